@@ -0,0 +1,89 @@
+package vncd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+/******************************************************************************
+  Admission
+ ******************************************************************************/
+
+// Admission is the decision about a new connection
+type Admission struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"` // logged if the connection is denied
+
+	// Class is a hint for the backend selection, available to context
+	// backend factories via AdmissionClassFromContext
+	Class string `json:"class,omitempty"`
+}
+
+// Admitter decides about a new connection before a backend is created for it
+type Admitter func(info ConnInfo) Admission
+
+// AdmissionWebhook returns an Admitter posting the ConnInfo of every connection
+// as JSON to url. The webhook responds with an Admission as JSON. If it fails
+// or does not respond within timeout, connections are admitted if failOpen is
+// set and denied otherwise.
+func AdmissionWebhook(url string, timeout time.Duration, failOpen bool) Admitter {
+	client := &http.Client{Timeout: timeout}
+	return func(info ConnInfo) Admission {
+		a, err := postAdmission(client, url, info)
+		if err != nil {
+			log.Printf("Admission webhook failed for session [%s]: %v", info.ID, err)
+			return Admission{Allowed: failOpen, Reason: "Admission webhook failed"}
+		}
+		return a
+	}
+}
+
+func postAdmission(client *http.Client, url string, info ConnInfo) (Admission, error) {
+	var a Admission
+	body, err := json.Marshal(info)
+	if err != nil {
+		return a, err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return a, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return a, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&a)
+	return a, err
+}
+
+// admit asks admitter (if not nil) about a connection. Denied connections are
+// logged.
+func admit(admitter Admitter, info ConnInfo) Admission {
+	if admitter == nil {
+		return Admission{Allowed: true}
+	}
+	a := admitter(info)
+	if !a.Allowed {
+		log.Printf("Connection [%s] from %s denied: %s", info.ID, info.RemoteAddr, a.Reason)
+	}
+	return a
+}
+
+type admissionClassKey struct{}
+
+// AdmissionClassFromContext returns the backend class suggested by the
+// admission of a connection, if any
+func AdmissionClassFromContext(ctx context.Context) (string, bool) {
+	c, ok := ctx.Value(admissionClassKey{}).(string)
+	return c, ok && c != ""
+}
+
+// contextWithAdmissionClass returns a context carrying a suggested backend class
+func contextWithAdmissionClass(ctx context.Context, class string) context.Context {
+	return context.WithValue(ctx, admissionClassKey{}, class)
+}
@@ -0,0 +1,147 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// commandStopTimeout is the time a command gets to exit after SIGTERM before
+// it is killed
+const commandStopTimeout = 5 * time.Second
+
+// CommandOptions configures the processes started by CreateCommandBackend
+type CommandOptions struct {
+	// Command is run with sh -c and has to start a VNC server listening on
+	// localhost at the port in the VNC_PORT environment variable, e.g.
+	// "x11vnc -localhost -rfbport $VNC_PORT -create"
+	Command string
+
+	// Port is the port passed to the command. A free port is chosen if 0.
+	Port int
+
+	// StartupTimeout, if set, makes CreateCommandBackend wait until the
+	// command accepts connections on its port
+	StartupTimeout time.Duration
+}
+
+/*
+CommandBackend implements a Backend that runs a local command, e.g. a VNC server
+for the session, instead of a container.
+
+The command runs in its own process group, which is terminated once the
+connection ends.
+*/
+type CommandBackend struct {
+	cmd    *exec.Cmd     // The running command
+	target net.TCPAddr   // The address the command listens on
+	exited chan struct{} // Closed once the command has exited
+	id     string        // The process ID of the command
+}
+
+// CreateCommandBackend starts the command in opts and returns a backend
+// handling requests with it
+func CreateCommandBackend(opts CommandOptions) (Backend, error) {
+	if opts.Command == "" {
+		return nil, errors.New("Command backend requires a command")
+	}
+
+	target := net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: opts.Port}
+	if target.Port == 0 {
+		addr, err := GetFreePort()
+		if err != nil {
+			return nil, err
+		}
+		target.Port = addr.Port
+	}
+
+	cmd := exec.Command("sh", "-c", opts.Command)
+	cmd.Env = append(os.Environ(), "VNC_PORT="+strconv.Itoa(target.Port))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Error starting command [%s]: %v", opts.Command, err)
+	}
+
+	b := &CommandBackend{
+		cmd:    cmd,
+		target: target,
+		exited: make(chan struct{}),
+		id:     "pid-" + strconv.Itoa(cmd.Process.Pid),
+	}
+	go func() {
+		cmd.Wait()
+		close(b.exited)
+	}()
+
+	if opts.StartupTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), opts.StartupTimeout)
+		err := b.Ready(ctx)
+		cancel()
+		if err != nil {
+			b.Terminate()
+			return nil, err
+		}
+	}
+
+	fmt.Printf("Command [%d] listening on %s\n", cmd.Process.Pid, target.String())
+	return b, nil
+}
+
+// GetTarget returns the address the command listens on. It fails if the
+// command has exited.
+func (b *CommandBackend) GetTarget() (*net.TCPAddr, error) {
+	select {
+	case <-b.exited:
+		return nil, fmt.Errorf("Command [%d] has exited: %v", b.cmd.Process.Pid, b.cmd.ProcessState)
+	default:
+	}
+	return &b.target, nil
+}
+
+// ID returns the process ID of the command
+func (b *CommandBackend) ID() string {
+	return b.id
+}
+
+// Ready waits until the command accepts connections on its port. It fails if
+// the command exits.
+func (b *CommandBackend) Ready(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-b.exited:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := waitAccepting(ctx, &b.target); err != nil {
+		if _, err := b.GetTarget(); err != nil {
+			return err
+		}
+		return fmt.Errorf("Command [%d] not accepting connections on %s: %v", b.cmd.Process.Pid, b.target.String(), err)
+	}
+	return nil
+}
+
+// Terminate stops the process group of the command. Processes still running
+// after commandStopTimeout are killed.
+func (b *CommandBackend) Terminate() {
+	pgid := b.cmd.Process.Pid
+	syscall.Kill(-pgid, syscall.SIGTERM)
+	select {
+	case <-b.exited:
+	case <-time.After(commandStopTimeout):
+		syscall.Kill(-pgid, syscall.SIGKILL)
+		<-b.exited
+	}
+	fmt.Printf("Command [%d] stopped\n", pgid)
+}
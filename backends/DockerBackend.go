@@ -3,9 +3,19 @@ package backends
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -13,10 +23,130 @@ import (
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// ErrBackendWarmingUp is returned when a backend is requested while its image
+// is still being pulled and the backend is configured to reject such requests
+var ErrBackendWarmingUp = errors.New("Backend warming up - image pull in progress")
+
+// Pull policies of Docker backends
+const (
+	PullAlways       = "always"       // pull before every container creation
+	PullIfNotPresent = "ifnotpresent" // pull if the image is not present locally
+	PullNever        = "never"        // never pull, fail if the image is absent
+)
+
+// imagePull tracks an image pull in progress. Concurrent backends requiring the
+// same image share a single pull.
+type imagePull struct {
+	done chan struct{} // closed when the pull has finished
+	err  error         // result of the pull (valid after done is closed)
+}
+
+var (
+	pullsMux sync.Mutex
+	pulls    = make(map[string]*imagePull)
+)
+
+// DockerOptions configures the containers created by CreateDockerBackend
+type DockerOptions struct {
+	Image   string // container type to be instantiated
+	Port    int    // exported port of the container (image default if 0)
+	Network string // Docker network name used for isolation
+
+	// RejectDuringPull fails with ErrBackendWarmingUp while the image is
+	// pulled for another backend, instead of waiting for the pull
+	RejectDuringPull bool
+
+	// StartupTimeout, if set, makes CreateDockerBackend wait until the
+	// container accepts connections on Port. The container is removed if it
+	// does not within the timeout.
+	StartupTimeout time.Duration
+
+	// PullPolicy decides when the image is pulled (PullIfNotPresent if empty)
+	PullPolicy string
+
+	// RegistryAuth holds the encoded credentials for pulling from a private
+	// registry (see EncodeRegistryAuth)
+	RegistryAuth string
+
+	// PullTimeout aborts image pulls taking longer (0 = no timeout)
+	PullTimeout time.Duration
+
+	// Env holds environment variables (KEY=value) set in the container
+	Env []string
+
+	// User (e.g. 1000:1000) runs the container process as a non-root user.
+	// Hostname sets the host name of the container. Image defaults if empty.
+	User     string
+	Hostname string
+
+	// Mounts holds bind mounts and volumes mounted into the container. The
+	// sources of bind mounts must exist on the host.
+	Mounts []mount.Mount
+
+	// Resource limits of the container. Zero values leave the Docker
+	// defaults in place.
+	CPUShares   int64 // relative CPU weight
+	NanoCPUs    int64 // CPU quota in units of 1e-9 CPUs
+	MemoryBytes int64 // memory limit in bytes
+
+	// GPUs requests NVIDIA GPUs like docker run --gpus: "all", a number of
+	// GPUs or "device=<id>[,<id>...]". No GPUs are requested if empty.
+	GPUs string
+
+	// ShmSize is the size of /dev/shm in bytes (Docker default of 64MB if 0).
+	// Browser based desktops usually need 1-2GB.
+	ShmSize int64
+
+	// NamePrefix names containers <NamePrefix>-<random>. Docker chooses a
+	// random name if empty.
+	NamePrefix string
+
+	// Labels are attached to the container (e.g. for docker ps --filter)
+	Labels map[string]string
+
+	// AutoRemove removes the container once it has been stopped
+	AutoRemove bool
+
+	// StopTimeout is the grace period for the container to stop before it is
+	// killed (Docker default if 0)
+	StopTimeout time.Duration
+
+	// AllowedImages restricts the images that may be launched. Patterns are
+	// globs (e.g. "registry.example.com/desktops/*") or regular expressions
+	// enclosed in slashes (e.g. "/^ubuntu:2[02]\.04$/"). All images are
+	// allowed if empty.
+	AllowedImages []string
+}
+
+// dockerClient is the part of the Docker API used by DockerBackend
+type dockerClient interface {
+	ImageInspectWithRaw(ctx context.Context, image string) (types.ImageInspect, []byte, error)
+	ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error)
+	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig,
+		networkingConfig *network.NetworkingConfig, platform *specs.Platform, name string) (container.ContainerCreateCreatedBody, error)
+	ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error
+	ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error
+	ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	ContainerExecCreate(ctx context.Context, containerID string, config types.ExecConfig) (types.IDResponse, error)
+	ContainerExecStart(ctx context.Context, execID string, config types.ExecStartCheck) error
+	ContainerExecInspect(ctx context.Context, execID string) (types.ContainerExecInspect, error)
+	NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error)
+	NetworkConnect(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error
+}
+
+// newDockerClient connects to the Docker daemon of the environment
+var newDockerClient = func() (dockerClient, error) {
+	return client.NewEnvClient()
+}
+
 /*
 DockerBackend implements a local Backend that spawns a new Docker container
 locally to handle the request
@@ -27,10 +157,11 @@ type DockerBackend struct {
 	containerID      string // ID of the created container
 	dockerNetwork    string // Docker network name used for isolation
 	target           net.TCPAddr
-	cli              *client.Client
+	cli              dockerClient
 	ctx              context.Context
 	containerRunning bool
 	termMux          sync.Mutex
+	options          DockerOptions
 }
 
 /*
@@ -39,74 +170,176 @@ type DockerBackend struct {
  ------------------------------------------------------------------------------
 */
 
-// GetTarget returns the internet address of the backing container
+// GetTarget returns the internet address of the backing container. An error is
+// returned if the address has never been set (e.g. container creation failed).
 func (b *DockerBackend) GetTarget() (*net.TCPAddr, error) {
+	if b.target.Port == 0 {
+		return nil, errors.New("Docker backend has no target address")
+	}
 	return &b.target, nil
 }
 
-// Terminate removes the backing container
+// ID returns the ID of the container
+func (b *DockerBackend) ID() string {
+	return b.containerID
+}
+
+// Ready waits until the container accepts connections at the target address
+func (b *DockerBackend) Ready(ctx context.Context) error {
+	target, err := b.GetTarget()
+	if err != nil {
+		return err
+	}
+	if err = waitAccepting(ctx, target); err != nil {
+		return fmt.Errorf("Container %s not accepting connections on %s: %v", b.containerID, target.String(), err)
+	}
+	return nil
+}
+
+// Terminate stops the backing container, which Docker removes if AutoRemove
+// is set. It is safe to call Terminate more than once and from several
+// goroutines; only the first successful call stops the container.
 func (b *DockerBackend) Terminate() {
 
 	b.termMux.Lock()
+	defer b.termMux.Unlock()
 
 	if !b.containerRunning {
 		return
 	}
 
 	ctx := context.Background()
-	cli, err := client.NewEnvClient()
+	cli, err := newDockerClient()
 	if err != nil {
 		fmt.Println("Error obtaining Docker environment. There might be ramnant containers!")
+		return
 	}
 	fmt.Print("Stopping container ", b.containerID, "... ")
 
-	if err = cli.ContainerStop(ctx, b.containerID, nil); err != nil {
+	var timeout *time.Duration
+	if b.options.StopTimeout > 0 {
+		timeout = &b.options.StopTimeout
+	}
+	if err = cli.ContainerStop(ctx, b.containerID, timeout); err != nil {
 		fmt.Println(err)
 	}
 	b.containerRunning = (err != nil)
-	b.termMux.Unlock()
 	fmt.Println("Done")
 }
 
+// Exec runs cmd inside the backing container and returns its exit code
+func (b *DockerBackend) Exec(ctx context.Context, cmd []string) (int, error) {
+	exec, err := b.cli.ContainerExecCreate(ctx, b.containerID, types.ExecConfig{Cmd: cmd})
+	if err != nil {
+		return -1, err
+	}
+	if err = b.cli.ContainerExecStart(ctx, exec.ID, types.ExecStartCheck{}); err != nil {
+		return -1, err
+	}
+	for {
+		inspect, err := b.cli.ContainerExecInspect(ctx, exec.ID)
+		if err != nil {
+			return -1, err
+		}
+		if !inspect.Running {
+			return inspect.ExitCode, nil
+		}
+		select {
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
 /******************************************************************************
   Implementation
  ******************************************************************************/
 
-// CreateDockerBackend creates the Docker container backend
-func CreateDockerBackend(image string, port int, network string) (Backend, error) {
+// CreateDockerBackend creates the Docker container backend. The image is pulled
+// according to the PullPolicy option. Only one pull per image is in progress at any
+// time; concurrent requests either wait for it to finish or, if
+// RejectDuringPull is set, fail with ErrBackendWarmingUp.
+func CreateDockerBackend(opts DockerOptions) (Backend, error) {
 	b := &DockerBackend{
-		Image:            image,
-		Port:             port,
-		dockerNetwork:    network,
+		Image:            opts.Image,
+		Port:             opts.Port,
+		dockerNetwork:    opts.Network,
 		ctx:              context.Background(),
 		containerRunning: false,
+		options:          opts,
+	}
+	port := opts.Port
+
+	if err := checkImageAllowed(opts.Image, opts.AllowedImages); err != nil {
+		return b, err
+	}
+
+	for _, m := range opts.Mounts {
+		if m.Type != mount.TypeBind {
+			continue
+		}
+		if _, err := os.Stat(m.Source); err != nil {
+			return b, fmt.Errorf("Invalid bind mount source [%s] for target [%s]: %v", m.Source, m.Target, err)
+		}
+	}
+
+	deviceRequests, err := gpuRequests(opts.GPUs)
+	if err != nil {
+		return b, err
 	}
 
-	var err error
-	b.cli, err = client.NewEnvClient()
+	b.cli, err = newDockerClient()
 	if err != nil {
 		return b, err
 	}
 
+	if err = b.ensureImage(); err != nil {
+		return b, err
+	}
+
+	// Default to the port exposed by the image
+	if port == 0 {
+		if port, err = b.imagePort(); err != nil {
+			return b, err
+		}
+		b.Port = port
+	}
+
 	containerPort := nat.Port(fmt.Sprintf("%d/tcp", port))
 	containerConfig := &container.Config{
-		Image: image,
+		Image: opts.Image,
 		ExposedPorts: nat.PortSet{
 			containerPort: struct{}{},
 		},
+		Env:      opts.Env,
+		Labels:   opts.Labels,
+		User:     opts.User,
+		Hostname: opts.Hostname,
 	}
 
-	var hostConfig *container.HostConfig
+	hostConfig := &container.HostConfig{
+		AutoRemove: opts.AutoRemove,
+		Mounts:     opts.Mounts,
+		ShmSize:    opts.ShmSize,
+		Resources: container.Resources{
+			CPUShares: opts.CPUShares,
+			NanoCPUs:  opts.NanoCPUs,
+			Memory:    opts.MemoryBytes,
+
+			DeviceRequests: deviceRequests,
+		},
+	}
 	runningInContainer, cID := runningInsideContainer()
 	if runningInContainer == true {
 		if b.dockerNetwork == "" {
 			fmt.Println("Connecting through docker default bridge")
 			// Default hostconfig is fine for this
 		} else {
-			// TODO: Make sure network exists
-			// TODO: Attach proxy to network (if needed)
-			fmt.Println("Attaching " + cID + " to network ")
-			// TODO: Configure hostConfig to use network
+			if err = b.ensureContainerNetwork(cID); err != nil {
+				return b, err
+			}
+			hostConfig.NetworkMode = container.NetworkMode(b.dockerNetwork)
 		}
 	} else {
 		fmt.Println("Exposing external port")
@@ -125,29 +358,26 @@ func CreateDockerBackend(image string, port int, network string) (Backend, error
 			return b, err
 		}
 		b.target = *hostPort
-		hostConfig = &container.HostConfig{
-			PortBindings: nat.PortMap{
-				containerPort: []nat.PortBinding{
-					{
-						HostIP:   hostPort.IP.String(),
-						HostPort: strconv.Itoa(hostPort.Port),
-					},
+		hostConfig.PortBindings = nat.PortMap{
+			containerPort: []nat.PortBinding{
+				{
+					HostIP:   hostPort.IP.String(),
+					HostPort: strconv.Itoa(hostPort.Port),
 				},
 			},
 		}
 	}
 
-	resp, err := b.cli.ContainerCreate(b.ctx, containerConfig, hostConfig, nil, "")
+	name := containerName(opts.NamePrefix)
+	resp, err := b.cli.ContainerCreate(b.ctx, containerConfig, hostConfig, nil, nil, name)
 	if err != nil {
-		if err = b.pullImage(); err != nil {
-			return b, err
-		}
-		resp, err = b.cli.ContainerCreate(b.ctx, containerConfig, hostConfig, nil, "")
 		return b, err
 	}
 	b.containerID = resp.ID
 
+	// From here on, the container is removed if the backend cannot be used
 	if err = b.cli.ContainerStart(b.ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		b.remove()
 		return b, err
 	}
 	b.containerRunning = true
@@ -159,22 +389,128 @@ func CreateDockerBackend(image string, port int, network string) (Backend, error
 		var addr *net.TCPAddr
 		containerIP, err = b.getContainerIP(b.containerID)
 		if err != nil {
+			b.remove()
 			return b, err
 		}
 		addr, err = net.ResolveTCPAddr("tcp", containerIP+":"+strconv.Itoa(port))
 		if err != nil {
+			b.remove()
 			return b, err
 		}
 		b.target = *addr
 	}
 
+	// Wait for the server inside the container to come up
+	if opts.StartupTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), opts.StartupTimeout)
+		err = b.Ready(ctx)
+		cancel()
+		if err != nil {
+			b.remove()
+			return b, err
+		}
+	}
+
 	fmt.Println("Container listining on " + b.target.String())
 
 	return b, nil
 }
 
+// remove forcibly removes the backing container, e.g. after a failed startup
+func (b *DockerBackend) remove() {
+	b.termMux.Lock()
+	defer b.termMux.Unlock()
+
+	err := b.cli.ContainerRemove(b.ctx, b.containerID, types.ContainerRemoveOptions{Force: true})
+	if err != nil {
+		fmt.Println("Error removing container " + b.containerID + ": " + err.Error())
+		return
+	}
+	b.containerRunning = false
+}
+
+// imagePort returns the single TCP port exposed by the backend image
+func (b *DockerBackend) imagePort() (int, error) {
+	inspect, _, err := b.cli.ImageInspectWithRaw(b.ctx, b.Image)
+	if err != nil {
+		return 0, err
+	}
+
+	var ports []nat.Port
+	if inspect.Config != nil {
+		for p := range inspect.Config.ExposedPorts {
+			if p.Proto() == "tcp" {
+				ports = append(ports, p)
+			}
+		}
+	}
+	switch len(ports) {
+	case 0:
+		return 0, fmt.Errorf("No port configured and image %s exposes no TCP port", b.Image)
+	case 1:
+		return ports[0].Int(), nil
+	}
+	return 0, fmt.Errorf("No port configured and image %s exposes several TCP ports %v", b.Image, ports)
+}
+
+// ensureImage makes the backend image available according to the pull policy
+func (b *DockerBackend) ensureImage() error {
+	switch b.options.PullPolicy {
+	case PullAlways:
+		return b.pullImage()
+	case PullIfNotPresent, "":
+		_, _, err := b.cli.ImageInspectWithRaw(b.ctx, b.Image)
+		if client.IsErrNotFound(err) {
+			return b.pullImage()
+		}
+		return err
+	case PullNever:
+		_, _, err := b.cli.ImageInspectWithRaw(b.ctx, b.Image)
+		if client.IsErrNotFound(err) {
+			return fmt.Errorf("Docker image %s not present and pull policy is %s", b.Image, PullNever)
+		}
+		return err
+	}
+	return fmt.Errorf("Unknown pull policy: %s", b.options.PullPolicy)
+}
+
+// pullImage pulls the backend image, joining a pull of the same image that is
+// already in progress
 func (b *DockerBackend) pullImage() error {
 
+	pullsMux.Lock()
+	if pull, ok := pulls[b.Image]; ok {
+		pullsMux.Unlock()
+		if b.options.RejectDuringPull {
+			return ErrBackendWarmingUp
+		}
+		fmt.Println("Waiting for pull of docker image " + b.Image)
+		<-pull.done
+		return pull.err
+	}
+	pull := &imagePull{done: make(chan struct{})}
+	pulls[b.Image] = pull
+	pullsMux.Unlock()
+
+	pull.err = b.doPullImage()
+
+	pullsMux.Lock()
+	delete(pulls, b.Image)
+	pullsMux.Unlock()
+	close(pull.done)
+
+	return pull.err
+}
+
+func (b *DockerBackend) doPullImage() error {
+
+	ctx := b.ctx
+	if b.options.PullTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.options.PullTimeout)
+		defer cancel()
+	}
+
 	pullCh := make(chan bool)
 	fmt.Print("Pulling docker image " + b.Image + " ")
 	go func() {
@@ -191,10 +527,164 @@ func (b *DockerBackend) pullImage() error {
 		}
 	}()
 
-	_, err := b.cli.ImagePull(b.ctx, b.Image, types.ImagePullOptions{})
-	//io.Copy(os.Stdout, out)
+	out, err := b.cli.ImagePull(ctx, b.Image, types.ImagePullOptions{
+		RegistryAuth: b.options.RegistryAuth,
+	})
+	if err == nil {
+		err = readPullProgress(out)
+		out.Close()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("Timeout pulling docker image %s after %v", b.Image, b.options.PullTimeout)
+	}
 	pullCh <- (err == nil)
+	if err != nil {
+		fmt.Println(" Failed")
+	}
+
+	return err
+}
+
+// EncodeRegistryAuth encodes registry credentials for DockerOptions.RegistryAuth
+func EncodeRegistryAuth(auth types.AuthConfig) (string, error) {
+	buf, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
+
+// RegistryAuthFromConfigFile reads the credentials for server from a Docker
+// client configuration file (e.g. ~/.docker/config.json). Credentials kept in
+// a credential helper are not supported.
+func RegistryAuthFromConfigFile(file string, server string) (types.AuthConfig, error) {
+	var dockerConfig struct {
+		Auths map[string]types.AuthConfig `json:"auths"`
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return types.AuthConfig{}, err
+	}
+	if err = json.Unmarshal(buf, &dockerConfig); err != nil {
+		return types.AuthConfig{}, err
+	}
+
+	auth, ok := dockerConfig.Auths[server]
+	if !ok {
+		return auth, fmt.Errorf("No credentials for registry %s in %s", server, file)
+	}
+	auth.ServerAddress = server
+
+	// The auth field holds base64 encoded username:password
+	if auth.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return auth, err
+		}
+		userpass := strings.SplitN(string(decoded), ":", 2)
+		if len(userpass) != 2 {
+			return auth, fmt.Errorf("Invalid credentials for registry %s in %s", server, file)
+		}
+		auth.Username, auth.Password, auth.Auth = userpass[0], userpass[1], ""
+	}
+	return auth, nil
+}
+
+// readPullProgress consumes the JSON progress stream of an image pull. The
+// pull only completes while the stream is read. Errors reported in the stream
+// are returned.
+func readPullProgress(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var msg struct {
+			Error       string `json:"error"`
+			ErrorDetail struct {
+				Message string `json:"message"`
+			} `json:"errorDetail"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.ErrorDetail.Message != "" {
+			return errors.New(msg.ErrorDetail.Message)
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+	}
+}
+
+// gpuRequests translates a GPU request (see DockerOptions.GPUs) into device
+// requests for the NVIDIA runtime
+func gpuRequests(gpus string) ([]container.DeviceRequest, error) {
+	if gpus == "" {
+		return nil, nil
+	}
+
+	req := container.DeviceRequest{
+		Driver:       "nvidia",
+		Capabilities: [][]string{{"gpu"}},
+	}
+	switch {
+	case gpus == "all":
+		req.Count = -1
+	case strings.HasPrefix(gpus, "device="):
+		req.DeviceIDs = strings.Split(strings.TrimPrefix(gpus, "device="), ",")
+	default:
+		count, err := strconv.Atoi(gpus)
+		if err != nil || count < 1 {
+			return nil, fmt.Errorf("Invalid GPU request [%s]", gpus)
+		}
+		req.Count = count
+	}
+	return []container.DeviceRequest{req}, nil
+}
+
+// checkImageAllowed returns an error unless image matches one of the patterns
+// (see DockerOptions.AllowedImages) or there are no patterns
+func checkImageAllowed(image string, patterns []string) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+	for _, p := range patterns {
+		var ok bool
+		var err error
+		if len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+			ok, err = regexp.MatchString(p[1:len(p)-1], image)
+		} else {
+			ok, err = path.Match(p, image)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid allowed image pattern [%s]: %v", p, err)
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("Image [%s] is not allowed", image)
+}
 
+// containerName returns a unique container name starting with prefix, or an
+// empty name (chosen by Docker) if prefix is empty
+func containerName(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	return prefix + "-" + hex.EncodeToString(suffix)
+}
+
+// PingDocker returns an error if the Docker daemon of the environment does not
+// respond
+func PingDocker(ctx context.Context) error {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return err
+	}
+	_, err = cli.Ping(ctx)
 	return err
 }
 
@@ -225,25 +715,66 @@ func runningInsideContainer() (bool, string) {
 	defer cgroup.Close()
 
 	scanner := bufio.NewScanner(cgroup)
-	for success := scanner.Scan(); success == true; {
-		line := scanner.Text()
-		d := strings.Split(strings.Split(line, ":")[2], "/")
-		if d[1] == "docker" {
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		d := strings.Split(fields[2], "/")
+		if len(d) > 2 && d[1] == "docker" {
 			return true, d[2]
 		}
 	}
 	return false, ""
 }
 
+// getContainerIP returns the IP address of a container on the backend network.
+// Without a configured network, the address on the default bridge is used, or
+// the address on any other network the container is attached to.
 func (b *DockerBackend) getContainerIP(contID string) (string, error) {
 	resp, err := b.cli.ContainerInspect(b.ctx, contID)
 	if err != nil {
 		return "", err
 	}
+	settings := resp.NetworkSettings
+	if settings == nil {
+		return "", fmt.Errorf("Container %s has no network settings", contID)
+	}
+
+	if b.dockerNetwork != "" {
+		if endpoint, ok := settings.Networks[b.dockerNetwork]; ok && endpoint != nil && endpoint.IPAddress != "" {
+			return endpoint.IPAddress, nil
+		}
+		return "", fmt.Errorf("Container %s has no address on network [%s]", contID, b.dockerNetwork)
+	}
 
-	return resp.NetworkSettings.DefaultNetworkSettings.IPAddress, nil
+	if settings.DefaultNetworkSettings.IPAddress != "" {
+		return settings.DefaultNetworkSettings.IPAddress, nil
+	}
+	names := make([]string, 0, len(settings.Networks))
+	for name := range settings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names) // deterministic choice
+	for _, name := range names {
+		if endpoint := settings.Networks[name]; endpoint != nil && endpoint.IPAddress != "" {
+			return endpoint.IPAddress, nil
+		}
+	}
+	return "", fmt.Errorf("Container %s has no IP address", contID)
 }
 
-func ensureContainerNetwork(contID string) {
+// ensureContainerNetwork makes sure the backend network exists and that the
+// proxy container contID is attached to it, so that it can reach the backends
+func (b *DockerBackend) ensureContainerNetwork(contID string) error {
+	resource, err := b.cli.NetworkInspect(b.ctx, b.dockerNetwork, types.NetworkInspectOptions{})
+	if err != nil {
+		return fmt.Errorf("Docker network [%s] not available: %v", b.dockerNetwork, err)
+	}
+	if _, ok := resource.Containers[contID]; ok {
+		return nil
+	}
 
+	fmt.Println("Attaching " + contID + " to network " + b.dockerNetwork)
+	return b.cli.NetworkConnect(b.ctx, b.dockerNetwork, contID, nil)
 }
@@ -0,0 +1,437 @@
+package backends
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeDocker is a Docker daemon that records the requests of DockerBackends
+type fakeDocker struct {
+	mux sync.Mutex
+
+	image types.ImageInspect // returned for every image
+	pull  string             // progress stream of image pulls
+
+	pullOptions *types.ImagePullOptions
+	config      *container.Config
+	hostConfig  *container.HostConfig
+	stops       int
+	stopTimeout *time.Duration
+}
+
+// useFakeDocker makes backends created during the test talk to d
+func useFakeDocker(t *testing.T, d *fakeDocker) {
+	create := newDockerClient
+	newDockerClient = func() (dockerClient, error) { return d, nil }
+	t.Cleanup(func() { newDockerClient = create })
+}
+
+func (d *fakeDocker) ImageInspectWithRaw(ctx context.Context, image string) (types.ImageInspect, []byte, error) {
+	return d.image, nil, nil
+}
+
+func (d *fakeDocker) ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.pullOptions = &options
+	return ioutil.NopCloser(strings.NewReader(d.pull)), nil
+}
+
+func (d *fakeDocker) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig,
+	networkingConfig *network.NetworkingConfig, platform *specs.Platform, name string) (container.ContainerCreateCreatedBody, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.config, d.hostConfig = config, hostConfig
+	return container.ContainerCreateCreatedBody{ID: "fake"}, nil
+}
+
+func (d *fakeDocker) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
+	return nil
+}
+
+func (d *fakeDocker) ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.stops++
+	if timeout != nil {
+		t := *timeout
+		d.stopTimeout = &t
+	}
+	return nil
+}
+
+func (d *fakeDocker) ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error {
+	return nil
+}
+
+func (d *fakeDocker) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	settings := &types.NetworkSettings{}
+	settings.DefaultNetworkSettings.IPAddress = "127.0.0.1"
+	return types.ContainerJSON{NetworkSettings: settings}, nil
+}
+
+func (d *fakeDocker) ContainerExecCreate(ctx context.Context, containerID string, config types.ExecConfig) (types.IDResponse, error) {
+	return types.IDResponse{ID: "exec"}, nil
+}
+
+func (d *fakeDocker) ContainerExecStart(ctx context.Context, execID string, config types.ExecStartCheck) error {
+	return nil
+}
+
+func (d *fakeDocker) ContainerExecInspect(ctx context.Context, execID string) (types.ContainerExecInspect, error) {
+	return types.ContainerExecInspect{}, nil
+}
+
+func (d *fakeDocker) NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	return types.NetworkResource{}, nil
+}
+
+func (d *fakeDocker) NetworkConnect(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+	return nil
+}
+
+// createFakeBackend creates a backend with opts against d
+func createFakeBackend(t *testing.T, d *fakeDocker, opts DockerOptions) *DockerBackend {
+	t.Helper()
+	useFakeDocker(t, d)
+	if opts.Image == "" {
+		opts.Image = "vnc"
+	}
+	b, err := CreateDockerBackend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.(*DockerBackend)
+}
+
+func TestDockerStopTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		want    *time.Duration
+	}{
+		{"Docker default", 0, nil},
+		{"grace period", 5 * time.Second, durationPtr(5 * time.Second)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &fakeDocker{}
+			b := createFakeBackend(t, d, DockerOptions{Port: 5900, StopTimeout: tt.timeout})
+			b.Terminate()
+
+			if d.stops != 1 {
+				t.Fatalf("Container stopped %d times, want once", d.stops)
+			}
+			if (d.stopTimeout == nil) != (tt.want == nil) || d.stopTimeout != nil && *d.stopTimeout != *tt.want {
+				t.Errorf("Stop timeout = %v, want %v", d.stopTimeout, tt.want)
+			}
+		})
+	}
+}
+
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
+
+func TestDockerShmSize(t *testing.T) {
+	tests := []struct {
+		name string
+		size int64
+	}{
+		{"Docker default", 0},
+		{"2GB", 2 << 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &fakeDocker{}
+			createFakeBackend(t, d, DockerOptions{Port: 5900, ShmSize: tt.size})
+			if d.hostConfig.ShmSize != tt.size {
+				t.Errorf("ShmSize = %d, want %d", d.hostConfig.ShmSize, tt.size)
+			}
+		})
+	}
+}
+
+func TestGPURequests(t *testing.T) {
+	tests := []struct {
+		gpus      string
+		wantCount int
+		wantIDs   []string
+		wantNone  bool
+		wantErr   bool
+	}{
+		{gpus: "", wantNone: true},
+		{gpus: "all", wantCount: -1},
+		{gpus: "2", wantCount: 2},
+		{gpus: "device=0,1", wantIDs: []string{"0", "1"}},
+		{gpus: "0", wantErr: true},
+		{gpus: "-1", wantErr: true},
+		{gpus: "many", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.gpus, func(t *testing.T) {
+			reqs, err := gpuRequests(tt.gpus)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("gpuRequests(%q) error = %v, want error %t", tt.gpus, err, tt.wantErr)
+			}
+			if tt.wantErr || tt.wantNone {
+				if len(reqs) != 0 {
+					t.Errorf("gpuRequests(%q) = %v, want none", tt.gpus, reqs)
+				}
+				return
+			}
+			if len(reqs) != 1 {
+				t.Fatalf("gpuRequests(%q) = %v, want a single request", tt.gpus, reqs)
+			}
+			r := reqs[0]
+			if r.Driver != "nvidia" || !reflect.DeepEqual(r.Capabilities, [][]string{{"gpu"}}) {
+				t.Errorf("gpuRequests(%q) requests driver %s with %v", tt.gpus, r.Driver, r.Capabilities)
+			}
+			if r.Count != tt.wantCount || !reflect.DeepEqual(r.DeviceIDs, tt.wantIDs) {
+				t.Errorf("gpuRequests(%q) = count %d, devices %v, want %d, %v", tt.gpus, r.Count, r.DeviceIDs, tt.wantCount, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestDockerDeviceRequests(t *testing.T) {
+	d := &fakeDocker{}
+	createFakeBackend(t, d, DockerOptions{Port: 5900, GPUs: "device=0,1"})
+	want, _ := gpuRequests("device=0,1")
+	if got := d.hostConfig.Resources.DeviceRequests; !reflect.DeepEqual(got, want) {
+		t.Errorf("DeviceRequests = %v, want %v", got, want)
+	}
+
+	// Invalid requests fail before a container is created
+	useFakeDocker(t, d)
+	d.hostConfig = nil
+	if _, err := CreateDockerBackend(DockerOptions{Image: "vnc", Port: 5900, GPUs: "many"}); err == nil {
+		t.Error("Invalid GPU request accepted")
+	}
+	if d.hostConfig != nil {
+		t.Error("Container created despite an invalid GPU request")
+	}
+}
+
+func TestCheckImageAllowed(t *testing.T) {
+	tests := []struct {
+		name     string
+		image    string
+		patterns []string
+		wantErr  bool
+	}{
+		{"no patterns", "anything:latest", nil, false},
+		{"exact glob", "ubuntu:22.04", []string{"ubuntu:22.04"}, false},
+		{"glob", "registry.example.com/desktops/xfce", []string{"registry.example.com/desktops/*"}, false},
+		{"glob does not cross slashes", "registry.example.com/desktops/team/xfce", []string{"registry.example.com/desktops/*"}, true},
+		{"second pattern", "vnc:latest", []string{"ubuntu:*", "vnc:*"}, false},
+		{"regular expression", "ubuntu:20.04", []string{`/^ubuntu:2[02]\.04$/`}, false},
+		{"regular expression mismatch", "ubuntu:18.04", []string{`/^ubuntu:2[02]\.04$/`}, true},
+		{"unanchored regular expression", "evil/ubuntu:20.04", []string{`/ubuntu/`}, false},
+		{"no match", "evil:latest", []string{"ubuntu:*"}, true},
+		{"invalid glob", "ubuntu", []string{"[ubuntu"}, true},
+		{"invalid regular expression", "ubuntu", []string{"/(ubuntu/"}, true},
+		{"single slash is a glob", "/", []string{"/"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkImageAllowed(tt.image, tt.patterns); (err != nil) != tt.wantErr {
+				t.Errorf("checkImageAllowed(%q, %q) = %v, want error %t", tt.image, tt.patterns, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDockerImageNotAllowed(t *testing.T) {
+	d := &fakeDocker{}
+	useFakeDocker(t, d)
+	_, err := CreateDockerBackend(DockerOptions{Image: "evil", Port: 5900, AllowedImages: []string{"vnc:*"}})
+	if err == nil {
+		t.Fatal("Image not allowed was launched")
+	}
+	if d.config != nil {
+		t.Error("Container created for an image not allowed")
+	}
+}
+
+func TestReadPullProgress(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  string
+		wantErr string // "" = no error
+	}{
+		{"empty", "", ""},
+		{"progress", `{"status":"Pulling fs layer"}` + "\n" + `{"status":"Download complete"}`, ""},
+		{"error detail", `{"status":"Pulling"}{"errorDetail":{"message":"manifest unknown"},"error":"failed"}`, "manifest unknown"},
+		{"error only", `{"error":"denied"}`, "denied"},
+		{"malformed", `{"status":`, "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := readPullProgress(strings.NewReader(tt.stream))
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("readPullProgress() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDockerPullError(t *testing.T) {
+	d := &fakeDocker{pull: `{"error":"denied"}`}
+	useFakeDocker(t, d)
+	if _, err := CreateDockerBackend(DockerOptions{Image: "vnc", Port: 5900, PullPolicy: PullAlways}); err == nil {
+		t.Fatal("Failed pull accepted")
+	}
+	if d.config != nil {
+		t.Error("Container created after a failed pull")
+	}
+}
+
+func TestRegistryAuthFromConfigFile(t *testing.T) {
+	userpass := base64.StdEncoding.EncodeToString([]byte("alice:s3:cret"))
+	config := `{"auths": {
+		"registry.example.com": {"auth": "` + userpass + `"},
+		"plain.example.com": {"username": "bob", "password": "secret"},
+		"broken.example.com": {"auth": "not base64!"},
+		"nocolon.example.com": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("alice")) + `"}
+	}}`
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(file, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		file       string
+		server     string
+		wantUser   string
+		wantPasswd string
+		wantErr    bool
+	}{
+		{name: "encoded credentials", file: file, server: "registry.example.com", wantUser: "alice", wantPasswd: "s3:cret"},
+		{name: "plain credentials", file: file, server: "plain.example.com", wantUser: "bob", wantPasswd: "secret"},
+		{name: "unknown registry", file: file, server: "other.example.com", wantErr: true},
+		{name: "invalid encoding", file: file, server: "broken.example.com", wantErr: true},
+		{name: "no password", file: file, server: "nocolon.example.com", wantErr: true},
+		{name: "missing file", file: file + ".missing", server: "registry.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := RegistryAuthFromConfigFile(tt.file, tt.server)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RegistryAuthFromConfigFile() error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if auth.Username != tt.wantUser || auth.Password != tt.wantPasswd || auth.ServerAddress != tt.server || auth.Auth != "" {
+				t.Errorf("RegistryAuthFromConfigFile() = %+v", auth)
+			}
+		})
+	}
+}
+
+func TestDockerRegistryAuth(t *testing.T) {
+	token, err := EncodeRegistryAuth(types.AuthConfig{Username: "alice", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDocker{}
+	createFakeBackend(t, d, DockerOptions{Port: 5900, PullPolicy: PullAlways, RegistryAuth: token})
+	if d.pullOptions == nil || d.pullOptions.RegistryAuth != token {
+		t.Errorf("Pull options %+v do not carry the registry auth %s", d.pullOptions, token)
+	}
+}
+
+func TestDockerTerminateTwice(t *testing.T) {
+	tests := []struct {
+		name      string
+		running   bool
+		wantStops int
+	}{
+		{"never started", false, 0},
+		{"running", true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &fakeDocker{}
+			useFakeDocker(t, d)
+			b := &DockerBackend{containerID: "fake", containerRunning: tt.running}
+
+			// Terminate from two goroutines and once more afterwards
+			var wg sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					b.Terminate()
+				}()
+			}
+			wg.Wait()
+			b.Terminate()
+
+			if d.stops != tt.wantStops {
+				t.Errorf("Container stopped %d times, want %d", d.stops, tt.wantStops)
+			}
+		})
+	}
+}
+
+func TestDockerImagePort(t *testing.T) {
+	tests := []struct {
+		name    string
+		exposed []string
+		port    int // configured port
+		want    int
+		wantErr bool
+	}{
+		{name: "single exposed port", exposed: []string{"5901/tcp"}, want: 5901},
+		{name: "udp ports ignored", exposed: []string{"5901/tcp", "5353/udp"}, want: 5901},
+		{name: "configured port", exposed: []string{"5901/tcp", "6080/tcp"}, port: 5900, want: 5900},
+		{name: "several exposed ports", exposed: []string{"5901/tcp", "6080/tcp"}, wantErr: true},
+		{name: "no exposed port", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ports := nat.PortSet{}
+			for _, p := range tt.exposed {
+				ports[nat.Port(p)] = struct{}{}
+			}
+			d := &fakeDocker{image: types.ImageInspect{Config: &container.Config{ExposedPorts: ports}}}
+			useFakeDocker(t, d)
+
+			b, err := CreateDockerBackend(DockerOptions{Image: "vnc", Port: tt.port})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreateDockerBackend() error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if d.config != nil {
+					t.Error("Container created without a port")
+				}
+				return
+			}
+			if port := b.(*DockerBackend).Port; port != tt.want {
+				t.Errorf("Port = %d, want %d", port, tt.want)
+			}
+			want := nat.Port(fmt.Sprintf("%d/tcp", tt.want))
+			if _, ok := d.config.ExposedPorts[want]; !ok || len(d.config.ExposedPorts) != 1 {
+				t.Errorf("Container exposes %v, want %s", d.config.ExposedPorts, want)
+			}
+		})
+	}
+}
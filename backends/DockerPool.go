@@ -0,0 +1,165 @@
+package backends
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// poolMaxRetries failed container creations make a pool give up a slot. It is
+// refilled once a backend has been created on demand again.
+const poolMaxRetries = 10
+
+// Delays before a pool retries a failed container creation. The delay doubles
+// after every failure up to poolMaxRetryInterval.
+var (
+	poolRetryInterval    = 5 * time.Second
+	poolMaxRetryInterval = 5 * time.Minute
+)
+
+/*
+DockerBackendPool keeps a number of Docker backends created in advance, so
+that new sessions do not have to wait for a container to start. Each backend
+taken from the pool is replaced asynchronously. If the pool is exhausted,
+backends are created on demand.
+
+Backends taken from the pool are owned by the caller and stopped by their
+Terminate method as usual.
+*/
+type DockerBackendPool struct {
+	options DockerOptions
+	idle    chan Backend
+	mux     sync.Mutex
+	closed  bool
+	missing int // slots given up after repeated failures
+
+	// create creates the backends of the pool (CreateDockerBackend)
+	create func(DockerOptions) (Backend, error)
+}
+
+// NewDockerBackendPool creates a pool of size backends created with opts. The
+// pool is filled in the background.
+func NewDockerBackendPool(opts DockerOptions, size int) *DockerBackendPool {
+	return newPool(opts, size, CreateDockerBackend)
+}
+
+func newPool(opts DockerOptions, size int, create func(DockerOptions) (Backend, error)) *DockerBackendPool {
+	p := &DockerBackendPool{
+		options: opts,
+		idle:    make(chan Backend, size),
+		create:  create,
+	}
+	for i := 0; i < size; i++ {
+		go p.replenish()
+	}
+	return p
+}
+
+// Get returns a backend from the pool or creates a new one if the pool is
+// empty
+func (p *DockerBackendPool) Get() (Backend, error) {
+	select {
+	case b, ok := <-p.idle:
+		if ok {
+			go p.replenish()
+			return b, nil
+		}
+	default:
+	}
+	b, err := p.create(p.options)
+	if err == nil {
+		p.refill()
+	}
+	return b, err
+}
+
+// Options returns the options of the backends created by the pool
+func (p *DockerBackendPool) Options() DockerOptions {
+	return p.options
+}
+
+// Size returns the number of backends the pool keeps
+func (p *DockerBackendPool) Size() int {
+	return cap(p.idle)
+}
+
+// Idle returns the number of backends waiting in the pool
+func (p *DockerBackendPool) Idle() int {
+	return len(p.idle)
+}
+
+// Close terminates the backends in the pool and stops replenishing it
+func (p *DockerBackendPool) Close() {
+	p.mux.Lock()
+	if p.closed {
+		p.mux.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.idle)
+	p.mux.Unlock()
+
+	for b := range p.idle {
+		b.Terminate()
+	}
+}
+
+// refill replenishes the slots given up after repeated failures, as backends
+// can be created again
+func (p *DockerBackendPool) refill() {
+	p.mux.Lock()
+	n := p.missing
+	p.missing = 0
+	p.mux.Unlock()
+	for i := 0; i < n; i++ {
+		go p.replenish()
+	}
+}
+
+// replenish adds a backend to the pool, retrying with increasing delays until
+// creation succeeds, poolMaxRetries attempts have failed or the pool is closed
+func (p *DockerBackendPool) replenish() {
+	delay := poolRetryInterval
+	for attempt := 1; ; attempt++ {
+		b, err := p.create(p.options)
+		if err == nil {
+			p.mux.Lock()
+			closed := p.closed
+			if !closed {
+				p.idle <- b
+			}
+			p.mux.Unlock()
+			if closed {
+				b.Terminate()
+			}
+			return
+		}
+
+		p.mux.Lock()
+		closed := p.closed
+		if !closed && attempt == poolMaxRetries {
+			p.missing++
+		}
+		p.mux.Unlock()
+		if closed {
+			return
+		}
+		if attempt == poolMaxRetries {
+			log.Printf("Giving up creating pooled backend after %d attempts: %v", attempt, err)
+			return
+		}
+
+		log.Printf("Error creating pooled backend (retrying in %s): %v", delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > poolMaxRetryInterval {
+			delay = poolMaxRetryInterval
+		}
+
+		p.mux.Lock()
+		closed = p.closed
+		p.mux.Unlock()
+		if closed {
+			return
+		}
+	}
+}
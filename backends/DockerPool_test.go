@@ -0,0 +1,136 @@
+package backends
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeBackend is a backend created by a fakeCreator
+type fakeBackend struct {
+	BaseBackend
+	terminated int32
+}
+
+func (b *fakeBackend) GetTarget() (*net.TCPAddr, error) { return &net.TCPAddr{}, nil }
+func (b *fakeBackend) ID() string                       { return "fake" }
+func (b *fakeBackend) Terminate()                       { atomic.StoreInt32(&b.terminated, 1) }
+
+// fakeCreator creates fakeBackends while it is not failing
+type fakeCreator struct {
+	mux     sync.Mutex
+	fail    bool
+	calls   int
+	created []*fakeBackend
+}
+
+func (c *fakeCreator) create(DockerOptions) (Backend, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.calls++
+	if c.fail {
+		return nil, errors.New("Creation failed")
+	}
+	b := &fakeBackend{}
+	c.created = append(c.created, b)
+	return b, nil
+}
+
+func (c *fakeCreator) setFail(fail bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.fail = fail
+}
+
+func (c *fakeCreator) callCount() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.calls
+}
+
+// shortRetries makes pools retry quickly during a test
+func shortRetries(t *testing.T) {
+	interval, max := poolRetryInterval, poolMaxRetryInterval
+	poolRetryInterval, poolMaxRetryInterval = time.Millisecond, 4*time.Millisecond
+	t.Cleanup(func() {
+		poolRetryInterval, poolMaxRetryInterval = interval, max
+	})
+}
+
+// eventually waits up to a second for cond to become true
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for " + what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDockerPoolFills(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"single backend", 1},
+		{"several backends", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &fakeCreator{}
+			p := newPool(DockerOptions{}, tt.size, c.create)
+			defer p.Close()
+			eventually(t, "pool to fill", func() bool { return p.Idle() == tt.size })
+
+			// Taking a backend replaces it
+			if _, err := p.Get(); err != nil {
+				t.Fatal(err)
+			}
+			eventually(t, "pool to be replenished", func() bool { return p.Idle() == tt.size })
+			if n := c.callCount(); n != tt.size+1 {
+				t.Errorf("%d backends created, want %d", n, tt.size+1)
+			}
+		})
+	}
+}
+
+func TestDockerPoolGivesUp(t *testing.T) {
+	shortRetries(t)
+	c := &fakeCreator{fail: true}
+	p := newPool(DockerOptions{}, 2, c.create)
+	defer p.Close()
+
+	want := 2 * poolMaxRetries
+	eventually(t, "pool to give up", func() bool { return c.callCount() == want })
+	time.Sleep(20 * poolMaxRetryInterval)
+	if n := c.callCount(); n != want {
+		t.Errorf("%d creation attempts, want %d", n, want)
+	}
+
+	// Creating a backend on demand refills the slots given up
+	c.setFail(false)
+	if _, err := p.Get(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "pool to be refilled", func() bool { return p.Idle() == 2 })
+}
+
+func TestDockerPoolClose(t *testing.T) {
+	c := &fakeCreator{}
+	p := newPool(DockerOptions{}, 2, c.create)
+	eventually(t, "pool to fill", func() bool { return p.Idle() == 2 })
+	p.Close()
+	p.Close() // closing twice is harmless
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for i, b := range c.created {
+		if atomic.LoadInt32(&b.terminated) == 0 {
+			t.Errorf("Pooled backend %d not terminated", i)
+		}
+	}
+}
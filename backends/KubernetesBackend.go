@@ -1,20 +1,129 @@
 package backends
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/apimachinery/pkg/watch"
 	k8s "k8s.io/client-go/kubernetes"
 )
 
 const (
-	// podAnnotationLock is used to lock pods and prevent assigning multiple connections
+	// DefaultLockAnnotation is used to lock pods and prevent assigning multiple connections
 	// to the same pod at the same time
-	podAnnotationLock = "kramergroup.science.vncd.lock"
+	DefaultLockAnnotation = "kramergroup.science.vncd.lock"
+
+	// requestTimeout limits API requests of backends after creation, which
+	// have no context of the caller
+	requestTimeout = 10 * time.Second
 )
 
+// KubernetesOptions configures the pods selected by CreateKubernetesBackend
+type KubernetesOptions struct {
+	Namespace     string // namespace of the pods
+	LabelSelector string // label selector matching suitable pods
+	FieldSelector string // field selector further restricting pods (optional)
+	Port          int    // port at which the container is listening
+
+	// Ephemeral deletes pods once they have handled a connection instead of
+	// unlocking them for the next connection. Replacement pods are left to
+	// Kubernetes (e.g. a Deployment).
+	Ephemeral bool
+
+	// GracePeriod is the time deleted pods get to shut down (the grace period
+	// of the pod if negative)
+	GracePeriod time.Duration
+
+	// PreferNode, if set, selects pods running on this node (e.g. the node
+	// of the proxy) before pods on other nodes
+	PreferNode string
+
+	// ReadyTimeout makes GetTarget wait up to the given time for the pod to
+	// be Ready and have an IP (do not wait if 0). The pod is watched rather
+	// than polled.
+	ReadyTimeout time.Duration
+
+	// ServiceName, if set, makes GetTarget return the address of this
+	// Service in ServiceNamespace (Namespace if empty) instead of the pod
+	// IP. This is required if the proxy cannot reach the pod network
+	// directly. The service should only select the pod handling the
+	// connection, as the pod lock does not apply to other pods behind it.
+	ServiceName      string
+	ServiceNamespace string
+
+	// LockAnnotation is the annotation key locking pods
+	// (DefaultLockAnnotation if empty). Deployments sharing a pool of pods
+	// must use the same key, independent deployments distinct keys.
+	LockAnnotation string
+
+	// LockTTL lets locks expire if they have not been renewed for the given
+	// time, e.g. because the proxy holding them crashed. Locks are renewed
+	// while in use. Locks never expire if 0.
+	LockTTL time.Duration
+
+	// InstanceID identifies the proxy in the lock owner annotation
+	// (<LockAnnotation>.owner) to help tracing locks. Omitted if empty.
+	InstanceID string
+}
+
+// podLock describes the annotations locking pods. The lock annotation holds
+// the time the lock was last renewed.
+type podLock struct {
+	key   string        // annotation key of the lock
+	ttl   time.Duration // expiry of locks not renewed (never if 0)
+	owner string        // instance ID of the proxy (optional)
+}
+
+// newPodLock returns the lock configured by opts
+func newPodLock(opts KubernetesOptions) podLock {
+	lock := podLock{key: opts.LockAnnotation, ttl: opts.LockTTL, owner: opts.InstanceID}
+	if lock.key == "" {
+		lock.key = DefaultLockAnnotation
+	}
+	return lock
+}
+
+// held returns true if pod carries a lock that has not expired. Locks without
+// a time (set by earlier versions) do not expire.
+func (l podLock) held(pod *v1.Pod) bool {
+	v, ok := pod.Annotations[l.key]
+	if !ok {
+		return false
+	}
+	renewed, err := time.Parse(time.RFC3339, v)
+	return l.ttl == 0 || err != nil || time.Since(renewed) < l.ttl
+}
+
+// set locks pod (or renews its lock)
+func (l podLock) set(pod *v1.Pod) {
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[l.key] = time.Now().UTC().Format(time.RFC3339)
+	if l.owner != "" {
+		pod.Annotations[l.ownerKey()] = l.owner
+	}
+}
+
+// clear unlocks pod
+func (l podLock) clear(pod *v1.Pod) {
+	delete(pod.Annotations, l.key)
+	delete(pod.Annotations, l.ownerKey())
+}
+
+func (l podLock) ownerKey() string {
+	return l.key + ".owner"
+}
+
 /*
 KubernetesBackend implements a Backend that uses Kubernetes Pods to handle
 requests.
@@ -27,80 +136,437 @@ type KubernetesBackend struct {
 	nameSpace     string         // The namespace of the pod handling the connection
 	containerPort int            // The port at which the container is listening
 	clientset     *k8s.Clientset // The k8s client
-	dispose       bool           // Dispose pods after use
+	ephemeral     bool           // Delete the pod after use instead of unlocking it
+	gracePeriod   time.Duration  // Grace period of deleted pods (pod default if negative)
+	readyTimeout  time.Duration  // Time to wait for the pod to become ready
+	service       string         // Service to connect through instead of the pod IP
+	serviceNS     string         // Namespace of the service
+	lock          podLock        // The lock of the pod
+	stopRenew     chan struct{}  // Stops renewing the lock (nil if not renewed)
+	id            string         // namespace/name of the pod
 }
 
 // CreateKubernetesBackend creates a KubernetesBackend to handle requests. It searches
-// the provided 'namespace' for a pod matching 'label' and without 'podAnnotationLock'.
+// the provided 'namespace' for a pod matching 'label' and without the lock annotation.
 // It then sets the lock to indicate that this pod is currently handling a connection.
-func CreateKubernetesBackend(clientset *k8s.Clientset, namespace string, labelSelector string, containerPort int, dispose bool) (Backend, error) {
+// API requests are cancelled with ctx.
+func CreateKubernetesBackend(ctx context.Context, clientset *k8s.Clientset, opts KubernetesOptions) (Backend, error) {
+	namespace := opts.Namespace
+	lock := newPodLock(opts)
 
 	// Find a suitable pod
-	podList, err := clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: labelSelector})
+	podList, err := listPods(ctx, clientset, opts)
 	if err != nil {
-		return nil, fmt.Errorf("List Pods of namespace[%s] error:%v", namespace, err)
-	}
-	for _, pod := range podList.Items {
-		if _, ok := pod.Annotations[podAnnotationLock]; ok {
-			continue // This pod is locked - move on
-		} else {
-			// Found a pod to handle the connection. Lock it and store info in KubernetesBackend
-			if pod.Annotations == nil {
-				pod.Annotations = make(map[string]string)
-			}
-			pod.Annotations[podAnnotationLock] = "yes"
-			_, err = clientset.CoreV1().Pods(namespace).Update(&pod)
-			if err != nil {
-				return nil, fmt.Errorf("Error locking pod [%s] in namespace [%s]", pod.ObjectMeta.Name, pod.ObjectMeta.Namespace)
-			}
-			return &KubernetesBackend{
-				podName:       pod.ObjectMeta.Name,
-				nameSpace:     pod.ObjectMeta.Namespace,
-				containerPort: containerPort,
-				clientset:     clientset,
-				dispose:       dispose,
-			}, nil
+		return nil, err
+	}
+	for _, pod := range preferNode(podList.Items, opts.PreferNode) {
+		locked, err := lockPod(ctx, clientset, &pod, lock)
+		if err != nil {
+			return nil, err
+		}
+		if !locked {
+			continue // This pod is locked by another connection - move on
+		}
+		// Found a pod to handle the connection
+		b := &KubernetesBackend{
+			podName:       pod.ObjectMeta.Name,
+			nameSpace:     pod.ObjectMeta.Namespace,
+			containerPort: opts.Port,
+			clientset:     clientset,
+			ephemeral:     opts.Ephemeral,
+			gracePeriod:   opts.GracePeriod,
+			readyTimeout:  opts.ReadyTimeout,
+			service:       opts.ServiceName,
+			serviceNS:     serviceNamespace(opts),
+			lock:          lock,
+			id:            pod.ObjectMeta.Namespace + "/" + pod.ObjectMeta.Name,
+		}
+		if lock.ttl > 0 {
+			b.stopRenew = make(chan struct{})
+			go b.renewLock()
 		}
+		return b, nil
 	}
 	return nil, fmt.Errorf("No available pod in namespace [%s]", namespace)
 }
 
-// GetTarget returns the TCP address of the handling Pod
+// AvailablePods returns the number of pods matching opts that are not locked
+// (or whose lock has expired), i.e. the number of connections
+// CreateKubernetesBackend can currently serve
+func AvailablePods(ctx context.Context, clientset *k8s.Clientset, opts KubernetesOptions) (int, error) {
+	podList, err := listPods(ctx, clientset, opts)
+	if err != nil {
+		return 0, err
+	}
+	lock := newPodLock(opts)
+	available := 0
+	for i := range podList.Items {
+		if !lock.held(&podList.Items[i]) {
+			available++
+		}
+	}
+	return available, nil
+}
+
+// listPods lists the pods matching the selectors of opts
+func listPods(ctx context.Context, clientset *k8s.Clientset, opts KubernetesOptions) (*v1.PodList, error) {
+	podList, err := clientset.CoreV1().Pods(opts.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: opts.LabelSelector,
+		FieldSelector: opts.FieldSelector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("List Pods of namespace[%s] error:%v", opts.Namespace, err)
+	}
+	return podList, nil
+}
+
+// CreateKubernetesPodBackend creates a KubernetesBackend handling requests with
+// a new pod created from template in opts.Namespace. The pod is named after the
+// template with a random suffix and deleted on Terminate (regardless of
+// opts.Ephemeral). If opts.Port is 0, the first container port of the template
+// is used. The creation request is cancelled with ctx.
+func CreateKubernetesPodBackend(ctx context.Context, clientset *k8s.Clientset, template *v1.PodTemplateSpec, opts KubernetesOptions) (Backend, error) {
+
+	pod := &v1.Pod{
+		ObjectMeta: *template.ObjectMeta.DeepCopy(),
+		Spec:       *template.Spec.DeepCopy(),
+	}
+	pod.Namespace = opts.Namespace
+	if pod.Name != "" {
+		pod.GenerateName = pod.Name + "-"
+		pod.Name = ""
+	} else if pod.GenerateName == "" {
+		pod.GenerateName = "vncd-"
+	}
+
+	port := opts.Port
+	if port == 0 {
+		for _, c := range pod.Spec.Containers {
+			if len(c.Ports) > 0 {
+				port = int(c.Ports[0].ContainerPort)
+				break
+			}
+		}
+		if port == 0 {
+			return nil, errors.New("Pod template exposes no container port and no port is configured")
+		}
+	}
+
+	created, err := clientset.CoreV1().Pods(opts.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Error creating pod in namespace [%s]: %v", opts.Namespace, err)
+	}
+	fmt.Printf("Created pod [%s] in namespace [%s]\n", created.Name, created.Namespace)
+
+	return &KubernetesBackend{
+		podName:       created.Name,
+		nameSpace:     created.Namespace,
+		containerPort: port,
+		clientset:     clientset,
+		ephemeral:     true,
+		gracePeriod:   opts.GracePeriod,
+		readyTimeout:  opts.ReadyTimeout,
+		service:       opts.ServiceName,
+		serviceNS:     serviceNamespace(opts),
+		id:            created.Namespace + "/" + created.Name,
+	}, nil
+}
+
+// ReadPodTemplate reads a pod template (metadata and spec of a pod) from a
+// YAML or JSON file
+func ReadPodTemplate(file string) (*v1.PodTemplateSpec, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	template := &v1.PodTemplateSpec{}
+	if err = yaml.NewYAMLOrJSONDecoder(f, 4096).Decode(template); err != nil {
+		return nil, fmt.Errorf("Invalid pod template [%s]: %v", file, err)
+	}
+	if len(template.Spec.Containers) == 0 {
+		return nil, fmt.Errorf("Pod template [%s] has no containers", file)
+	}
+	return template, nil
+}
+
+// lockPod sets the lock annotation of pod and returns false if the pod is
+// locked already (and the lock has not expired). The update fails with a conflict if the pod has changed since
+// it was read, e.g. because a concurrent connection has locked it. In this case
+// the pod is read again and locking is retried unless it is locked now.
+func lockPod(ctx context.Context, clientset *k8s.Clientset, pod *v1.Pod, lock podLock) (bool, error) {
+	for {
+		if lock.held(pod) {
+			return false, nil
+		}
+		if _, ok := pod.Annotations[lock.key]; ok {
+			fmt.Printf("Reclaiming stale lock of pod [%s] in namespace [%s] held by [%s]\n", pod.Name, pod.Namespace, pod.Annotations[lock.ownerKey()])
+		}
+		lock.set(pod)
+
+		_, err := clientset.CoreV1().Pods(pod.Namespace).Update(ctx, pod, metav1.UpdateOptions{})
+		if err == nil {
+			return true, nil
+		}
+		if !apierrors.IsConflict(err) {
+			return false, fmt.Errorf("Error locking pod [%s] in namespace [%s]: %v", pod.Name, pod.Namespace, err)
+		}
+
+		current, err := clientset.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return false, nil // The pod has gone in the meantime
+		}
+		if err != nil {
+			return false, fmt.Errorf("Error reading pod [%s] in namespace [%s]: %v", pod.Name, pod.Namespace, err)
+		}
+		*pod = *current
+	}
+}
+
+// GetTarget returns the TCP address of the handling Pod. If a ReadyTimeout is
+// set, it waits for the pod to become Ready first.
 func (b *KubernetesBackend) GetTarget() (*net.TCPAddr, error) {
-	pod, err := b.getPod()
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout+b.readyTimeout)
+	defer cancel()
+
+	pod, err := b.getPod(ctx)
 	if err != nil {
 		return nil, err
 	}
+	if b.readyTimeout > 0 && !podReady(pod) {
+		readyCtx, cancelReady := context.WithTimeout(ctx, b.readyTimeout)
+		pod, err = b.waitReady(readyCtx, pod)
+		cancelReady()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if b.service != "" {
+		return b.getServiceTarget(ctx)
+	}
 	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", pod.Status.PodIP, b.containerPort))
 	return addr, err
 }
 
-// Terminate removes the lock from the pod and makes it available for
-// scheduling again
+// ID returns the namespace and name of the pod (namespace/name)
+func (b *KubernetesBackend) ID() string {
+	return b.id
+}
+
+// Ready waits until the container of the pod (or the service) accepts
+// connections
+func (b *KubernetesBackend) Ready(ctx context.Context) error {
+	target, err := b.GetTarget()
+	if err != nil {
+		return err
+	}
+	if err = waitAccepting(ctx, target); err != nil {
+		return fmt.Errorf("Pod [%s] in namespace [%s] not accepting connections on %s: %v", b.podName, b.nameSpace, target.String(), err)
+	}
+	return nil
+}
+
+// getServiceTarget returns the cluster IP and port of the service. Headless
+// services have no cluster IP, so the first address of their endpoints is
+// returned instead.
+func (b *KubernetesBackend) getServiceTarget(ctx context.Context) (*net.TCPAddr, error) {
+	svc, err := b.clientset.CoreV1().Services(b.serviceNS).Get(ctx, b.service, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot find service [%s] in namespace [%s]: %v", b.service, b.serviceNS, err)
+	}
+
+	if svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != "None" {
+		port := b.containerPort
+		for i, p := range svc.Spec.Ports {
+			if i == 0 || int(p.Port) == b.containerPort {
+				port = int(p.Port)
+			}
+		}
+		return net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", svc.Spec.ClusterIP, port))
+	}
+
+	endpoints, err := b.clientset.CoreV1().Endpoints(b.serviceNS).Get(ctx, b.service, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot find endpoints of service [%s] in namespace [%s]: %v", b.service, b.serviceNS, err)
+	}
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Addresses) == 0 {
+			continue
+		}
+		port := b.containerPort
+		if len(subset.Ports) > 0 {
+			port = int(subset.Ports[0].Port)
+		}
+		return net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", subset.Addresses[0].IP, port))
+	}
+	return nil, fmt.Errorf("Service [%s] in namespace [%s] has no ready endpoints", b.service, b.serviceNS)
+}
+
+// serviceNamespace returns the namespace of the service in opts
+func serviceNamespace(opts KubernetesOptions) string {
+	if opts.ServiceNamespace != "" {
+		return opts.ServiceNamespace
+	}
+	return opts.Namespace
+}
+
+// waitReady watches pod until it is ready and returns its ready state. The
+// watch is resumed if the API server closes it before ctx is done.
+func (b *KubernetesBackend) waitReady(ctx context.Context, pod *v1.Pod) (*v1.Pod, error) {
+	pods := b.clientset.CoreV1().Pods(b.nameSpace)
+	for {
+		w, err := pods.Watch(ctx, metav1.ListOptions{
+			FieldSelector:   fields.OneTermEqualSelector("metadata.name", b.podName).String(),
+			ResourceVersion: pod.ResourceVersion,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Cannot watch pod [%s] in namespace [%s]: %v", b.podName, b.nameSpace, err)
+		}
+		pod, err = watchReady(ctx, w, pod)
+		w.Stop()
+		if err != nil || podReady(pod) {
+			return pod, err
+		}
+	}
+}
+
+// watchReady returns the pod once an event shows it ready, or its last known
+// state if the watch is closed
+func watchReady(ctx context.Context, w watch.Interface, pod *v1.Pod) (*v1.Pod, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Pod [%s] in namespace [%s] not ready in time (phase %s)", pod.Name, pod.Namespace, pod.Status.Phase)
+		case e, ok := <-w.ResultChan():
+			if !ok {
+				return pod, nil
+			}
+			switch e.Type {
+			case watch.Deleted:
+				return nil, fmt.Errorf("Pod [%s] in namespace [%s] was deleted while starting", pod.Name, pod.Namespace)
+			case watch.Error:
+				return nil, fmt.Errorf("Error watching pod [%s] in namespace [%s]: %v", pod.Name, pod.Namespace, e.Object)
+			}
+			if p, ok := e.Object.(*v1.Pod); ok {
+				pod = p
+				if podReady(pod) {
+					return pod, nil
+				}
+			}
+		}
+	}
+}
+
+// podReady returns true if pod is running, has an IP and its Ready condition
+// is true
+func podReady(pod *v1.Pod) bool {
+	if pod.Status.Phase != v1.PodRunning || pod.Status.PodIP == "" {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == v1.PodReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// Terminate ends the use of the pod. Ephemeral pods are deleted. Otherwise,
+// the lock is removed from the pod, which makes it available for the next
+// connection.
 func (b *KubernetesBackend) Terminate() {
-	pod, err := b.getPod()
+	if b.stopRenew != nil {
+		close(b.stopRenew)
+		b.stopRenew = nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	if b.ephemeral {
+		b.deletePod(ctx)
+		return
+	}
+
+	pod, err := b.getPod(ctx)
 	if err != nil {
 		fmt.Printf("Error releasing pod lock. Cannot find pod [%s] in namespace [%s]", b.podName, b.nameSpace)
 		return
 	}
-	if b.dispose {
-		if err = b.clientset.CoreV1().Pods(b.nameSpace).Delete(b.podName, &metav1.DeleteOptions{}); err != nil {
-			fmt.Printf("Error deleting pod [%s] in namespace [%s] - [%s]", b.podName, b.nameSpace, err.Error())
+	b.lock.clear(pod)
+	_, err = b.clientset.CoreV1().Pods(b.nameSpace).Update(ctx, pod, metav1.UpdateOptions{})
+	if err != nil {
+		fmt.Println("Error updating pod " + b.podName + " in namespace " + b.nameSpace)
+	}
+	fmt.Printf("Released lock from pod [%s] in namespace [%s]\n", b.podName, b.nameSpace)
+}
+
+// renewLock renews the lock of the pod until Terminate, so that it does not
+// expire while the pod is in use
+func (b *KubernetesBackend) renewLock() {
+	ticker := time.NewTicker(b.lock.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stopRenew:
 			return
+		case <-ticker.C:
 		}
-		fmt.Printf("Disposed of pod [%s] in namespace [%s]\n", b.podName, b.nameSpace)
-	} else {
-		delete(pod.ObjectMeta.Annotations, podAnnotationLock)
-		_, err = b.clientset.CoreV1().Pods(b.nameSpace).Update(pod)
-		if err != nil {
-			fmt.Println("Error updating pod " + b.podName + " in namespace " + b.nameSpace)
+		if err := b.renewLockOnce(); err != nil {
+			fmt.Printf("Error renewing lock of pod [%s] in namespace [%s]: %v\n", b.podName, b.nameSpace, err)
+		}
+	}
+}
+
+func (b *KubernetesBackend) renewLockOnce() error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	pod, err := b.getPod(ctx)
+	if err != nil {
+		return err
+	}
+	b.lock.set(pod)
+	_, err = b.clientset.CoreV1().Pods(b.nameSpace).Update(ctx, pod, metav1.UpdateOptions{})
+	return err
+}
+
+// deletePod deletes the pod with the configured grace period
+func (b *KubernetesBackend) deletePod(ctx context.Context) {
+	opts := metav1.DeleteOptions{}
+	if b.gracePeriod >= 0 {
+		seconds := int64(b.gracePeriod / time.Second)
+		opts.GracePeriodSeconds = &seconds
+	}
+	if err := b.clientset.CoreV1().Pods(b.nameSpace).Delete(ctx, b.podName, opts); err != nil {
+		fmt.Printf("Error deleting pod [%s] in namespace [%s] - [%s]", b.podName, b.nameSpace, err.Error())
+		return
+	}
+	fmt.Printf("Deleted pod [%s] in namespace [%s]\n", b.podName, b.nameSpace)
+}
+
+// preferNode orders pods running on node before all others. The order is
+// unchanged if node is empty.
+func preferNode(pods []v1.Pod, node string) []v1.Pod {
+	if node == "" {
+		return pods
+	}
+	ordered := make([]v1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		if pod.Spec.NodeName == node {
+			ordered = append(ordered, pod)
+		}
+	}
+	for _, pod := range pods {
+		if pod.Spec.NodeName != node {
+			ordered = append(ordered, pod)
 		}
-		fmt.Printf("Released lock from pod [%s] in namespace [%s]\n", b.podName, b.nameSpace)
 	}
+	return ordered
 }
 
-func (b *KubernetesBackend) getPod() (*v1.Pod, error) {
+func (b *KubernetesBackend) getPod(ctx context.Context) (*v1.Pod, error) {
 	// config, err := rest.InClusterConfig()
 	// clientset, err := kubernetes.NewForConfig(config)
-	return b.clientset.CoreV1().Pods(b.nameSpace).Get(b.podName, metav1.GetOptions{})
+	return b.clientset.CoreV1().Pods(b.nameSpace).Get(ctx, b.podName, metav1.GetOptions{})
 }
@@ -0,0 +1,91 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRoundRobinDialTimeout limits the check of round robin targets
+const DefaultRoundRobinDialTimeout = time.Second
+
+/*
+RoundRobin distributes connections across a fixed set of always running VNC
+servers. Each call to Get returns the next server that accepts connections.
+
+The backends returned are StaticBackends, so Terminate leaves the servers
+running.
+*/
+type RoundRobin struct {
+	targets     []*net.TCPAddr
+	dialTimeout time.Duration
+	next        int
+	mux         sync.Mutex
+}
+
+// NewRoundRobin creates a RoundRobin over the comma-separated host:port
+// addresses in targets. Targets not accepting connections within dialTimeout
+// (DefaultRoundRobinDialTimeout if 0) are skipped.
+func NewRoundRobin(targets string, dialTimeout time.Duration) (*RoundRobin, error) {
+	if dialTimeout == 0 {
+		dialTimeout = DefaultRoundRobinDialTimeout
+	}
+	r := &RoundRobin{dialTimeout: dialTimeout}
+	for _, t := range strings.Split(targets, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		addr, err := net.ResolveTCPAddr("tcp", t)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid round robin target [%s]: %v", t, err)
+		}
+		r.targets = append(r.targets, addr)
+	}
+	if len(r.targets) == 0 {
+		return nil, errors.New("Round robin requires at least one target")
+	}
+	return r, nil
+}
+
+// Get returns a backend for the next target accepting connections. It fails if
+// none does.
+func (r *RoundRobin) Get() (Backend, error) {
+	for i := 0; i < len(r.targets); i++ {
+		addr := r.advance()
+		conn, err := net.DialTimeout("tcp", addr.String(), r.dialTimeout)
+		if err != nil {
+			log.Printf("Skipping round robin target %s: %v", addr.String(), err)
+			continue
+		}
+		conn.Close()
+		return newStaticBackend(addr), nil
+	}
+	return nil, errors.New("No round robin target accepting connections")
+}
+
+// Reachable returns nil if any target accepts connections. Unlike Get, it
+// leaves the turn of the targets unchanged.
+func (r *RoundRobin) Reachable() error {
+	for _, addr := range r.targets {
+		conn, err := net.DialTimeout("tcp", addr.String(), r.dialTimeout)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+	return errors.New("No round robin target accepting connections")
+}
+
+// advance returns the next target in turn
+func (r *RoundRobin) advance() *net.TCPAddr {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	addr := r.targets[r.next]
+	r.next = (r.next + 1) % len(r.targets)
+	return addr
+}
@@ -0,0 +1,119 @@
+package backends
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenTargets returns the addresses of local servers, one per entry of alive.
+// Servers that are not alive have been closed and refuse connections.
+func listenTargets(t *testing.T, alive []bool) []string {
+	addrs := make([]string, len(alive))
+	for i, a := range alive {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = l.Addr().String()
+		if a {
+			t.Cleanup(func() { l.Close() })
+		} else {
+			l.Close()
+		}
+	}
+	return addrs
+}
+
+func TestRoundRobinGet(t *testing.T) {
+	tests := []struct {
+		name    string
+		alive   []bool
+		want    []int // targets returned by consecutive calls of Get
+		wantErr bool
+	}{
+		{name: "single target", alive: []bool{true}, want: []int{0, 0, 0}},
+		{name: "rotation", alive: []bool{true, true, true}, want: []int{0, 1, 2, 0, 1}},
+		{name: "dead target skipped", alive: []bool{true, false, true}, want: []int{0, 2, 0, 2}},
+		{name: "first target dead", alive: []bool{false, true, true}, want: []int{1, 2, 1}},
+		{name: "all targets dead", alive: []bool{false, false}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs := listenTargets(t, tt.alive)
+			r, err := NewRoundRobin(strings.Join(addrs, ","), 100*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wantErr {
+				if b, err := r.Get(); err == nil {
+					t.Errorf("Get() = %s, want error", b.ID())
+				}
+				return
+			}
+			for i, want := range tt.want {
+				b, err := r.Get()
+				if err != nil {
+					t.Fatalf("Get() #%d: %v", i, err)
+				}
+				target, _ := b.GetTarget()
+				if target.String() != addrs[want] {
+					t.Errorf("Get() #%d = %s, want %s", i, target, addrs[want])
+				}
+			}
+		})
+	}
+}
+
+func TestNewRoundRobin(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets string
+		want    int
+		wantErr bool
+	}{
+		{name: "spaces and empty entries", targets: " 127.0.0.1:5900, ,127.0.0.1:5901,", want: 2},
+		{name: "no targets", targets: " , ", wantErr: true},
+		{name: "invalid target", targets: "127.0.0.1:5900,localhost:vnc-invalid", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRoundRobin(tt.targets, 0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewRoundRobin(%q) error = %v, want error %t", tt.targets, err, tt.wantErr)
+			}
+			if err == nil && len(r.targets) != tt.want {
+				t.Errorf("NewRoundRobin(%q) has %d targets, want %d", tt.targets, len(r.targets), tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundRobinReachable(t *testing.T) {
+	tests := []struct {
+		name    string
+		alive   []bool
+		wantErr bool
+	}{
+		{name: "all targets alive", alive: []bool{true, true}},
+		{name: "one target alive", alive: []bool{false, true}},
+		{name: "all targets dead", alive: []bool{false, false}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRoundRobin(strings.Join(listenTargets(t, tt.alive), ","), 100*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = r.Reachable(); (err != nil) != tt.wantErr {
+				t.Errorf("Reachable() error = %v, want error %t", err, tt.wantErr)
+			}
+			// Probing leaves the turn of the targets unchanged
+			if r.next != 0 {
+				t.Errorf("Reachable() advanced the rotation to target %d", r.next)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultSSHRemoteAddr is the address of the VNC server on the SSH host if
+// none is configured
+const DefaultSSHRemoteAddr = "127.0.0.1:5900"
+
+// sshDialTimeout limits establishing the SSH connection
+const sshDialTimeout = 15 * time.Second
+
+// SSHOptions configures the tunnels created by CreateSSHBackend
+type SSHOptions struct {
+	Host     string // address (host[:port]) of the SSH server (port 22 if omitted)
+	User     string // user to log in as
+	KeyFile  string // private key file used for authentication (optional)
+	Password string // password used for authentication (optional)
+
+	// KnownHostsFile verifies the host key of the SSH server. It is required
+	// unless InsecureIgnoreHostKey is set, which accepts any host key and
+	// leaves the tunnel open to man-in-the-middle attacks.
+	KnownHostsFile        string
+	InsecureIgnoreHostKey bool
+
+	// RemoteAddr is the address of the VNC server as seen from the SSH host
+	// (DefaultSSHRemoteAddr if empty)
+	RemoteAddr string
+}
+
+/*
+SSHBackend implements a Backend that tunnels connections over SSH to a VNC
+server that is only reachable from the SSH host (e.g. bound to localhost).
+
+Each backend opens its own SSH connection and forwards a local port to the
+remote VNC server until Terminate is called.
+*/
+type SSHBackend struct {
+	BaseBackend
+	client   *ssh.Client  // The SSH connection
+	listener net.Listener // The local end of the tunnel
+	remote   string       // The address of the VNC server on the SSH host
+	id       string       // The SSH host and remote address
+}
+
+// CreateSSHBackend connects to the SSH server in opts and opens a tunnel to
+// the remote VNC server
+func CreateSSHBackend(opts SSHOptions) (Backend, error) {
+	config, err := sshClientConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	host := opts.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+	remote := opts.RemoteAddr
+	if remote == "" {
+		remote = DefaultSSHRemoteAddr
+	}
+
+	client, err := ssh.Dial("tcp", host, config)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to SSH server [%s]: %v", host, err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	b := &SSHBackend{
+		client:   client,
+		listener: listener,
+		remote:   remote,
+		id:       host + "->" + remote,
+	}
+	go b.forward()
+	fmt.Printf("Opened SSH tunnel from [%s] to [%s] via [%s]\n", listener.Addr(), remote, host)
+	return b, nil
+}
+
+// sshClientConfig returns the client configuration of opts
+func sshClientConfig(opts SSHOptions) (*ssh.ClientConfig, error) {
+	config := &ssh.ClientConfig{
+		User:    opts.User,
+		Timeout: sshDialTimeout,
+	}
+	if opts.KeyFile != "" {
+		key, err := ioutil.ReadFile(opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SSH key [%s]: %v", opts.KeyFile, err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+	if opts.Password != "" {
+		config.Auth = append(config.Auth, ssh.Password(opts.Password))
+	}
+	if len(config.Auth) == 0 {
+		return nil, errors.New("SSH backend requires a key file or a password")
+	}
+
+	if opts.KnownHostsFile == "" {
+		if !opts.InsecureIgnoreHostKey {
+			return nil, errors.New("SSH backend requires a known hosts file or InsecureIgnoreHostKey")
+		}
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		return config, nil
+	}
+	callback, err := knownhosts.New(opts.KnownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	config.HostKeyCallback = callback
+	return config, nil
+}
+
+// GetTarget returns the local end of the tunnel
+func (b *SSHBackend) GetTarget() (*net.TCPAddr, error) {
+	return b.listener.Addr().(*net.TCPAddr), nil
+}
+
+// ID returns the SSH host and the address of the VNC server on it
+func (b *SSHBackend) ID() string {
+	return b.id
+}
+
+// Terminate closes the tunnel and the SSH connection
+func (b *SSHBackend) Terminate() {
+	b.listener.Close()
+	b.client.Close()
+	fmt.Printf("Closed SSH tunnel to [%s]\n", b.remote)
+}
+
+// forward accepts connections to the local end of the tunnel until it is
+// closed and relays each to the remote VNC server
+func (b *SSHBackend) forward() {
+	for {
+		local, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer local.Close()
+			remote, err := b.client.Dial("tcp", b.remote)
+			if err != nil {
+				fmt.Printf("Error connecting to [%s] through SSH tunnel: %v\n", b.remote, err)
+				return
+			}
+			defer remote.Close()
+
+			done := make(chan struct{}, 2)
+			relay := func(dst, src net.Conn) {
+				io.Copy(dst, src)
+				done <- struct{}{}
+			}
+			go relay(remote, local)
+			go relay(local, remote)
+			<-done
+		}()
+	}
+}
@@ -0,0 +1,55 @@
+package backends
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSSHClientConfigHostKeys(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	if err := ioutil.WriteFile(knownHosts, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		opts    SSHOptions
+		wantErr bool
+	}{
+		{
+			name: "known hosts file",
+			opts: SSHOptions{Password: "secret", KnownHostsFile: knownHosts},
+		},
+		{
+			name: "host keys ignored explicitly",
+			opts: SSHOptions{Password: "secret", InsecureIgnoreHostKey: true},
+		},
+		{
+			name:    "no known hosts file",
+			opts:    SSHOptions{Password: "secret"},
+			wantErr: true,
+		},
+		{
+			name:    "missing known hosts file",
+			opts:    SSHOptions{Password: "secret", KnownHostsFile: knownHosts + ".missing"},
+			wantErr: true,
+		},
+		{
+			name:    "no credentials",
+			opts:    SSHOptions{KnownHostsFile: knownHosts},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := sshClientConfig(tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sshClientConfig() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && config.HostKeyCallback == nil {
+				t.Error("Host keys are not checked")
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package backends
+
+import (
+	"fmt"
+	"net"
+)
+
+/*
+StaticBackend implements a Backend that forwards all connections to a fixed,
+always running VNC server. Nothing is started or stopped, so concurrent
+connections share the server.
+*/
+type StaticBackend struct {
+	BaseBackend
+	addr *net.TCPAddr // The address of the VNC server
+	id   string       // The address as string
+}
+
+// CreateStaticBackend creates a StaticBackend for the server at addr
+// (host:port)
+func CreateStaticBackend(addr string) (Backend, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid static backend address [%s]: %v", addr, err)
+	}
+	return newStaticBackend(tcpAddr), nil
+}
+
+func newStaticBackend(addr *net.TCPAddr) *StaticBackend {
+	return &StaticBackend{addr: addr, id: addr.String()}
+}
+
+// GetTarget returns the address of the server
+func (b *StaticBackend) GetTarget() (*net.TCPAddr, error) {
+	return b.addr, nil
+}
+
+// ID returns the address of the server
+func (b *StaticBackend) ID() string {
+	return b.id
+}
+
+// Terminate does nothing, as the server outlives connections
+func (b *StaticBackend) Terminate() {}
@@ -1,7 +1,9 @@
 package backends
 
 import (
+	"context"
 	"net"
+	"time"
 )
 
 /******************************************************************************
@@ -12,4 +14,38 @@ import (
 type Backend interface {
 	GetTarget() (*net.TCPAddr, error) // GetTarget returns the listening IP address of the backend
 	Terminate()                       // Terminate the backend
+	ID() string                       // ID identifies the backend (e.g. container) in logs
+
+	// Ready blocks until the server at the target of the backend accepts
+	// connections, or fails once ctx is done. It is called after GetTarget
+	// and before the proxy connects. Backends that are serving by the time
+	// GetTarget returns embed BaseBackend.
+	Ready(ctx context.Context) error
+}
+
+// BaseBackend provides defaults of optional Backend methods
+type BaseBackend struct{}
+
+// Ready returns immediately
+func (BaseBackend) Ready(ctx context.Context) error {
+	return nil
+}
+
+// readyInterval is the delay between attempts of waitAccepting
+const readyInterval = 250 * time.Millisecond
+
+// waitAccepting dials addr until it accepts connections or ctx is done
+func waitAccepting(ctx context.Context, addr *net.TCPAddr) error {
+	var d net.Dialer
+	for {
+		conn, err := d.DialContext(ctx, "tcp", addr.String())
+		if err == nil {
+			return conn.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(readyInterval):
+		}
+	}
 }
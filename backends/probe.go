@@ -0,0 +1,135 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/******************************************************************************
+  Readiness probes
+ ******************************************************************************/
+
+// Probe checks whether a backend is ready to serve connections
+type Probe interface {
+	Probe(ctx context.Context, b Backend) error
+}
+
+// Executor is implemented by backends that can run a command inside the
+// backend (e.g. a container) and report its exit code
+type Executor interface {
+	Exec(ctx context.Context, cmd []string) (int, error)
+}
+
+// TCPProbe succeeds once the backend target accepts TCP connections
+type TCPProbe struct{}
+
+// Probe dials the backend target
+func (p TCPProbe) Probe(ctx context.Context, b Backend) error {
+	target, err := b.GetTarget()
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", target.String())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// HTTPProbe succeeds once a GET request for Path returns 200 (OK). The request
+// is sent to Port on the backend host, or to the target port if Port is 0.
+type HTTPProbe struct {
+	Path string
+	Port int
+}
+
+// Probe requests the configured path from the backend
+func (p HTTPProbe) Probe(ctx context.Context, b Backend) error {
+	target, err := b.GetTarget()
+	if err != nil {
+		return err
+	}
+	port := p.Port
+	if port == 0 {
+		port = target.Port
+	}
+
+	url := "http://" + net.JoinHostPort(target.IP.String(), strconv.Itoa(port)) + p.Path
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Readiness probe %s returned status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// ExecProbe succeeds once Command exits with status 0 inside the backend.
+// The backend must implement Executor.
+type ExecProbe struct {
+	Command []string
+}
+
+// Probe runs the configured command inside the backend
+func (p ExecProbe) Probe(ctx context.Context, b Backend) error {
+	e, ok := b.(Executor)
+	if !ok {
+		return errors.New("Backend does not support exec readiness probes")
+	}
+	code, err := e.Exec(ctx, p.Command)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("Readiness probe %v exited with status %d", p.Command, code)
+	}
+	return nil
+}
+
+// NewProbe creates a probe of the given type ("tcp", "http" or "exec"). path
+// and port are used by http probes, command by exec probes.
+func NewProbe(probeType string, path string, port int, command []string) (Probe, error) {
+	switch probeType {
+	case "tcp":
+		return TCPProbe{}, nil
+	case "http":
+		if path == "" {
+			path = "/"
+		}
+		return HTTPProbe{Path: path, Port: port}, nil
+	case "exec":
+		if len(command) == 0 {
+			return nil, errors.New("Exec readiness probe requires a command")
+		}
+		return ExecProbe{Command: command}, nil
+	}
+	return nil, fmt.Errorf("Unknown readiness probe type: %s", probeType)
+}
+
+// WaitReady runs the probe against b every interval until it succeeds or ctx
+// is done. The last probe error is returned if the backend did not become ready.
+func WaitReady(ctx context.Context, b Backend, p Probe, interval time.Duration) error {
+	for {
+		err := p.Probe(ctx, b)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Backend not ready: %v", err)
+		case <-time.After(interval):
+		}
+	}
+}
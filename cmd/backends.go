@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/kramergroup/vncd/backends"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// reachableTimeout limits the reachability checks of backends
+const reachableTimeout = 2 * time.Second
+
+// classFactory creates a backend for a resource class (the default backend
+// for an empty class)
+type classFactory func(class ResourceClassConfig) (backends.Backend, error)
+
+// backendType builds the backend setup (factory, pool and checks) of a
+// backend type from the keys in its block of BackendConfig
+type backendType struct {
+	block string // name of the field of BackendConfig holding the keys
+	build func(c BackendConfig) (backendSetup, error)
+}
+
+// backendTypes maps the backend types of the configuration (Backend.Type) to
+// their registration
+var backendTypes = make(map[string]backendType)
+
+// registerBackendType makes a backend type with its keys in the given block
+// of BackendConfig available to the configuration. It panics if the type is
+// registered twice.
+func registerBackendType(name, block string, build func(c BackendConfig) (backendSetup, error)) {
+	if _, ok := backendTypes[name]; ok {
+		panic("Backend type registered twice: " + name)
+	}
+	backendTypes[name] = backendType{block: block, build: build}
+}
+
+// backendTypeNames returns the registered backend types in alphabetical order
+func backendTypeNames() []string {
+	names := make([]string, 0, len(backendTypes))
+	for name := range backendTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	registerBackendType("docker", "Docker", buildDockerSetup)
+	registerBackendType("kubernetes", "Kubernetes", buildKubernetesSetup)
+	registerBackendType("ssh", "SSH", buildSSHSetup)
+	registerBackendType("command", "Command", buildCommandSetup)
+	registerBackendType("roundrobin", "RoundRobin", buildRoundRobinSetup)
+	registerBackendType("static", "Static", buildStaticSetup)
+}
+
+// buildDockerSetup creates a container per connection. If PoolSize is set,
+// containers of the default class are taken from a pool.
+func buildDockerSetup(c BackendConfig) (backendSetup, error) {
+	d := c.Docker
+	registryAuth, err := encodeRegistryAuth(d.RegistryAuth)
+	if err != nil {
+		return backendSetup{}, err
+	}
+	dockerOptions := func(image string) backends.DockerOptions {
+		return backends.DockerOptions{
+			Image:            image,
+			Port:             *(d.Port),
+			Network:          *(d.Network),
+			RejectDuringPull: *(d.RejectDuringPull),
+			StartupTimeout:   time.Duration(*(d.StartupTimeout)) * time.Second,
+			PullPolicy:       *(d.PullPolicy),
+			RegistryAuth:     registryAuth,
+			PullTimeout:      time.Duration(*(d.PullTimeout)) * time.Second,
+			Env:              d.Env,
+			User:             *(d.User),
+			Hostname:         *(d.Hostname),
+			Mounts:           dockerMounts(d.Mounts),
+			CPUShares:        *(d.CPUShares),
+			NanoCPUs:         *(d.NanoCPUs),
+			MemoryBytes:      *(d.MemoryBytes),
+			ShmSize:          *(d.ShmSize),
+			GPUs:             *(d.GPUs),
+			AutoRemove:       *(d.AutoRemove),
+			StopTimeout:      time.Duration(*(d.StopTimeout)) * time.Second,
+			NamePrefix:       *(d.NamePrefix),
+			Labels:           d.Labels,
+			AllowedImages:    d.AllowedImages,
+		}
+	}
+	var pool *backends.DockerBackendPool
+	if *(d.PoolSize) > 0 {
+		pool = dockerPoolFor(dockerOptions(*(d.Image)), *(d.PoolSize))
+	}
+	return backendSetup{
+		factory: func(class ResourceClassConfig) (backends.Backend, error) {
+			if class.Image == "" && pool != nil {
+				return pool.Get()
+			}
+			image := *(d.Image)
+			if class.Image != "" {
+				image = class.Image
+			}
+			log.Println("Creating Docker backend with image " + image)
+			return backends.CreateDockerBackend(dockerOptions(image))
+		},
+		pool: pool,
+		reachable: func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), reachableTimeout)
+			defer cancel()
+			return backends.PingDocker(ctx)
+		},
+	}, nil
+}
+
+// dockerPoolFor returns the pool of the current setup if it creates the same
+// backends, or else a new pool
+func dockerPoolFor(opts backends.DockerOptions, size int) *backends.DockerBackendPool {
+	current, _ := currentBackends.Load().(backendSetup)
+	if p := current.pool; p != nil && p.Size() == size && reflect.DeepEqual(p.Options(), opts) {
+		return p
+	}
+	return backends.NewDockerBackendPool(opts, size)
+}
+
+// buildKubernetesSetup locks a pre-provisioned pod per connection, or
+// creates one if PodTemplate is set
+func buildKubernetesSetup(c BackendConfig) (backendSetup, error) {
+	k := c.Kubernetes
+	var podTemplate *v1.PodTemplateSpec
+	if *k.PodTemplate != "" {
+		var err error
+		if podTemplate, err = backends.ReadPodTemplate(*k.PodTemplate); err != nil {
+			return backendSetup{}, err
+		}
+	}
+	port := *(k.Port)
+	if port == 0 && podTemplate == nil {
+		port = defaultKubernetesPort
+	}
+	var node string
+	if *(k.PreferSameNode) {
+		node = os.Getenv("NODE_NAME")
+	}
+	kubernetesOptions := func(labelSelector string) backends.KubernetesOptions {
+		return backends.KubernetesOptions{
+			Namespace:        *(k.Namespace),
+			LabelSelector:    labelSelector,
+			FieldSelector:    *(k.FieldSelector),
+			Port:             port,
+			Ephemeral:        *(k.Ephemeral),
+			GracePeriod:      time.Duration(*(k.GracePeriod)) * time.Second,
+			PreferNode:       node,
+			ReadyTimeout:     time.Duration(*(k.ReadyTimeout)) * time.Second,
+			ServiceName:      *(k.ServiceName),
+			ServiceNamespace: *(k.ServiceNamespace),
+			LockAnnotation:   *(k.LockAnnotation),
+			LockTTL:          time.Duration(*(k.LockTTL)) * time.Second,
+			InstanceID:       instanceID(),
+		}
+	}
+	var setup backendSetup
+	if podTemplate == nil {
+		setup.availablePods = func() (int, error) {
+			clientset, err := kubernetesClientset(*k.Kubeconfig)
+			if err != nil {
+				return 0, err
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), kubernetesTimeout)
+			defer cancel()
+			return backends.AvailablePods(ctx, clientset, kubernetesOptions(*(k.LabelSelector)))
+		}
+		setup.reachable = func() error {
+			n, err := setup.availablePods()
+			if err == nil && n == 0 {
+				err = errors.New("No pods available")
+			}
+			return err
+		}
+	}
+	setup.factory = func(class ResourceClassConfig) (backends.Backend, error) {
+		labelSelector := *(k.LabelSelector)
+		if class.LabelSelector != "" {
+			labelSelector = class.LabelSelector
+		}
+		if podTemplate != nil {
+			log.Printf("Creating Kubernetes pod from template [%s] in namespace [%s]\n", *k.PodTemplate, *(k.Namespace))
+		} else {
+			log.Printf("Createing Kubernetes backend with label selector [%s] in namespace [%s]\n", labelSelector, *(k.Namespace))
+		}
+
+		clientset, err := kubernetesClientset(*k.Kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), kubernetesTimeout)
+		defer cancel()
+		if podTemplate != nil {
+			return backends.CreateKubernetesPodBackend(ctx, clientset, podTemplate, kubernetesOptions(labelSelector))
+		}
+		return backends.CreateKubernetesBackend(ctx, clientset, kubernetesOptions(labelSelector))
+	}
+	return setup, nil
+}
+
+// kubernetesClientset creates a Kubernetes client from the kubeconfig file,
+// or the in-cluster configuration if kubeconfig is empty
+func kubernetesClientset(kubeconfig string) (*kubernetes.Clientset, error) {
+	var conf *rest.Config
+	var err error
+	if kubeconfig == "" {
+		conf, err = rest.InClusterConfig()
+	} else {
+		conf, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not build Kubernetes configuration [%s]", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(conf)
+	if err != nil {
+		return nil, fmt.Errorf("Could not initialise Kubernetes configuration [%s]", err)
+	}
+	return clientset, nil
+}
+
+// buildSSHSetup opens an SSH tunnel per connection
+func buildSSHSetup(c BackendConfig) (backendSetup, error) {
+	if c.SSH == nil || c.SSH.Host == "" {
+		return backendSetup{}, errors.New("SSH backend requires an SSH host")
+	}
+	opts := backends.SSHOptions{
+		Host:           os.ExpandEnv(c.SSH.Host),
+		User:           os.ExpandEnv(c.SSH.User),
+		KeyFile:        os.ExpandEnv(c.SSH.KeyFile),
+		Password:       os.ExpandEnv(c.SSH.Password),
+		KnownHostsFile: os.ExpandEnv(c.SSH.KnownHostsFile),
+		RemoteAddr:     os.ExpandEnv(c.SSH.RemoteAddress),
+
+		InsecureIgnoreHostKey: c.SSH.InsecureIgnoreHostKey,
+	}
+	if opts.KnownHostsFile == "" && opts.InsecureIgnoreHostKey {
+		log.Println("SSH host keys are not verified (InsecureIgnoreHostKey is set)")
+	}
+	return backendSetup{
+		factory: func(class ResourceClassConfig) (backends.Backend, error) {
+			log.Println("Creating SSH backend via " + opts.Host)
+			return backends.CreateSSHBackend(opts)
+		},
+	}, nil
+}
+
+// buildCommandSetup runs the command per connection
+func buildCommandSetup(c BackendConfig) (backendSetup, error) {
+	if *c.Command.Command == "" {
+		return backendSetup{}, errors.New("Command backend requires a command")
+	}
+	opts := backends.CommandOptions{
+		Command:        *c.Command.Command,
+		Port:           *c.Command.Port,
+		StartupTimeout: time.Duration(*c.Command.StartupTimeout) * time.Second,
+	}
+	return backendSetup{
+		factory: func(class ResourceClassConfig) (backends.Backend, error) {
+			log.Println("Creating command backend")
+			return backends.CreateCommandBackend(opts)
+		},
+	}, nil
+}
+
+// buildRoundRobinSetup distributes connections across Targets
+func buildRoundRobinSetup(c BackendConfig) (backendSetup, error) {
+	roundRobin, err := backends.NewRoundRobin(*c.RoundRobin.Targets, 0)
+	if err != nil {
+		return backendSetup{}, err
+	}
+	return backendSetup{
+		factory: func(class ResourceClassConfig) (backends.Backend, error) {
+			return roundRobin.Get()
+		},
+		reachable: roundRobin.Reachable,
+	}, nil
+}
+
+// buildStaticSetup forwards all connections to Address
+func buildStaticSetup(c BackendConfig) (backendSetup, error) {
+	if *c.Static.Address == "" {
+		return backendSetup{}, errors.New("Static backend requires an address")
+	}
+	address := *c.Static.Address
+	return backendSetup{
+		factory: func(class ResourceClassConfig) (backends.Backend, error) {
+			return backends.CreateStaticBackend(address)
+		},
+		reachable: func() error {
+			conn, err := net.DialTimeout("tcp", address, reachableTimeout)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		},
+	}, nil
+}
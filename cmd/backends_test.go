@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/kramergroup/vncd/backends"
+)
+
+// useBackendType registers a backend type for the duration of a test and
+// restores the configuration and backends changed by processConfig
+func useBackendType(t *testing.T, name, block string, build func(c BackendConfig) (backendSetup, error)) {
+	registerBackendType(name, block, build)
+	current, setup := config, currentBackends.Load()
+	factory, contextFactory, l := backendFactory, contextBackendFactory, limiter
+	t.Cleanup(func() {
+		delete(backendTypes, name)
+		config, backendFactory, contextBackendFactory, limiter = current, factory, contextFactory, l
+		if setup == nil {
+			setup = backendSetup{}
+		}
+		currentBackends.Store(setup)
+	})
+}
+
+func TestProcessConfigBackendType(t *testing.T) {
+	var built BackendConfig
+	useBackendType(t, "fake", "Static", func(c BackendConfig) (backendSetup, error) {
+		built = c
+		return backendSetup{
+			factory: func(class ResourceClassConfig) (backends.Backend, error) {
+				return backends.CreateStaticBackend(*c.Static.Address)
+			},
+		}, nil
+	})
+
+	typ, address := "fake", "127.0.0.1:5901"
+	config.Backend.Type = &typ
+	config.Backend.Static.Address = &address
+	if err := processConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if built.Static.Address == nil || *built.Static.Address != address {
+		t.Errorf("Backend type built with %+v, want its Static block", built.Static)
+	}
+
+	// Both frontends create the backends of the registered type
+	b, err := backendFactory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, _ := b.GetTarget(); target.String() != address {
+		t.Errorf("Backend target = %s, want %s", target, address)
+	}
+	b, err = contextBackendFactory(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, _ := b.GetTarget(); target.String() != address {
+		t.Errorf("Backend target with context = %s, want %s", target, address)
+	}
+}
+
+func TestProcessConfigUnknownBackendType(t *testing.T) {
+	useBackendType(t, "fake", "Static", func(c BackendConfig) (backendSetup, error) {
+		t.Error("Registered backend type built for another type")
+		return backendSetup{}, nil
+	})
+
+	typ := "unknown"
+	config.Backend.Type = &typ
+	err := processConfig()
+	if err == nil {
+		t.Fatal("processConfig() succeeded with an unknown backend type")
+	}
+	// The error lists the registered types
+	for _, name := range []string{"unknown", "fake", "docker", "static"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("Error %q does not mention %s", err, name)
+		}
+	}
+}
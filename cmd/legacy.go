@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// legacyBackendConfig holds the backend keys found directly under Backend,
+// where all backend types kept their keys in former versions. As the type may
+// be given elsewhere (e.g. on the command line), the keys are decoded into the
+// block of every type and resolveLegacy keeps the block of the configured one.
+type legacyBackendConfig struct {
+	Docker     DockerConfig
+	Kubernetes KubernetesConfig
+	Static     StaticConfig
+	RoundRobin RoundRobinConfig
+	Command    CommandConfig
+
+	keys []string // keys found in the configuration file
+}
+
+// UnmarshalYAML reads the common keys and blocks of b and collects the keys
+// of backend types found directly under Backend
+func (b *BackendConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw map[string]interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	legacy := make(map[string]interface{})
+	for key, v := range raw {
+		_, mapping := v.(map[interface{}]interface{})
+		if isLegacyBackendKey(key, mapping || v == nil, false) {
+			legacy[key] = v
+			delete(raw, key)
+		}
+	}
+
+	type plain BackendConfig
+	data, err := yaml.Marshal(raw)
+	if err == nil {
+		err = yaml.Unmarshal(data, (*plain)(b))
+	}
+	if err != nil || len(legacy) == 0 {
+		return err
+	}
+	if data, err = yaml.Marshal(legacy); err != nil {
+		return err
+	}
+	b.legacy, err = decodeLegacy(legacy, func(v interface{}) error {
+		return yaml.Unmarshal(data, v)
+	})
+	return err
+}
+
+// UnmarshalJSON reads the common keys and blocks of b and collects the keys
+// of backend types found directly under Backend
+func (b *BackendConfig) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	legacy := make(map[string]json.RawMessage)
+	for key, v := range raw {
+		v = bytes.TrimSpace(v)
+		object := bytes.HasPrefix(v, []byte("{")) || bytes.Equal(v, []byte("null"))
+		if isLegacyBackendKey(key, object, true) {
+			legacy[key] = v
+			delete(raw, key)
+		}
+	}
+
+	type plain BackendConfig
+	data, err := json.Marshal(raw)
+	if err == nil {
+		err = json.Unmarshal(data, (*plain)(b))
+	}
+	if err != nil || len(legacy) == 0 {
+		return err
+	}
+	if data, err = json.Marshal(legacy); err != nil {
+		return err
+	}
+	b.legacy, err = decodeLegacy(legacy, func(v interface{}) error {
+		return json.Unmarshal(data, v)
+	})
+	return err
+}
+
+// isLegacyBackendKey returns true unless key is a common key or block of
+// BackendConfig. Blocks are only recognised if their value is a mapping, as
+// Command is also the former key of the command. JSON keys are matched case
+// insensitively.
+func isLegacyBackendKey(key string, mapping, fold bool) bool {
+	t := reflect.TypeOf(BackendConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := yamlKey(f)
+		if name == key || fold && strings.EqualFold(name, key) {
+			return f.Type.Kind() == reflect.Struct && !mapping
+		}
+	}
+	return true
+}
+
+// decodeLegacy decodes the keys of legacy into the block of every backend type
+// with decode
+func decodeLegacy(legacy interface{}, decode func(v interface{}) error) (*legacyBackendConfig, error) {
+	l := &legacyBackendConfig{}
+	for _, key := range reflect.ValueOf(legacy).MapKeys() {
+		l.keys = append(l.keys, key.String())
+	}
+	sort.Strings(l.keys)
+
+	blocks := reflect.ValueOf(l).Elem()
+	for i := 0; i < blocks.NumField(); i++ {
+		if !blocks.Field(i).CanSet() {
+			continue
+		}
+		if err := decode(blocks.Field(i).Addr().Interface()); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// applyLegacyEnv reads the keys of backend types from environment variables
+// named after their former place directly under Backend (<prefix>_<KEY>)
+func (b *BackendConfig) applyLegacyEnv(prefix string, lookup func(string) (string, bool)) error {
+	if b.legacy == nil {
+		b.legacy = &legacyBackendConfig{}
+	}
+	blocks := reflect.ValueOf(b.legacy).Elem()
+	for i := 0; i < blocks.NumField(); i++ {
+		if !blocks.Field(i).CanSet() {
+			continue
+		}
+		if err := applyEnvSection(blocks.Field(i), prefix, lookup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveLegacy merges the keys found directly under Backend into the block of
+// backendType. Keys set in the block take precedence. Keys not used by the
+// type are ignored.
+func (b *BackendConfig) resolveLegacy(backendType string) {
+	l := b.legacy
+	b.legacy = nil
+	if l == nil {
+		return
+	}
+
+	var block, legacy reflect.Value
+	if t, ok := backendTypes[backendType]; ok {
+		block = reflect.ValueOf(b).Elem().FieldByName(t.block)
+		legacy = reflect.ValueOf(l).Elem().FieldByName(t.block)
+	}
+	var used, ignored []string
+	for _, key := range l.keys {
+		if legacy.IsValid() && hasKey(legacy.Type(), key) {
+			used = append(used, key)
+		} else {
+			ignored = append(ignored, key)
+		}
+	}
+	if len(used) > 0 {
+		log.Printf("Reading %s directly under Backend, which is deprecated: move them to Backend.%s",
+			strings.Join(used, ", "), backendTypes[backendType].block)
+	}
+	if len(ignored) > 0 {
+		log.Printf("Ignoring Backend keys not used by the %s backend: %s", backendType, strings.Join(ignored, ", "))
+	}
+	if !legacy.IsValid() {
+		return
+	}
+
+	merged := reflect.New(block.Type()).Elem()
+	merged.Set(legacy)
+	mergeSection(merged, block)
+	block.Set(merged)
+}
+
+// hasKey returns true if the struct type t has a field with the configuration
+// key key
+func hasKey(t reflect.Type, key string) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if strings.EqualFold(yamlKey(t.Field(i)), key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// key returns the value of an optional key for comparison ("" if unset)
+func key(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *string:
+		if v != nil {
+			return *v
+		}
+	case *int:
+		if v != nil {
+			return *v
+		}
+	}
+	return ""
+}
+
+func TestBackendConfigBlocks(t *testing.T) {
+	tests := []struct {
+		name        string
+		backendType string
+		yaml        string
+		get         func(b BackendConfig) interface{}
+		want        interface{}
+	}{
+		{
+			name:        "docker",
+			backendType: "docker",
+			yaml:        "Docker:\n  Image: vnc\n  Port: 5901\n",
+			get:         func(b BackendConfig) interface{} { return key(b.Docker.Image) },
+			want:        "vnc",
+		},
+		{
+			name:        "kubernetes",
+			backendType: "kubernetes",
+			yaml:        "Kubernetes:\n  Namespace: vnc\n  LabelSelector: app=vnc\n",
+			get:         func(b BackendConfig) interface{} { return key(b.Kubernetes.LabelSelector) },
+			want:        "app=vnc",
+		},
+		{
+			name:        "static",
+			backendType: "static",
+			yaml:        "Static:\n  Address: vnc:5900\n",
+			get:         func(b BackendConfig) interface{} { return key(b.Static.Address) },
+			want:        "vnc:5900",
+		},
+		{
+			name:        "roundrobin",
+			backendType: "roundrobin",
+			yaml:        "RoundRobin:\n  Targets: vnc1:5900,vnc2:5900\n",
+			get:         func(b BackendConfig) interface{} { return key(b.RoundRobin.Targets) },
+			want:        "vnc1:5900,vnc2:5900",
+		},
+		{
+			name:        "command",
+			backendType: "command",
+			yaml:        "Command:\n  Command: Xvnc :1\n  Port: 5901\n",
+			get:         func(b BackendConfig) interface{} { return key(b.Command.Command) },
+			want:        "Xvnc :1",
+		},
+		{
+			name:        "ssh",
+			backendType: "ssh",
+			yaml:        "SSH:\n  Host: vnc.example.com\n",
+			get:         func(b BackendConfig) interface{} { return b.SSH.Host },
+			want:        "vnc.example.com",
+		},
+		{
+			name:        "legacy key",
+			backendType: "static",
+			yaml:        "Address: vnc:5900\n",
+			get:         func(b BackendConfig) interface{} { return key(b.Static.Address) },
+			want:        "vnc:5900",
+		},
+		{
+			name:        "legacy command",
+			backendType: "command",
+			yaml:        "Command: Xvnc :1\nPort: 5901\n",
+			get:         func(b BackendConfig) interface{} { return key(b.Command.Port) },
+			want:        5901,
+		},
+		{
+			name:        "block takes precedence over legacy key",
+			backendType: "docker",
+			yaml:        "Image: old\nDocker:\n  Image: new\n",
+			get:         func(b BackendConfig) interface{} { return key(b.Docker.Image) },
+			want:        "new",
+		},
+		{
+			name:        "legacy key of another type ignored",
+			backendType: "docker",
+			yaml:        "Address: vnc:5900\n",
+			get:         func(b BackendConfig) interface{} { return key(b.Static.Address) },
+			want:        "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b BackendConfig
+			if err := yaml.Unmarshal([]byte(tt.yaml), &b); err != nil {
+				t.Fatal(err)
+			}
+			b.resolveLegacy(tt.backendType)
+			if got := tt.get(b); got != tt.want {
+				t.Errorf("Got %v, want %v", got, tt.want)
+			}
+			if b.legacy != nil {
+				t.Error("Legacy keys not resolved")
+			}
+		})
+	}
+}
+
+func TestBackendConfigLegacyJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string
+	}{
+		{"block", `{"Docker": {"Image": "vnc"}}`, "vnc"},
+		{"legacy key", `{"Image": "vnc"}`, "vnc"},
+		{"legacy key in lower case", `{"image": "vnc"}`, "vnc"},
+		{"block in lower case", `{"docker": {"image": "vnc"}}`, "vnc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b BackendConfig
+			if err := json.Unmarshal([]byte(tt.json), &b); err != nil {
+				t.Fatal(err)
+			}
+			b.resolveLegacy("docker")
+			if got := key(b.Docker.Image); got != tt.want {
+				t.Errorf("Docker.Image = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyLegacyEnv(t *testing.T) {
+	env := map[string]string{
+		"VNCD_BACKEND_IMAGE":        "old",
+		"VNCD_BACKEND_ADDRESS":      "vnc:5900",
+		"VNCD_BACKEND_DOCKER_IMAGE": "new",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	var c Config
+	if err := applyEnvOverrides(&c, lookup); err != nil {
+		t.Fatal(err)
+	}
+	c.Backend.resolveLegacy("docker")
+	if got := key(c.Backend.Docker.Image); got != "new" {
+		t.Errorf("Docker.Image = %v, want new", got)
+	}
+	if got := key(c.Backend.Static.Address); got != "" {
+		t.Errorf("Static.Address = %v, want it unset", got)
+	}
+}
@@ -16,6 +16,8 @@ package main
 */
 
 import (
+	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/json"
 	"flag"
@@ -25,240 +27,1330 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/kramergroup/vncd"
 	"github.com/kramergroup/vncd/backends"
+	"github.com/kramergroup/vncd/rfb"
+	"github.com/kramergroup/vncd/webclient"
 	yaml "gopkg.in/yaml.v2"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
 )
 
+// kubernetesTimeout limits the API requests selecting or creating the pod of a
+// Kubernetes backend
+const kubernetesTimeout = 30 * time.Second
+
+// defaultKubernetesPort is the port of pre-provisioned pods if none is
+// configured
+const defaultKubernetesPort = 5900
+
+// version is the build version, set with -ldflags "-X main.version=..."
+var version = "dev"
+
 var (
-	configFile    = "/etc/vncd/vncd.conf.yaml"
-	defaultConfig = readConfigFile(configFile)
+	configFile = flag.String("config", "/etc/vncd/vncd.conf.yaml", "configuration file")
+
+	// backendPort and startupTimeout are shared by the backend types using
+	// them. A port of 0 selects the default of the type.
+	backendPort = flag.Int("backendPort", 0,
+		"port of the VNC server in backends (0 = image port for docker, free port for command, 5900 or template port for kubernetes)")
+	startupTimeout = flag.Int("startupTimeout", 0, "seconds to wait for backend containers to accept connections")
+
+	// defaultConfig holds the configuration file (and environment
+	// overrides). Flags not given on the command line take their values
+	// from it once it has been read.
+	defaultConfig Config
 
 	config = Config{
 		Frontend: FrontendConfig{
-			Port:       flag.Int("port", *defaultConfig.Frontend.Port, "proxy local address"),
-			TLS:        flag.Bool("tls", *defaultConfig.Frontend.TLS, "tls/ssl between client and proxy"),
-			Cert:       flag.String("cert", *defaultConfig.Frontend.Cert, "proxy certificate x509 file for tls/ssl use"),
-			Key:        flag.String("key", *defaultConfig.Frontend.Key, "proxy key x509 file for tls/ssl use"),
-			RemoteTLS:  flag.Bool("remotetls", *defaultConfig.Frontend.RemoteTLS, "tls/ssl between proxy and VNC server"),
-			HealthPort: flag.Int("healthPort", *defaultConfig.Frontend.HealthPort, "health endpoint address"),
+			Port:      flag.Int("port", 5900, "proxy local address"),
+			TLS:       flag.Bool("tls", false, "tls/ssl between client and proxy"),
+			Cert:      flag.String("cert", "", "proxy certificate x509 file for tls/ssl use"),
+			Key:       flag.String("key", "", "proxy key x509 file for tls/ssl use"),
+			RemoteTLS: flag.Bool("remotetls", false, "tls/ssl between proxy and VNC server"),
+			RemoteTLSPolicy: flag.String("remoteTLSPolicy", vncd.TLSPolicyInsecure,
+				"verification of backend certificates (strict, skip-san or insecure)"),
+			RemoteCA:   flag.String("remoteCA", "", "CA file for verifying backend certificates"),
+			HealthPort: flag.Int("healthPort", 9999, "health endpoint address"),
 			WebSocket:  flag.Int("websocket", 80, "Websocket frontend port"),
+			SharedHealth: flag.Bool("sharedHealth", true,
+				"serve a single health endpoint for all listeners"),
+			WebSocketHealthPort: flag.Int("websocketHealthPort", 9998,
+				"websocket health endpoint address (if not shared)"),
+			UpdateRequestRate: flag.Int("updateRequestRate", 0,
+				"maximum framebuffer update requests per second and connection (0 = unlimited)"),
+			WebSocketTLS: flag.Bool("websocketTLS", false,
+				"tls/ssl (wss) between websocket client and proxy"),
+			ClientCA: flag.String("clientCA", "",
+				"CA file for verifying websocket client certificates (enables mTLS)"),
+			RedirectTarget: flag.String("redirectTarget", "",
+				"base URL of a peer receiving new websocket connections while draining"),
+			CutTextWebhook: flag.String("cutTextWebhook", "",
+				"URL receiving the clipboard texts of backends"),
+			MaxCutText: flag.Int("maxCutText", vncd.DefaultMaxCutText,
+				"maximum length of clipboard texts passed to the webhook"),
+			ExitAfterIdle: flag.Int("exitAfterIdle", 0,
+				"seconds without sessions after which vncd exits (0 = never)"),
+			EarlyHandshake: flag.Bool("earlyHandshake", false,
+				"send the RFB greeting to clients before the backend is ready"),
+			KeepaliveInterval: flag.Int("keepaliveInterval", 0,
+				"seconds of client inactivity after which the backend is sent an update request (0 = never)"),
+			IdleTimeout: flag.Int("idleTimeout", 0,
+				"seconds without traffic after which websocket relays are closed (0 = never)"),
+			RecordDir: flag.String("recordDir", "",
+				"directory tcp sessions are recorded to (empty = no recording)"),
+			ProxyProtocol: flag.String("proxyProtocol", "",
+				"read PROXY protocol headers on the tcp listener (required, optional or empty)"),
+			ProxyHeaderTimeout: flag.Int("proxyHeaderTimeout", 5,
+				"seconds to wait for a PROXY protocol header"),
+			MinRFBVersion: flag.String("minRFBVersion", "",
+				"refuse clients requesting an older RFB version, e.g. 3.8"),
+			StatsD: flag.String("statsd", "",
+				"host:port of a StatsD server receiving session metrics"),
+			AdmissionWebhook: flag.String("admissionWebhook", "",
+				"URL deciding about each connection before a backend is created"),
+			AdmissionTimeout: flag.Int("admissionTimeout", 5,
+				"timeout of the admission webhook in seconds"),
+			AdmissionFailOpen: flag.Bool("admissionFailOpen", false,
+				"admit connections if the admission webhook fails"),
+			ScaleDownBelow: flag.Int("scaleDownBelow", 0,
+				"report not ready with fewer open connections while the scale down hint is set (0 = never)"),
+			AdminToken: flag.String("adminToken", "",
+				"bearer token required by the /config endpoints of the health port (empty = disabled)"),
+			HandshakeFailureReason: flag.String("handshakeFailureReason", "VNC server unavailable",
+				"reason sent to early greeted clients if the backend fails (empty = close silently)"),
+			WebClient:     flag.Bool("webClient", false, "serve the built-in noVNC client"),
+			WebClientPath: flag.String("webClientPath", "/vnc/", "path of the built-in noVNC client"),
 		},
 		Backend: BackendConfig{
-			Port:          flag.Int("backendPort", *defaultConfig.Backend.Port, "backend address"),
-			Type:          flag.String("backendType", *defaultConfig.Backend.Type, "backend type"),
-			Image:         flag.String("backendImage", *defaultConfig.Backend.Image, "backend address"),
-			Network:       flag.String("backendNetwork", *defaultConfig.Backend.Network, "backend network"),
-			Kubeconfig:    flag.String("kubeconfig", *defaultConfig.Backend.Network, "Location of the kubeconfig file"),
-			LabelSelector: flag.String("labelSelector", *defaultConfig.Backend.LabelSelector, "Label selector for pods"),
-			Namespace:     flag.String("namespace", *defaultConfig.Backend.Namespace, "Namespace for pods"),
-			Dispose:       flag.Bool("dispose", *defaultConfig.Backend.Dispose, "Dispose pods after use"),
+			Type: flag.String("backendType", "docker", "backend type"),
+			MaxConcurrentTerminations: flag.Int("maxTerminations", 0,
+				"maximum number of backends terminated concurrently (0 = unlimited)"),
+			Docker: DockerConfig{
+				Image:          flag.String("backendImage", "kramergroup/vnc-alpine", "backend address"),
+				Port:           backendPort,
+				StartupTimeout: startupTimeout,
+				Network:        flag.String("backendNetwork", "", "backend network"),
+				CPUShares:      flag.Int64("cpuShares", 0, "relative CPU weight of backend containers"),
+				NanoCPUs:       flag.Int64("nanoCPUs", 0, "CPU quota of backend containers in 1e-9 CPUs"),
+				MemoryBytes:    flag.Int64("memory", 0, "memory limit of backend containers in bytes"),
+				RejectDuringPull: flag.Bool("rejectDuringPull", false,
+					"reject connections while the backend image is pulled"),
+				PoolSize: flag.Int("poolSize", 0,
+					"number of backend containers created in advance (0 = none)"),
+				User: flag.String("user", "",
+					"user[:group] running backend container processes"),
+				Hostname: flag.String("hostname", "",
+					"host name of backend containers"),
+				GPUs: flag.String("gpus", "",
+					"GPUs of backend containers (all, a count or device=<id>,...)"),
+				ShmSize: flag.Int64("shmSize", 0,
+					"size of /dev/shm of backend containers in bytes"),
+				StopTimeout: flag.Int("stopTimeout", 0,
+					"seconds backend containers get to stop before they are killed"),
+				PullPolicy:  flag.String("pullPolicy", backends.PullIfNotPresent, "pull policy of backend images (always, ifnotpresent or never)"),
+				PullTimeout: flag.Int("pullTimeout", 0, "timeout of backend image pulls in seconds (0 = none)"),
+				AutoRemove:  flag.Bool("autoRemove", true, "remove backend containers once stopped"),
+				NamePrefix:  flag.String("namePrefix", "", "name prefix of backend containers"),
+			},
+			Kubernetes: KubernetesConfig{
+				Port:          backendPort,
+				Kubeconfig:    flag.String("kubeconfig", "", "Location of the kubeconfig file"),
+				LabelSelector: flag.String("labelSelector", "", "Label selector for pods"),
+				FieldSelector: flag.String("fieldSelector", "", "Field selector for pods (e.g. spec.nodeName=node1)"),
+				Namespace:     flag.String("namespace", "", "Namespace for pods"),
+				PreferSameNode: flag.Bool("preferSameNode", false,
+					"prefer pods on the node of the proxy (NODE_NAME)"),
+				ReadyTimeout: flag.Int("readyTimeout", 30,
+					"seconds to wait for pods to become ready (0 = do not wait)"),
+				Ephemeral: flag.Bool("ephemeral", false,
+					"delete pods after use instead of unlocking them"),
+				GracePeriod: flag.Int("gracePeriod", -1,
+					"seconds deleted pods get to shut down (-1 = pod default)"),
+				ServiceName: flag.String("serviceName", "",
+					"service to connect to pods through instead of the pod IP"),
+				ServiceNamespace: flag.String("serviceNamespace", "",
+					"namespace of the service (default: namespace of the pods)"),
+				LockAnnotation: flag.String("lockAnnotation", backends.DefaultLockAnnotation,
+					"annotation key locking pods"),
+				LockTTL: flag.Int("lockTTL", 0,
+					"seconds after which locks not renewed expire (0 = never)"),
+				PodTemplate: flag.String("podTemplate", "",
+					"YAML file of a pod template to create a pod per connection from"),
+			},
+			Static: StaticConfig{
+				Address: flag.String("backendAddress", "", "address (host:port) of the static backend"),
+			},
+			RoundRobin: RoundRobinConfig{
+				Targets: flag.String("backendTargets", "", "comma-separated addresses (host:port) of round robin backends"),
+			},
+			Command: CommandConfig{
+				Command:        flag.String("backendCommand", "", "command starting a VNC server on $VNC_PORT"),
+				Port:           backendPort,
+				StartupTimeout: startupTimeout,
+			},
 		},
 	}
-	backendFactory func() (backends.Backend, error)
+	backendFactory        func() (backends.Backend, error)
+	contextBackendFactory vncd.ContextBackendFactory
+	readinessProbe        backends.Probe
+	sessions              = vncd.NewSessionRegistry()
+	limiter               *vncd.ConnectionLimiter
+	certStore             *vncd.CertificateStore
+	observer              vncd.BackendObserver
+	admitter              vncd.Admitter
+	scaleDown             scaleDownHint
+	started               = time.Now()
 )
 
 // Config holds to global configuration of the proxy
 type Config struct {
-	Frontend FrontendConfig `yaml:"Frontend"`
-	Backend  BackendConfig  `yaml:"Backend"`
+	Frontend FrontendConfig `yaml:"Frontend" json:"Frontend"`
+	Backend  BackendConfig  `yaml:"Backend" json:"Backend"`
 }
 
 // FrontendConfig contains the front-end related configuration
 type FrontendConfig struct {
-	Port       *int    `yaml:"Port"`
-	HealthPort *int    `yaml:"HealthPort"`
-	TLS        *bool   `yaml:"TLS"`
-	Cert       *string `yaml:"Cert"`
-	Key        *string `yaml:"Key"`
-	RemoteTLS  *bool   `yaml:"RemoteTLS"`
-	WebSocket  *int    `yaml:"Websocket"`
-}
-
-// BackendConfig holds backend configurartion
-// Currently, this is a union of configurartion variables
-// of ALL backend implementations to keep things simple
-// TODO Find a better way to separate out backend
-//      configurations for different backends
+	Port       *int    `yaml:"Port" json:"Port"`
+	HealthPort *int    `yaml:"HealthPort" json:"HealthPort"`
+	TLS        *bool   `yaml:"TLS" json:"TLS"`
+	Cert       *string `yaml:"Cert" json:"Cert"`
+	Key        *string `yaml:"Key" json:"Key"`
+	RemoteTLS  *bool   `yaml:"RemoteTLS" json:"RemoteTLS"`
+	WebSocket  *int    `yaml:"Websocket" json:"Websocket"`
+
+	// RemoteTLSPolicy selects how backend certificates are verified
+	// (strict, skip-san or insecure). RemoteCA holds the CAs to verify
+	// against (system CAs if empty).
+	RemoteTLSPolicy *string `yaml:"RemoteTLSPolicy" json:"RemoteTLSPolicy"`
+	RemoteCA        *string `yaml:"RemoteCA" json:"RemoteCA"`
+
+	// SharedHealth selects a single health endpoint on HealthPort reporting
+	// all listeners (true), or one endpoint per listener (false)
+	SharedHealth        *bool `yaml:"SharedHealth" json:"SharedHealth"`
+	WebSocketHealthPort *int  `yaml:"WebsocketHealthPort" json:"WebsocketHealthPort"`
+
+	// WebSocketTLS serves the websocket frontend via TLS using Cert and Key.
+	// If ClientCA is set, clients need a certificate signed by it.
+	WebSocketTLS *bool   `yaml:"WebsocketTLS" json:"WebsocketTLS"`
+	ClientCA     *string `yaml:"ClientCA" json:"ClientCA"`
+
+	// RedirectTarget is the base URL of a peer instance that new websocket
+	// connections are redirected to while draining
+	RedirectTarget *string `yaml:"RedirectTarget" json:"RedirectTarget"`
+
+	// SessionLabels maps label names to their source (see vncd.LabelMapping)
+	SessionLabels map[string]string `yaml:"SessionLabels" json:"SessionLabels"`
+
+	// RateLimit limits the rate of new connections (see vncd.RateLimit). It
+	// can be changed at runtime via /config/ratelimit on the health port.
+	RateLimit *RateLimitConfig `yaml:"RateLimit" json:"RateLimit"`
+
+	// AdminToken is the bearer token required by the endpoints changing the
+	// configuration at runtime (/config/...). They are disabled if it is empty.
+	AdminToken *string `yaml:"AdminToken" json:"AdminToken"`
+
+	// CutTextWebhook receives the clipboard texts backends send to clients
+	// as JSON posts. Texts are truncated to MaxCutText bytes.
+	CutTextWebhook *string `yaml:"CutTextWebhook" json:"CutTextWebhook"`
+	MaxCutText     *int    `yaml:"MaxCutText" json:"MaxCutText"`
+
+	// MetricLabels lists the session labels used as labels of the metrics
+	// served at /metrics. Other labels are omitted from the metrics.
+	MetricLabels []string `yaml:"MetricLabels" json:"MetricLabels"`
+
+	// StatsD sends session metrics to the StatsD server at host:port via
+	// UDP (disabled if empty)
+	StatsD *string `yaml:"StatsD" json:"StatsD"`
+
+	// AdmissionWebhook receives the session info of each connection as JSON
+	// and responds with {"allowed": bool, "reason": "...", "class": "..."}
+	// before a backend is created. The class selects a resource class by
+	// name. If the webhook fails within AdmissionTimeout seconds, connections
+	// are admitted if AdmissionFailOpen is set.
+	AdmissionWebhook  *string `yaml:"AdmissionWebhook" json:"AdmissionWebhook"`
+	AdmissionTimeout  *int    `yaml:"AdmissionTimeout" json:"AdmissionTimeout"`
+	AdmissionFailOpen *bool   `yaml:"AdmissionFailOpen" json:"AdmissionFailOpen"`
+
+	// ScaleDownBelow makes the health check report that the proxy does not
+	// accept connections while fewer connections are open and the scale down
+	// hint has been set (PUT true to /config/scaledown on the health port,
+	// which requires the AdminToken).
+	// Existing sessions continue, so that the instance can be removed once
+	// they have ended (0 = disabled).
+	ScaleDownBelow *int `yaml:"ScaleDownBelow" json:"ScaleDownBelow"`
+
+	// UpdateRequestRate limits the framebuffer update requests per second
+	// a client can send (0 = unlimited)
+	UpdateRequestRate *int `yaml:"UpdateRequestRate" json:"UpdateRequestRate"`
+
+	// ExitAfterIdle shuts vncd down once there have been no sessions for
+	// the given number of seconds (0 = never)
+	ExitAfterIdle *int `yaml:"ExitAfterIdle" json:"ExitAfterIdle"`
+
+	// EarlyHandshake greets clients with the RFB protocol version before
+	// the backend is ready
+	EarlyHandshake *bool `yaml:"EarlyHandshake" json:"EarlyHandshake"`
+
+	// HandshakeFailureReason is sent to clients greeted early if the backend
+	// fails before the handshake is complete (empty = close silently)
+	HandshakeFailureReason *string `yaml:"HandshakeFailureReason" json:"HandshakeFailureReason"`
+
+	// KeepaliveInterval sends an incremental FramebufferUpdateRequest to the
+	// backend after the given number of seconds without client messages, as
+	// some VNC servers disconnect idle clients (0 = disabled)
+	KeepaliveInterval *int `yaml:"KeepaliveInterval" json:"KeepaliveInterval"`
+
+	// IdleTimeout closes websocket relays and terminates their backends
+	// after the given number of seconds without traffic in either
+	// direction (0 = disabled)
+	IdleTimeout *int `yaml:"IdleTimeout" json:"IdleTimeout"`
+
+	// RecordDir records the RFB byte stream of every session of the tcp
+	// listener to a file in this directory (disabled if empty)
+	RecordDir *string `yaml:"RecordDir" json:"RecordDir"`
+
+	// ProxyProtocol reads PROXY protocol headers of a load balancer on the
+	// tcp listener: "required", "optional" or empty (disabled). Headers must
+	// arrive within ProxyHeaderTimeout seconds.
+	ProxyProtocol      *string `yaml:"ProxyProtocol" json:"ProxyProtocol"`
+	ProxyHeaderTimeout *int    `yaml:"ProxyHeaderTimeout" json:"ProxyHeaderTimeout"`
+
+	// MinRFBVersion (e.g. "3.8") refuses clients requesting an older
+	// protocol version
+	MinRFBVersion *string `yaml:"MinRFBVersion" json:"MinRFBVersion"`
+
+	// WebClient serves the built-in noVNC client under WebClientPath on the
+	// health port of the websocket listener
+	WebClient     *bool   `yaml:"WebClient" json:"WebClient"`
+	WebClientPath *string `yaml:"WebClientPath" json:"WebClientPath"`
+}
+
+// BackendConfig holds backend configurartion. Keys of a backend type are kept
+// in a block named after the type (e.g. Docker for the docker type). Keys
+// directly under Backend, as in former versions, are read into the block of
+// the configured type (see resolveLegacy).
 type BackendConfig struct {
 
 	// Common fields
-	Type *string `yaml:"Type"`
-	Port *int    `yaml:"Port"`
+	Type *string `yaml:"Type" json:"Type"`
+
+	// MaxConcurrentTerminations bounds the number of backends terminated
+	// at the same time (0 = unlimited)
+	MaxConcurrentTerminations *int `yaml:"MaxConcurrentTerminations" json:"MaxConcurrentTerminations"`
+
+	// Classes select differently sized backends based on the geometry
+	// requested by websocket clients
+	Classes []ResourceClassConfig `yaml:"Classes" json:"Classes"`
+
+	// ReadinessProbe is run against new backends before connecting
+	ReadinessProbe *ProbeConfig `yaml:"ReadinessProbe" json:"ReadinessProbe"`
+
+	// Keys of the backend types. Only the block of Type may be set.
+	Docker     DockerConfig     `yaml:"Docker" json:"Docker"`
+	Kubernetes KubernetesConfig `yaml:"Kubernetes" json:"Kubernetes"`
+	Static     StaticConfig     `yaml:"Static" json:"Static"`
+	RoundRobin RoundRobinConfig `yaml:"RoundRobin" json:"RoundRobin"`
+	Command    CommandConfig    `yaml:"Command" json:"Command"`
 
-	// Type Docker fields
-	Image   *string `yaml:"Image"`
-	Network *string `yaml:"Network"`
+	// SSH configures the tunnel of the ssh backend type
+	SSH *SSHConfig `yaml:"SSH" json:"SSH"`
 
-	// Kubernetes fields
-	LabelSelector *string `yaml:"LabelSelector"`
-	Namespace     *string `yaml:"Namespace"`
-	Kubeconfig    *string `yaml:"Kubeconfig"`
-	Dispose       *bool   `yaml:"Dispose"`
+	// legacy holds the keys found directly under Backend
+	legacy *legacyBackendConfig
 }
 
-func main() {
-	flag.Parse()
+// DockerConfig holds the keys of the docker backend type
+type DockerConfig struct {
+	Image   *string `yaml:"Image" json:"Image"`
+	Port    *int    `yaml:"Port" json:"Port"` // 0 = the single port exposed by the image
+	Network *string `yaml:"Network" json:"Network"`
+
+	// Env holds environment variables (KEY=value) passed to the container
+	Env []string `yaml:"Env" json:"Env"`
+
+	// User (user[:group]) and Hostname of the container process
+	User     *string `yaml:"User" json:"User"`
+	Hostname *string `yaml:"Hostname" json:"Hostname"`
 
-	processConfig()
+	// Mounts holds bind mounts and volumes mounted into the container
+	Mounts []MountConfig `yaml:"Mounts" json:"Mounts"`
 
-	term := make(chan bool)
-	go startProxy(&config, term)
-	go startWebsocketProxy(&config, term)
-	<-term
+	// Resource limits of containers (0 = Docker default)
+	CPUShares   *int64 `yaml:"CPUShares" json:"CPUShares"`
+	NanoCPUs    *int64 `yaml:"NanoCPUs" json:"NanoCPUs"`
+	MemoryBytes *int64 `yaml:"MemoryBytes" json:"MemoryBytes"`
+
+	// GPUs requests NVIDIA GPUs: "all", a count or "device=<id>,..."
+	GPUs *string `yaml:"GPUs" json:"GPUs"`
+
+	// ShmSize is the size of /dev/shm of containers in bytes (0 = Docker
+	// default)
+	ShmSize *int64 `yaml:"ShmSize" json:"ShmSize"`
+
+	// RejectDuringPull rejects connections while the image is being pulled
+	// instead of letting them wait for the pull to finish
+	RejectDuringPull *bool `yaml:"RejectDuringPull" json:"RejectDuringPull"`
+
+	// PoolSize keeps the given number of containers of the default image
+	// created in advance to cut session startup latency (0 = none)
+	PoolSize *int `yaml:"PoolSize" json:"PoolSize"`
+
+	// StartupTimeout waits up to the given number of seconds for new
+	// containers to accept connections (0 = do not wait)
+	StartupTimeout *int `yaml:"StartupTimeout" json:"StartupTimeout"`
+
+	// PullPolicy is always, ifnotpresent or never
+	PullPolicy *string `yaml:"PullPolicy" json:"PullPolicy"`
+
+	// RegistryAuth holds credentials for pulling from a private registry
+	RegistryAuth *RegistryAuthConfig `yaml:"RegistryAuth" json:"RegistryAuth"`
+
+	// PullTimeout aborts image pulls after the given number of seconds
+	// (0 = no timeout)
+	PullTimeout *int `yaml:"PullTimeout" json:"PullTimeout"`
+
+	// AutoRemove removes containers once they have been stopped
+	AutoRemove *bool `yaml:"AutoRemove" json:"AutoRemove"`
+
+	// StopTimeout is the number of seconds containers get to stop before
+	// they are killed (0 = Docker default)
+	StopTimeout *int `yaml:"StopTimeout" json:"StopTimeout"`
+
+	// NamePrefix and Labels identify the containers created by vncd
+	NamePrefix *string           `yaml:"NamePrefix" json:"NamePrefix"`
+	Labels     map[string]string `yaml:"Labels" json:"Labels"`
+
+	// AllowedImages restricts the images of containers (including those of
+	// resource classes) to globs or /regular expressions/ (empty = all)
+	AllowedImages []string `yaml:"AllowedImages" json:"AllowedImages"`
 }
 
-func startProxy(config *Config, term chan<- bool) {
-	laddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", *config.Frontend.Port))
+// KubernetesConfig holds the keys of the kubernetes backend type
+type KubernetesConfig struct {
+	LabelSelector *string `yaml:"LabelSelector" json:"LabelSelector"`
+	FieldSelector *string `yaml:"FieldSelector" json:"FieldSelector"`
+	Namespace     *string `yaml:"Namespace" json:"Namespace"`
+	Kubeconfig    *string `yaml:"Kubeconfig" json:"Kubeconfig"`
+	Port          *int    `yaml:"Port" json:"Port"` // 0 = 5900 or the first container port of PodTemplate
+
+	// Dispose is the former name of Ephemeral
+	//
+	// Deprecated: use Ephemeral
+	Dispose *bool `yaml:"Dispose" json:"Dispose"`
+
+	// Ephemeral deletes pods after use (with GracePeriod seconds to shut
+	// down, -1 = pod default) instead of removing the lock so that they
+	// handle the next connection
+	Ephemeral   *bool `yaml:"Ephemeral" json:"Ephemeral"`
+	GracePeriod *int  `yaml:"GracePeriod" json:"GracePeriod"`
+
+	// PreferSameNode prefers pods on the node of the proxy, which is read
+	// from the NODE_NAME environment variable (downward API)
+	PreferSameNode *bool `yaml:"PreferSameNode" json:"PreferSameNode"`
+
+	// ReadyTimeout waits up to the given number of seconds for the selected
+	// pod to be Running and Ready (0 = do not wait)
+	ReadyTimeout *int `yaml:"ReadyTimeout" json:"ReadyTimeout"`
+
+	// ServiceName connects to pods through this Service (in ServiceNamespace,
+	// default Namespace) instead of their pod IP
+	ServiceName      *string `yaml:"ServiceName" json:"ServiceName"`
+	ServiceNamespace *string `yaml:"ServiceNamespace" json:"ServiceNamespace"`
+
+	// LockAnnotation is the annotation key locking pods. Independent
+	// deployments sharing a namespace need distinct keys.
+	LockAnnotation *string `yaml:"LockAnnotation" json:"LockAnnotation"`
+
+	// LockTTL (in seconds) lets locks of crashed proxies expire. Locks in use
+	// are renewed every LockTTL/3 seconds. Locks never expire if 0.
+	LockTTL *int `yaml:"LockTTL" json:"LockTTL"`
+
+	// PodTemplate is a YAML file holding a pod template (metadata and spec).
+	// If set, a pod is created from it for every connection and deleted
+	// afterwards instead of locking existing pods.
+	PodTemplate *string `yaml:"PodTemplate" json:"PodTemplate"`
+}
+
+// StaticConfig holds the keys of the static backend type
+type StaticConfig struct {
+
+	// Address (host:port) of the VNC server
+	Address *string `yaml:"Address" json:"Address"`
+}
+
+// RoundRobinConfig holds the keys of the roundrobin backend type
+type RoundRobinConfig struct {
+
+	// Targets are the comma-separated addresses (host:port) of the VNC
+	// servers
+	Targets *string `yaml:"Targets" json:"Targets"`
+}
+
+// CommandConfig holds the keys of the command backend type
+type CommandConfig struct {
+
+	// Command is run with sh -c for each connection and has to start a VNC
+	// server on localhost:$VNC_PORT. Port sets VNC_PORT (a free port if 0),
+	// StartupTimeout the seconds to wait for the server.
+	Command        *string `yaml:"Command" json:"Command"`
+	Port           *int    `yaml:"Port" json:"Port"`
+	StartupTimeout *int    `yaml:"StartupTimeout" json:"StartupTimeout"`
+}
+
+// ResourceClassConfig describes a class of backends suitable for clients
+// requesting a geometry of at least MinWidth x MinHeight
+type ResourceClassConfig struct {
+	Name          string `yaml:"Name" json:"Name"`
+	MinWidth      int    `yaml:"MinWidth" json:"MinWidth"`
+	MinHeight     int    `yaml:"MinHeight" json:"MinHeight"`
+	Image         string `yaml:"Image" json:"Image"`                 // Docker image of the class
+	LabelSelector string `yaml:"LabelSelector" json:"LabelSelector"` // Kubernetes pod selector of the class
+}
+
+// RateLimitConfig limits the rate of new connections per second (0 = no limit)
+type RateLimitConfig struct {
+	Global float64 `yaml:"Global" json:"Global"`
+	PerIP  float64 `yaml:"PerIP" json:"PerIP"`
+	Burst  int     `yaml:"Burst" json:"Burst"`
+}
+
+// RegistryAuthConfig holds credentials of a private Docker registry. They are
+// either given directly or read from a Docker client configuration file.
+// Environment variables (e.g. $REGISTRY_PASSWORD) are expanded.
+type RegistryAuthConfig struct {
+	Server     string `yaml:"Server" json:"Server"`
+	Username   string `yaml:"Username" json:"Username"`
+	Password   string `yaml:"Password" json:"Password"`
+	ConfigFile string `yaml:"ConfigFile" json:"ConfigFile"`
+}
+
+// SSHConfig configures the SSH tunnel to a VNC server. Environment variables
+// (e.g. $SSH_PASSWORD) are expanded.
+type SSHConfig struct {
+	Host           string `yaml:"Host" json:"Host"` // host[:port] of the SSH server
+	User           string `yaml:"User" json:"User"`
+	KeyFile        string `yaml:"KeyFile" json:"KeyFile"`
+	Password       string `yaml:"Password" json:"Password"`
+	KnownHostsFile string `yaml:"KnownHostsFile" json:"KnownHostsFile"`
+	RemoteAddress  string `yaml:"RemoteAddress" json:"RemoteAddress"` // VNC server as seen from the SSH host
+
+	// InsecureIgnoreHostKey accepts any host key if no KnownHostsFile is set
+	InsecureIgnoreHostKey bool `yaml:"InsecureIgnoreHostKey" json:"InsecureIgnoreHostKey"`
+}
+
+// MountConfig configures a mount of a Docker backend container
+type MountConfig struct {
+	Type     string `yaml:"Type" json:"Type"` // bind (default), volume or tmpfs
+	Source   string `yaml:"Source" json:"Source"`
+	Target   string `yaml:"Target" json:"Target"`
+	ReadOnly bool   `yaml:"ReadOnly" json:"ReadOnly"`
+}
+
+// ProbeConfig configures a backend readiness probe
+type ProbeConfig struct {
+	Type    string   `yaml:"Type" json:"Type"`       // tcp, http or exec
+	Path    string   `yaml:"Path" json:"Path"`       // http path (http)
+	Port    int      `yaml:"Port" json:"Port"`       // port if not the backend port (http)
+	Command []string `yaml:"Command" json:"Command"` // command run inside the backend (exec)
+}
+
+func main() {
+	flag.Parse()
+
+	fileConfig, err := loadConfigFile(*configFile)
 	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
+	defaultConfig = fileConfig
+	applyFileConfig(&config, fileConfig)
 
-	if *config.Frontend.TLS && !exists(*config.Frontend.Cert) && !exists(*config.Frontend.Key) {
-		fmt.Println("certificate and key file required")
+	if err := config.Validate(); err != nil {
+		fmt.Println(err.Error())
 		os.Exit(1)
 	}
 
-	var p = new(vncd.Server)
+	if err := run(); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+}
+
+// run starts all frontends and blocks until the first of them stops
+func run() error {
+
+	if err := processConfig(); err != nil {
+		return err
+	}
+	defer closeBackends()
+
+	if *config.Frontend.TLS || *config.Frontend.WebSocketTLS {
+		var err error
+		if certStore, err = vncd.LoadCertificateStore(*config.Frontend.Cert, *config.Frontend.Key); err != nil {
+			return err
+		}
+	}
+	go handleSIGHUP(certStore)
+
+	proxy, err := createProxy(&config)
+	if err != nil {
+		return err
+	}
+	wsProxy, err := createWebsocketProxy(&config)
+	if err != nil {
+		return err
+	}
+
+	listeners := map[string]healthReporter{
+		"tcp":       proxy,
+		"websocket": wsProxy,
+	}
+	serveHealth := func(port int, listeners map[string]healthReporter) {
+		var client http.Handler
+		if _, ok := listeners["websocket"]; ok && *config.Frontend.WebClient {
+			client = webclient.Handler(wsProxy.Handler())
+		}
+		if err := reportHealth(port, listeners, client); err != nil {
+			log.Println(err.Error())
+		}
+	}
+	if *config.Frontend.SharedHealth {
+		go serveHealth(*config.Frontend.HealthPort, listeners)
+	} else {
+		ports := map[string]int{
+			"tcp":       *config.Frontend.HealthPort,
+			"websocket": *config.Frontend.WebSocketHealthPort,
+		}
+		for name, l := range listeners {
+			go serveHealth(ports[name], map[string]healthReporter{name: l})
+		}
+	}
+
+	go drainWebsocketProxy(wsProxy, listeners, *config.Frontend.ScaleDownBelow)
 
+	if *config.Frontend.ExitAfterIdle > 0 {
+		go exitAfterIdle(sessions, time.Duration(*config.Frontend.ExitAfterIdle)*time.Second, terminate)
+	}
+
+	term := make(chan error, 2)
+	go func() {
+		term <- startProxy(&config, proxy)
+	}()
+	go func() {
+		term <- startWebsocketProxy(&config, wsProxy)
+	}()
+	return <-term
+}
+
+// reloadCertificate reloads the frontend certificate. All TLS listeners share
+// the store and present the new certificate at once.
+func reloadCertificate(store *vncd.CertificateStore) {
+	if err := store.Reload(); err != nil {
+		log.Printf("Could not reload certificate, keeping the current one: %v", err)
+		return
+	}
+	log.Println("Reloaded certificate")
+}
+
+// exitAfterIdle calls shutdown once r has had no sessions and no connections
+// waiting for a backend for the given duration. A new connection restarts the
+// countdown.
+func exitAfterIdle(r *vncd.SessionRegistry, d time.Duration, shutdown func()) {
+	poll := time.Second
+	if d < poll {
+		poll = d
+	}
+	for r.Idle() < d {
+		time.Sleep(poll)
+	}
+	log.Printf("No sessions for %v - shutting down", d)
+	shutdown()
+}
+
+// terminate initiates a graceful shutdown
+func terminate() {
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+}
+
+// drainWebsocketProxy makes p redirect or refuse new connections once vncd is
+// shutting down and while the scale down hint drains this instance
+func drainWebsocketProxy(p *vncd.WebsocketServer, listeners map[string]healthReporter, below int) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sigs:
+			log.Println("Shutting down - draining websocket connections")
+			p.SetDraining(true)
+			return
+		case <-ticker.C:
+			open := 0
+			for _, l := range listeners {
+				open += l.CountOpenConnections()
+			}
+			p.SetDraining(scaleDown.drains(below, open))
+		}
+	}
+}
+
+func createProxy(config *Config) (*vncd.Server, error) {
+
+	var p *vncd.Server
+	var err error
 	if *config.Frontend.RemoteTLS {
-		// Testing only. You needs to specify config.ServerName insteand of InsecureSkipVerify
-		p, err = vncd.NewServer(nil, backendFactory, &tls.Config{InsecureSkipVerify: true})
+		var tlsConfig *tls.Config
+		tlsConfig, err = vncd.BackendTLSConfig(*config.Frontend.RemoteTLSPolicy, *config.Frontend.RemoteCA)
+		if err != nil {
+			return nil, err
+		}
+		p, err = vncd.NewServer(nil, backendFactory, tlsConfig)
 	} else {
 		p, err = vncd.NewServer(nil, backendFactory, nil)
 	}
+	if err != nil {
+		return nil, err
+	}
+	p.EarlyHandshake = *config.Frontend.EarlyHandshake
+	p.HandshakeFailureReason = *config.Frontend.HandshakeFailureReason
+	p.ProxyProtocol = *config.Frontend.ProxyProtocol
+	p.ProxyHeaderTimeout = time.Duration(*config.Frontend.ProxyHeaderTimeout) * time.Second
+	if *config.Frontend.MinRFBVersion != "" {
+		if p.MinRFBVersion, err = rfb.ParseVersionNumber(*config.Frontend.MinRFBVersion); err != nil {
+			return nil, err
+		}
+	}
+	p.UpdateRequestRate = float64(*config.Frontend.UpdateRequestRate)
+	p.MaxConcurrentTerminations = *config.Backend.MaxConcurrentTerminations
+	p.ReadinessProbe = readinessProbe
+	p.Sessions = sessions
+	p.Labels = vncd.LabelMapping(defaultConfig.Frontend.SessionLabels)
+	p.Limiter = limiter
+	p.Observer = observer
+	p.KeepaliveInterval = time.Duration(*config.Frontend.KeepaliveInterval) * time.Second
+	p.Admit = admitter
+	if *config.Frontend.CutTextWebhook != "" {
+		p.CutTextSink = vncd.CutTextWebhook(*config.Frontend.CutTextWebhook)
+		p.MaxCutText = *config.Frontend.MaxCutText
+	}
+	if *config.Frontend.RecordDir != "" {
+		if err := os.MkdirAll(*config.Frontend.RecordDir, 0700); err != nil {
+			return nil, err
+		}
+		p.RecordDir = *config.Frontend.RecordDir
+	}
+	return p, nil
+}
+
+func startProxy(config *Config, p *vncd.Server) error {
+	laddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", *config.Frontend.Port))
+	if err != nil {
+		return err
+	}
 
 	// Start normal proxy
 	log.Printf("Listening on %s for incomming tcp connections", laddr.String())
 	if *config.Frontend.TLS {
-		p.ListenAndServeTLS(laddr, *config.Frontend.Cert, *config.Frontend.Key)
-	} else {
-		p.ListenAndServe(laddr)
+		return p.ListenAndServeTLS(laddr, certStore.TLSConfig())
 	}
-	term <- true
+	return p.ListenAndServe(laddr)
 }
 
-func startWebsocketProxy(config *Config, term chan<- bool) {
+func createWebsocketProxy(config *Config) (*vncd.WebsocketServer, error) {
 
-	laddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", *config.Frontend.WebSocket))
+	p, err := vncd.NewContextWebsocketServer(contextBackendFactory)
 	if err != nil {
-		fmt.Println(err.Error())
-		os.Exit(1)
+		return nil, err
 	}
+	p.MaxConcurrentTerminations = *config.Backend.MaxConcurrentTerminations
+	p.ReadinessProbe = readinessProbe
+	p.Sessions = sessions
+	p.Labels = vncd.LabelMapping(defaultConfig.Frontend.SessionLabels)
+	p.Limiter = limiter
+	p.Observer = observer
+	p.KeepaliveInterval = time.Duration(*config.Frontend.KeepaliveInterval) * time.Second
+	p.IdleTimeout = time.Duration(*config.Frontend.IdleTimeout) * time.Second
+	p.Admit = admitter
+	if *config.Frontend.CutTextWebhook != "" {
+		p.CutTextSink = vncd.CutTextWebhook(*config.Frontend.CutTextWebhook)
+		p.MaxCutText = *config.Frontend.MaxCutText
+	}
+	p.RedirectTarget = *config.Frontend.RedirectTarget
+	return p, nil
+}
 
-	var p = new(vncd.WebsocketServer)
+func startWebsocketProxy(config *Config, p *vncd.WebsocketServer) error {
 
-	p, err = vncd.NewWebsocketServer(backendFactory)
+	laddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", *config.Frontend.WebSocket))
+	if err != nil {
+		return err
+	}
 
 	wsPort := fmt.Sprintf(":%d", *config.Frontend.WebSocket)
 	log.Printf("Listening on %s for incomming websocket connections\n", wsPort)
-	p.ListenAndServe(laddr)
-	term <- true
+	if *config.Frontend.WebSocketTLS {
+		tlsConfig := certStore.TLSConfig()
+		if *config.Frontend.ClientCA != "" {
+			if tlsConfig, err = vncd.MutualTLSConfig(certStore, *config.Frontend.ClientCA); err != nil {
+				return err
+			}
+		}
+		return p.ListenAndServeTLS(laddr, tlsConfig)
+	}
+	return p.ListenAndServe(laddr)
 }
 
 // readConfigFile reads configuration variables from a global
-// configuration file (provided via the -config commandline parameter)
-func readConfigFile(configFile string) Config {
+// configuration file (provided via the -config commandline parameter). Files
+// ending in .json are read as JSON, all others as YAML.
+func readConfigFile(configFile string) (Config, error) {
 
 	var fileConfig Config
-	yamlFile, err := ioutil.ReadFile(configFile)
+	data, err := ioutil.ReadFile(configFile)
+	if os.IsNotExist(err) {
+		log.Printf("Configuration file %s not found, using defaults", configFile)
+		return fileConfig, nil
+	}
 
 	if err == nil {
-		err = yaml.Unmarshal(yamlFile, &fileConfig)
+		if strings.ToLower(filepath.Ext(configFile)) == ".json" {
+			err = json.Unmarshal(data, &fileConfig)
+		} else {
+			err = yaml.Unmarshal(data, &fileConfig)
+		}
 	}
 
 	if err != nil {
-		fmt.Println("Error reading configuration from file " + configFile)
-		os.Exit(1)
+		return fileConfig, fmt.Errorf("Error reading configuration from file %s: %v", configFile, err)
 	}
-	return fileConfig
-}
-
-func processConfig() {
-
-	// Define backend factory method
-	switch *config.Backend.Type {
-	case "docker":
-		backendFactory = func() (backends.Backend, error) {
-			log.Println("Creating Docker backend with image " + *(config.Backend.Image))
-			return backends.CreateDockerBackend(*(config.Backend.Image), *(config.Backend.Port), *(config.Backend.Network))
-		}
-	case "kubernetes":
-		backendFactory = func() (backends.Backend, error) {
-			log.Printf("Createing Kubernetes backend with label selector [%s] in namespace [%s]\n", *(config.Backend.LabelSelector), *(config.Backend.Namespace))
-
-			var conf *rest.Config
-			var err error
-			if *config.Backend.Kubeconfig == "" {
-				conf, err = rest.InClusterConfig()
-				if err != nil {
-					log.Fatalf("Could not build Kubernetes configuration [%s]", err)
-				}
-			} else {
-				conf, err = clientcmd.BuildConfigFromFlags("", *config.Backend.Kubeconfig)
-				if err != nil {
-					log.Fatalf("Could not build Kubernetes configuration [%s]", err)
-				}
-			}
+	return fileConfig, nil
+}
 
-			clientset, err := kubernetes.NewForConfig(conf)
-			if err != nil {
-				log.Fatalf("Could not initialise Kubernetes configuration [%s]", err)
+// loadConfigFile reads the configuration file and applies environment
+// overrides
+func loadConfigFile(configFile string) (Config, error) {
+	fileConfig, err := readConfigFile(configFile)
+	if err == nil {
+		err = applyEnvOverrides(&fileConfig, os.LookupEnv)
+	}
+	return fileConfig, err
+}
+
+// applyFileConfig sets the keys of c that were not given on the command line
+// to their values in the configuration file, if present there
+func applyFileConfig(c *Config, file Config) {
+	mergeSection(reflect.ValueOf(&c.Frontend).Elem(), reflect.ValueOf(file.Frontend))
+
+	backendType := *c.Backend.Type
+	if !setOnCommandLine(reflect.ValueOf(c.Backend.Type)) && file.Backend.Type != nil {
+		backendType = *file.Backend.Type
+	}
+	file.Backend.resolveLegacy(backendType)
+	mergeSection(reflect.ValueOf(&c.Backend).Elem(), reflect.ValueOf(file.Backend))
+
+	// Dispose is the former name of Ephemeral
+	k, fileK := &c.Backend.Kubernetes, file.Backend.Kubernetes
+	if !setOnCommandLine(reflect.ValueOf(k.Ephemeral)) &&
+		fileK.Ephemeral == nil && fileK.Dispose != nil {
+		k.Ephemeral = fileK.Dispose
+	}
+}
+
+// envPrefix starts the names of environment variables overriding the
+// configuration file
+const envPrefix = "VNCD"
+
+// applyEnvOverrides sets the scalar keys of c (strings, numbers and booleans)
+// from environment variables named VNCD_<SECTION>_<KEY> in upper case, e.g.
+// VNCD_FRONTEND_PORT or VNCD_BACKEND_DOCKER_IMAGE. Flags take precedence, as
+// their defaults are taken from c. Keys of backend types are also read from
+// the former names without the block (e.g. VNCD_BACKEND_IMAGE).
+func applyEnvOverrides(c *Config, lookup func(string) (string, bool)) error {
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		prefix := envPrefix + "_" + strings.ToUpper(yamlKey(sections.Type().Field(i)))
+		if err := applyEnvSection(section, prefix, lookup); err != nil {
+			return err
+		}
+	}
+	return c.Backend.applyLegacyEnv(envPrefix+"_BACKEND", lookup)
+}
+
+// applyEnvSection sets the scalar keys of a configuration section from
+// environment variables named <prefix>_<KEY>. Keys of nested blocks are read
+// from <prefix>_<BLOCK>_<KEY>.
+func applyEnvSection(section reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	for j := 0; j < section.NumField(); j++ {
+		field := section.Field(j)
+		if !field.CanSet() {
+			continue
+		}
+		if field.Kind() == reflect.Struct {
+			blockPrefix := prefix + "_" + strings.ToUpper(yamlKey(section.Type().Field(j)))
+			if err := applyEnvSection(field, blockPrefix, lookup); err != nil {
+				return err
 			}
-			return backends.CreateKubernetesBackend(clientset, *(config.Backend.Namespace), *(config.Backend.LabelSelector), *(config.Backend.Port), *(config.Backend.Dispose))
+			continue
+		}
+		if field.Kind() != reflect.Ptr {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(yamlKey(section.Type().Field(j)))
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		v := reflect.New(field.Type().Elem())
+		if err := parseEnvValue(v.Elem(), value); err != nil {
+			return fmt.Errorf("Invalid value of %s [%s]: %v", name, value, err)
+		}
+		field.Set(v)
+	}
+	return nil
+}
+
+// yamlKey returns the configuration key of a struct field
+func yamlKey(f reflect.StructField) string {
+	if key := strings.Split(f.Tag.Get("yaml"), ",")[0]; key != "" {
+		return key
+	}
+	return f.Name
+}
+
+// parseEnvValue sets v from its string representation s. Pointers to structs
+// and other non-scalar keys cannot be set from the environment.
+func parseEnvValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
 		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
 	default:
-		fmt.Println("Unknown backend type: " + *config.Backend.Type)
-		os.Exit(1)
+		return fmt.Errorf("%s keys cannot be set from the environment", v.Kind())
+	}
+	return nil
+}
+
+func processConfig() error {
+
+	// Define the connection rate limits
+	var limit vncd.RateLimit
+	if c := defaultConfig.Frontend.RateLimit; c != nil {
+		limit = vncd.RateLimit{Global: c.Global, PerIP: c.PerIP, Burst: c.Burst}
+	}
+	var err error
+	if limiter, err = vncd.NewConnectionLimiter(limit); err != nil {
+		return err
 	}
 
+	if *config.Frontend.AdmissionWebhook != "" {
+		admitter = vncd.AdmissionWebhook(*config.Frontend.AdmissionWebhook,
+			time.Duration(*config.Frontend.AdmissionTimeout)*time.Second, *config.Frontend.AdmissionFailOpen)
+	}
+
+	if *config.Frontend.StatsD != "" {
+		statsd, err := vncd.NewStatsD(*config.Frontend.StatsD)
+		if err != nil {
+			return err
+		}
+		statsd.Registry = sessions
+		observer = statsd
+	}
+
+	// Define the readiness probe
+	if probe := config.Backend.ReadinessProbe; probe != nil {
+		var err error
+		readinessProbe, err = backends.NewProbe(probe.Type, probe.Path, probe.Port, probe.Command)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Define backend factory method. Resource classes may override the
+	// image or label selector. The factory is replaced when the
+	// configuration is reloaded.
+	setup, err := buildBackends(config.Backend)
+	if err != nil {
+		return err
+	}
+	replaceBackends(setup)
+
+	backendFactory = func() (backends.Backend, error) {
+		return currentBackends.Load().(backendSetup).factory(ResourceClassConfig{})
+	}
+	contextBackendFactory = func(ctx context.Context) (backends.Backend, error) {
+		s := currentBackends.Load().(backendSetup)
+		return s.factory(selectResourceClass(ctx, s.classes))
+	}
+	return nil
+}
+
+// selectResourceClass returns the resource class named by the admission of a
+// connection, or else the largest resource class whose minimum geometry is met
+// by the geometry requested for the connection. An empty class is returned if
+// none applies.
+func selectResourceClass(ctx context.Context, classes []ResourceClassConfig) ResourceClassConfig {
+	var selected ResourceClassConfig
+	if name, ok := vncd.AdmissionClassFromContext(ctx); ok {
+		for _, c := range classes {
+			if c.Name == name {
+				log.Printf("Selected resource class [%s] by admission\n", name)
+				return c
+			}
+		}
+		log.Printf("Unknown resource class [%s] selected by admission\n", name)
+	}
+	width, height, ok := vncd.GeometryFromContext(ctx)
+	if !ok {
+		return selected
+	}
+	for _, c := range classes {
+		if width >= c.MinWidth && height >= c.MinHeight &&
+			c.MinWidth*c.MinHeight >= selected.MinWidth*selected.MinHeight {
+			selected = c
+		}
+	}
+	if selected.Name != "" {
+		log.Printf("Selected resource class [%s] for geometry %dx%d\n", selected.Name, width, height)
+	}
+	return selected
 }
 
+// dockerMounts converts mount configurations to Docker mounts
+func dockerMounts(configs []MountConfig) []mount.Mount {
+	var mounts []mount.Mount
+	for _, m := range configs {
+		t := mount.Type(m.Type)
+		if t == "" {
+			t = mount.TypeBind
+		}
+		mounts = append(mounts, mount.Mount{
+			Type:     t,
+			Source:   m.Source,
+			Target:   m.Target,
+			ReadOnly: m.ReadOnly,
+		})
+	}
+	return mounts
+}
+
+// healthReporter is implemented by all frontends that can report their health
+type healthReporter interface {
+	AcceptingConnections() bool
+	CountOpenConnections() int
+}
+
+// drainer is implemented by frontends that can drain (see
+// vncd.WebsocketServer.SetDraining)
+type drainer interface {
+	Draining() bool
+}
+
+// healthHandler reports the combined health of a set of named listeners
 type healthHandler struct {
-	Server *vncd.Server
+	Listeners map[string]healthReporter
+
+	// ScaleDownBelow reports the listeners as not accepting connections if
+	// fewer connections are open and the scale down hint is set
+	ScaleDownBelow int
+	ScaleDown      *scaleDownHint
+
+	// AvailablePods, if set, counts the unlocked pods of the Kubernetes
+	// backend, so that an autoscaler can grow the pool
+	AvailablePods func() (int, error)
+
+	// Reachable, if set, checks that the backend can serve new connections
+	Reachable func() error
+
+	// BackendType, Started and Version describe the proxy
+	BackendType string
+	Started     time.Time
+	Version     string
+
+	// IdleBackends counts the backends waiting in the pool of the Docker
+	// backend. It returns false if there is no pool.
+	IdleBackends func() (int, bool)
 }
 
-func (h healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// scaleDownHint is set by an orchestrator (PUT true to /config/scaledown) that
+// intends to remove instances. Lightly used instances then report not to
+// accept connections, so that they drain and can be removed.
+type scaleDownHint struct {
+	set int32
+}
 
-	type Status struct {
-		Acceptingconnections bool `json:"accepting"`
-		Numberofconnections  int  `json:"open"`
+// Get returns true if the hint is set
+func (h *scaleDownHint) Get() bool {
+	return atomic.LoadInt32(&h.set) == 1
+}
+
+// drains returns true if the hint is set and fewer than below connections are
+// open. Zero below disables scaling down.
+func (h *scaleDownHint) drains(below, open int) bool {
+	return below > 0 && h.Get() && open < below
+}
+
+// ServeHTTP returns the hint as JSON (GET) or sets it to the boolean in the
+// request body (PUT)
+func (h *scaleDownHint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var set bool
+		if err := json.NewDecoder(r.Body).Decode(&set); err != nil {
+			http.Error(w, "Invalid scale down hint: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var v int32
+		if set {
+			v = 1
+		}
+		atomic.StoreInt32(&h.set, v)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Get())
+}
+
+// adminHandler passes requests carrying Token as bearer token on to Handler.
+// All requests are refused if Token is empty.
+type adminHandler struct {
+	Token   string
+	Handler http.Handler
+}
+
+func (h adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Token == "" {
+		http.Error(w, "Admin endpoints are disabled (no AdminToken)", http.StatusForbidden)
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(h.Token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+// ListenerStatus is the health of a listener
+type ListenerStatus struct {
+	Acceptingconnections bool `json:"accepting"`
+	Numberofconnections  int  `json:"open"`
+	Draining             bool `json:"draining"`
+}
+
+// Status is the combined health of all listeners
+type Status struct {
+	Acceptingconnections bool                      `json:"accepting"`
+	Numberofconnections  int                       `json:"open"`
+	Draining             bool                      `json:"draining"`
+	ScalingDown          bool                      `json:"scalingDown,omitempty"`
+	AvailablePods        *int                      `json:"availablePods,omitempty"`
+	IdleBackends         *int                      `json:"idleBackends,omitempty"`
+	BackendType          string                    `json:"backendType"`
+	Uptime               int64                     `json:"uptime"` // in seconds
+	Version              string                    `json:"version"`
+	Listeners            map[string]ListenerStatus `json:"listeners"`
+}
+
+// status collects the health of the listeners
+func (h healthHandler) status() Status {
+
+	// The aggregate is only accepting if all listeners are
 	s := Status{
-		Acceptingconnections: h.Server.AcceptingConnections(),
-		Numberofconnections:  h.Server.CountOpenConnections(),
+		Acceptingconnections: true,
+		BackendType:          h.BackendType,
+		Uptime:               int64(time.Since(h.Started) / time.Second),
+		Version:              h.Version,
+		Listeners:            make(map[string]ListenerStatus),
+	}
+	for name, l := range h.Listeners {
+		ls := ListenerStatus{
+			Acceptingconnections: l.AcceptingConnections(),
+			Numberofconnections:  l.CountOpenConnections(),
+		}
+		if d, ok := l.(drainer); ok {
+			ls.Draining = d.Draining()
+		}
+		s.Acceptingconnections = s.Acceptingconnections && ls.Acceptingconnections
+		s.Numberofconnections += ls.Numberofconnections
+		s.Draining = s.Draining || ls.Draining
+		s.Listeners[name] = ls
+	}
+
+	// Drain lightly used instances if the orchestrator wants to scale down
+	if h.ScaleDown != nil && h.ScaleDown.drains(h.ScaleDownBelow, s.Numberofconnections) {
+		s.Acceptingconnections = false
+		s.ScalingDown = true
+		s.Draining = true
 	}
 
+	if h.AvailablePods != nil {
+		if n, err := h.AvailablePods(); err != nil {
+			log.Println("Cannot count available pods: " + err.Error())
+		} else {
+			s.AvailablePods = &n
+		}
+	}
+
+	if h.IdleBackends != nil {
+		if n, ok := h.IdleBackends(); ok {
+			s.IdleBackends = &n
+		}
+	}
+	return s
+}
+
+// ServeHTTP reports the health of the listeners as JSON
+func (h healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := h.status()
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(s)
 	if !s.Acceptingconnections {
 		w.WriteHeader(http.StatusServiceUnavailable)
 	}
+	json.NewEncoder(w).Encode(s)
 	fmt.Println("Handled health check")
 }
 
-func reportHealth(srv *vncd.Server) {
+// ServeLive reports that the process is alive. Unlike ServeHTTP and
+// ServeReady, it succeeds while the listeners do not accept connections, so
+// that a liveness probe does not restart a proxy that is merely full.
+func (h healthHandler) ServeLive(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
 
-	haddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", *config.Frontend.HealthPort))
+// ServeReady succeeds only if all listeners accept connections and the backend
+// is reachable
+func (h healthHandler) ServeReady(w http.ResponseWriter, r *http.Request) {
+	if !h.status().Acceptingconnections {
+		http.Error(w, "Not accepting connections", http.StatusServiceUnavailable)
+		return
+	}
+	if h.Reachable != nil {
+		if err := h.Reachable(); err != nil {
+			http.Error(w, "Backend not reachable: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func reportHealth(port int, listeners map[string]healthReporter, client http.Handler) error {
+
+	haddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
-		log.Println(err.Error())
-		os.Exit(1)
+		return err
 	}
 
-	log.Println("Listening for health check requests on " + haddr.String())
-	err = http.ListenAndServe(haddr.String(), healthHandler{
-		Server: srv,
+	var pods func() (int, error)
+	if currentBackends.Load().(backendSetup).availablePods != nil {
+		pods = countAvailablePods
+	}
+
+	health := healthHandler{
+		Listeners:      listeners,
+		ScaleDownBelow: *config.Frontend.ScaleDownBelow,
+		ScaleDown:      &scaleDown,
+		AvailablePods:  pods,
+		Reachable:      checkBackendReachable,
+		BackendType:    *config.Backend.Type,
+		Started:        started,
+		Version:        version,
+		IdleBackends:   idleBackends,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", health)
+	mux.HandleFunc("/livez", health.ServeLive)
+	mux.HandleFunc("/readyz", health.ServeReady)
+	mux.Handle("/sessions", sessions)
+	mux.Handle("/config/ratelimit", adminHandler{Token: *config.Frontend.AdminToken, Handler: limiter})
+	mux.Handle("/config/scaledown", adminHandler{Token: *config.Frontend.AdminToken, Handler: &scaleDown})
+	mux.Handle("/metrics", vncd.SessionMetrics{
+		Registry:      sessions,
+		AllowedLabels: defaultConfig.Frontend.MetricLabels,
 	})
+	if client != nil {
+		path := "/" + strings.Trim(*config.Frontend.WebClientPath, "/") + "/"
+		mux.Handle(path, http.StripPrefix(strings.TrimSuffix(path, "/"), client))
+		log.Println("Serving web client on " + path)
+	}
+
+	log.Println("Listening for health check requests on " + haddr.String())
+	return http.ListenAndServe(haddr.String(), mux)
+}
+
+// instanceID identifies this proxy in pod locks: the pod name (POD_NAME,
+// downward API) if set, the hostname otherwise
+func instanceID() string {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+	name, _ := os.Hostname()
+	return name
 }
 
-// exists is a small helper rerturning true if a file exists
+// exists is a small helper returning true if a file exists
 func exists(filename string) bool {
 	_, err := os.Stat(filename)
 	return !os.IsNotExist(err)
 }
+
+// encodeRegistryAuth returns the encoded registry credentials of the
+// configuration, or an empty string if none are configured
+func encodeRegistryAuth(c *RegistryAuthConfig) (string, error) {
+	if c == nil {
+		return "", nil
+	}
+
+	var auth types.AuthConfig
+	if c.ConfigFile != "" {
+		var err error
+		auth, err = backends.RegistryAuthFromConfigFile(os.ExpandEnv(c.ConfigFile), c.Server)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		auth = types.AuthConfig{
+			Username:      os.ExpandEnv(c.Username),
+			Password:      os.ExpandEnv(c.Password),
+			ServerAddress: c.Server,
+		}
+	}
+	return backends.EncodeRegistryAuth(auth)
+}
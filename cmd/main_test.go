@@ -0,0 +1,576 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kramergroup/vncd"
+	"github.com/kramergroup/vncd/backends"
+	"golang.org/x/net/websocket"
+)
+
+// fakeListener reports a fixed health
+type fakeListener struct {
+	accepting bool
+	open      int
+}
+
+func (l fakeListener) AcceptingConnections() bool { return l.accepting }
+func (l fakeListener) CountOpenConnections() int  { return l.open }
+
+// serve returns the response of h to a GET request for path
+func serve(h http.HandlerFunc, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+func TestHealthProbes(t *testing.T) {
+	unreachable := func() error { return errors.New("No backend") }
+	tests := []struct {
+		name      string
+		listeners map[string]healthReporter
+		reachable func() error
+		wantReady int
+	}{
+		{
+			name:      "healthy",
+			listeners: map[string]healthReporter{"vnc": fakeListener{accepting: true}},
+			wantReady: http.StatusOK,
+		},
+		{
+			name:      "healthy with reachable backend",
+			listeners: map[string]healthReporter{"vnc": fakeListener{accepting: true}},
+			reachable: func() error { return nil },
+			wantReady: http.StatusOK,
+		},
+		{
+			name: "saturated listener",
+			listeners: map[string]healthReporter{
+				"vnc":       fakeListener{accepting: true},
+				"websocket": fakeListener{accepting: false, open: 10},
+			},
+			wantReady: http.StatusServiceUnavailable,
+		},
+		{
+			name:      "backend unreachable",
+			listeners: map[string]healthReporter{"vnc": fakeListener{accepting: true}},
+			reachable: unreachable,
+			wantReady: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := healthHandler{Listeners: tt.listeners, Reachable: tt.reachable}
+
+			// A proxy is alive even if it cannot take connections
+			if rec := serve(h.ServeLive, "/livez"); rec.Code != http.StatusOK {
+				t.Errorf("/livez = %d, want %d", rec.Code, http.StatusOK)
+			}
+			if rec := serve(h.ServeReady, "/readyz"); rec.Code != tt.wantReady {
+				t.Errorf("/readyz = %d, want %d", rec.Code, tt.wantReady)
+			}
+		})
+	}
+}
+
+func TestHealthStatusCode(t *testing.T) {
+	tests := []struct {
+		name      string
+		listeners map[string]healthReporter
+		want      int
+	}{
+		{"no listeners", nil, http.StatusOK},
+		{"accepting", map[string]healthReporter{"vnc": fakeListener{accepting: true, open: 1}}, http.StatusOK},
+		{"not accepting", map[string]healthReporter{"vnc": fakeListener{open: 10}}, http.StatusServiceUnavailable},
+		{
+			name: "one of several not accepting",
+			listeners: map[string]healthReporter{
+				"vnc":       fakeListener{accepting: true},
+				"websocket": fakeListener{},
+			},
+			want: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(healthHandler{Listeners: tt.listeners}.ServeHTTP, "/")
+			if rec.Code != tt.want {
+				t.Errorf("Status code = %d, want %d", rec.Code, tt.want)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+
+			// The body is sent with either status code
+			var s Status
+			if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+				t.Fatalf("Invalid status %q: %v", rec.Body.String(), err)
+			}
+			if s.Acceptingconnections != (tt.want == http.StatusOK) {
+				t.Errorf("Status reports accepting %t with status code %d", s.Acceptingconnections, rec.Code)
+			}
+		})
+	}
+}
+
+func TestHealthStatusFields(t *testing.T) {
+	idle := func() (int, bool) { return 2, true }
+	noPool := func() (int, bool) { return 0, false }
+	tests := []struct {
+		name         string
+		idleBackends func() (int, bool)
+		want         map[string]interface{} // decoded JSON fields
+		wantAbsent   []string
+	}{
+		{
+			name:         "with pool",
+			idleBackends: idle,
+			want: map[string]interface{}{
+				"backendType":  "docker",
+				"uptime":       float64(90),
+				"version":      "1.2.3",
+				"idleBackends": float64(2),
+				"accepting":    true,
+				"open":         float64(3),
+			},
+		},
+		{
+			name:         "without pool",
+			idleBackends: noPool,
+			want: map[string]interface{}{
+				"backendType": "docker",
+				"version":     "1.2.3",
+				"accepting":   true,
+			},
+			wantAbsent: []string{"idleBackends", "availablePods", "scalingDown"},
+		},
+		{
+			name: "no pool reporter",
+			want: map[string]interface{}{
+				"uptime": float64(90),
+			},
+			wantAbsent: []string{"idleBackends"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := healthHandler{
+				Listeners:    map[string]healthReporter{"vnc": fakeListener{accepting: true, open: 3}},
+				BackendType:  "docker",
+				Started:      time.Now().Add(-90*time.Second - 100*time.Millisecond),
+				Version:      "1.2.3",
+				IdleBackends: tt.idleBackends,
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(serve(h.ServeHTTP, "/").Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			for key, want := range tt.want {
+				if v, ok := got[key]; !ok {
+					t.Errorf("%s missing from status", key)
+				} else if v != want {
+					t.Errorf("%s = %v (%T), want %v (%T)", key, v, v, want, want)
+				}
+			}
+			for _, key := range tt.wantAbsent {
+				if v, ok := got[key]; ok {
+					t.Errorf("%s = %v, want it omitted", key, v)
+				}
+			}
+		})
+	}
+}
+
+// writeFile writes content to a file name in a temporary directory and returns
+// its path
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string // not created if empty
+		content  string
+		wantErr  bool
+		wantPort int // 0 = unset
+	}{
+		{name: "missing file"},
+		{name: "empty file", file: "vncd.conf.yaml"},
+		{name: "valid file", file: "vncd.conf.yaml", content: "Frontend:\n  Port: 5901\n", wantPort: 5901},
+		{name: "malformed YAML", file: "vncd.conf.yaml", content: "Frontend: [\n", wantErr: true},
+		{name: "wrong type", file: "vncd.conf.yaml", content: "Frontend:\n  Port: many\n", wantErr: true},
+		{name: "malformed JSON", file: "vncd.conf.json", content: `{"Frontend": `, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "vncd.conf.yaml")
+			if tt.file != "" {
+				path = writeFile(t, tt.file, tt.content)
+			}
+
+			c, err := readConfigFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readConfigFile() error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			// Missing keys are left unset, so that the defaults apply
+			port := 0
+			if c.Frontend.Port != nil {
+				port = *c.Frontend.Port
+			}
+			if port != tt.wantPort {
+				t.Errorf("Frontend.Port = %d, want %d", port, tt.wantPort)
+			}
+			if tt.wantPort == 0 && !reflect.DeepEqual(c, Config{}) {
+				t.Errorf("readConfigFile() = %+v, want an empty configuration", c)
+			}
+		})
+	}
+}
+
+func TestReadConfigFileFormats(t *testing.T) {
+	tests := []struct {
+		name       string
+		yaml, json string
+	}{
+		{
+			name: "frontend",
+			yaml: "Frontend:\n  Port: 5901\n  TLS: true\n  Cert: /etc/vncd/cert.pem\n",
+			json: `{"Frontend": {"Port": 5901, "TLS": true, "Cert": "/etc/vncd/cert.pem"}}`,
+		},
+		{
+			name: "backend blocks",
+			yaml: `
+Backend:
+  Type: docker
+  Classes:
+    - Name: large
+      MinWidth: 1920
+      Image: vnc:large
+  Docker:
+    Image: vnc
+    Env: [DISPLAY=:1]
+    Mounts:
+      - Source: /data
+        Target: /home
+        ReadOnly: true
+`,
+			json: `{"Backend": {
+				"Type": "docker",
+				"Classes": [{"Name": "large", "MinWidth": 1920, "Image": "vnc:large"}],
+				"Docker": {
+					"Image": "vnc",
+					"Env": ["DISPLAY=:1"],
+					"Mounts": [{"Source": "/data", "Target": "/home", "ReadOnly": true}]
+				}
+			}}`,
+		},
+		{
+			name: "legacy backend keys",
+			yaml: "Backend:\n  Type: command\n  Command: Xvnc :1\n  Port: 5901\n",
+			json: `{"Backend": {"Type": "command", "Command": "Xvnc :1", "Port": 5901}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fromYAML, err := readConfigFile(writeFile(t, "vncd.conf.yaml", tt.yaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			fromJSON, err := readConfigFile(writeFile(t, "vncd.conf.json", tt.json))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reflect.DeepEqual(fromYAML, Config{}) {
+				t.Fatal("Nothing read from the YAML file")
+			}
+			if !reflect.DeepEqual(fromYAML, fromJSON) {
+				t.Errorf("YAML and JSON differ:\n%+v\n%+v", fromYAML, fromJSON)
+			}
+		})
+	}
+}
+
+func TestScaleDownDrains(t *testing.T) {
+	tests := []struct {
+		name        string
+		set         bool
+		below, open int
+		want        bool
+	}{
+		{"hint not set", false, 5, 1, false},
+		{"lightly used", true, 5, 4, true},
+		{"at threshold", true, 5, 5, false},
+		{"disabled", true, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h scaleDownHint
+			if tt.set {
+				h.set = 1
+			}
+			if got := h.drains(tt.below, tt.open); got != tt.want {
+				t.Errorf("drains(%d, %d) = %t, want %t", tt.below, tt.open, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminRateLimit(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string // configured
+		authorization string // sent
+		wantCode      int
+	}{
+		{"valid token", "secret", "Bearer secret", http.StatusOK},
+		{"wrong token", "secret", "Bearer guess", http.StatusUnauthorized},
+		{"missing token", "secret", "", http.StatusUnauthorized},
+		{"token without scheme", "secret", "secret", http.StatusUnauthorized},
+		{"disabled", "", "Bearer ", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := vncd.NewConnectionLimiter(vncd.RateLimit{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ws, err := vncd.NewWebsocketServer(func() (backends.Backend, error) { return nil, nil })
+			if err != nil {
+				t.Fatal(err)
+			}
+			ws.Limiter = l
+			h := adminHandler{Token: tt.token, Handler: l}
+
+			req := httptest.NewRequest("PUT", "/config/ratelimit", strings.NewReader(`{"global": 0.001, "burst": 2}`))
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("PUT /config/ratelimit = %d, want %d", rec.Code, tt.wantCode)
+			}
+
+			// New connections follow the limit only if it has been changed
+			srv := httptest.NewServer(ws.Handler())
+			defer srv.Close()
+			limited := 0
+			for i := 0; i < 3; i++ {
+				resp, err := http.Get(srv.URL + "/websockify")
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusTooManyRequests {
+					limited++
+				}
+			}
+			wantLimited := 0
+			if tt.wantCode == http.StatusOK {
+				wantLimited = 1
+			}
+			if limited != wantLimited {
+				t.Errorf("%d of 3 connections limited, want %d", limited, wantLimited)
+			}
+		})
+	}
+}
+
+func TestScaleDownReadiness(t *testing.T) {
+	var hint scaleDownHint
+	admin := adminHandler{Token: "secret", Handler: &hint}
+	put := func(body, authorization string) int {
+		req := httptest.NewRequest("PUT", "/config/scaledown", strings.NewReader(body))
+		req.Header.Set("Authorization", authorization)
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	h := healthHandler{ScaleDownBelow: 2, ScaleDown: &hint}
+	ready := func(open int) int {
+		h.Listeners = map[string]healthReporter{"vnc": fakeListener{accepting: true, open: open}}
+		return serve(h.ServeReady, "/readyz").Code
+	}
+
+	if code := put("true", "Bearer guess"); code != http.StatusUnauthorized {
+		t.Fatalf("PUT with wrong token = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := ready(0); code != http.StatusOK {
+		t.Errorf("/readyz = %d without hint, want %d", code, http.StatusOK)
+	}
+
+	if code := put("true", "Bearer secret"); code != http.StatusOK {
+		t.Fatalf("PUT = %d, want %d", code, http.StatusOK)
+	}
+	tests := []struct {
+		open int
+		want int
+	}{
+		{3, http.StatusOK},
+		{2, http.StatusOK},
+		{1, http.StatusServiceUnavailable},
+		{0, http.StatusServiceUnavailable},
+		{2, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := ready(tt.open); code != tt.want {
+			t.Errorf("/readyz = %d with %d open connections, want %d", code, tt.open, tt.want)
+		}
+	}
+
+	if code := put("false", "Bearer secret"); code != http.StatusOK {
+		t.Fatalf("PUT = %d, want %d", code, http.StatusOK)
+	}
+	if code := ready(0); code != http.StatusOK {
+		t.Errorf("/readyz = %d after clearing the hint, want %d", code, http.StatusOK)
+	}
+}
+
+func TestHealthStatusDraining(t *testing.T) {
+	tests := []struct {
+		name           string
+		draining       bool // websocket listener
+		scaleDown      bool
+		wantDraining   bool
+		wantListeners  map[string]ListenerStatus
+		wantScaledDown bool
+	}{
+		{
+			name: "not draining",
+			wantListeners: map[string]ListenerStatus{
+				"tcp":       {Acceptingconnections: true, Numberofconnections: 1},
+				"websocket": {},
+			},
+		},
+		{
+			name:         "websocket draining",
+			draining:     true,
+			wantDraining: true,
+			wantListeners: map[string]ListenerStatus{
+				"tcp":       {Acceptingconnections: true, Numberofconnections: 1},
+				"websocket": {Draining: true},
+			},
+		},
+		{
+			name:           "scaling down",
+			scaleDown:      true,
+			wantDraining:   true,
+			wantScaledDown: true,
+			wantListeners: map[string]ListenerStatus{
+				"tcp":       {Acceptingconnections: true, Numberofconnections: 1},
+				"websocket": {},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, err := vncd.NewWebsocketServer(func() (backends.Backend, error) { return nil, nil })
+			if err != nil {
+				t.Fatal(err)
+			}
+			ws.SetDraining(tt.draining)
+			var hint scaleDownHint
+			if tt.scaleDown {
+				hint.set = 1
+			}
+			h := healthHandler{
+				Listeners: map[string]healthReporter{
+					"tcp":       fakeListener{accepting: true, open: 1},
+					"websocket": ws,
+				},
+				ScaleDownBelow: 5,
+				ScaleDown:      &hint,
+			}
+
+			var s Status
+			if err := json.Unmarshal(serve(h.ServeHTTP, "/").Body.Bytes(), &s); err != nil {
+				t.Fatal(err)
+			}
+			if s.Draining != tt.wantDraining {
+				t.Errorf("draining = %t, want %t", s.Draining, tt.wantDraining)
+			}
+			if s.ScalingDown != tt.wantScaledDown {
+				t.Errorf("scalingDown = %t, want %t", s.ScalingDown, tt.wantScaledDown)
+			}
+			if s.Acceptingconnections {
+				t.Error("accepting = true with a websocket listener that is not listening")
+			}
+			if s.Numberofconnections != 1 {
+				t.Errorf("open = %d, want 1", s.Numberofconnections)
+			}
+			if !reflect.DeepEqual(s.Listeners, tt.wantListeners) {
+				t.Errorf("listeners = %+v, want %+v", s.Listeners, tt.wantListeners)
+			}
+		})
+	}
+}
+
+func TestExitAfterIdle(t *testing.T) {
+	const idle = 200 * time.Millisecond
+
+	// The backend of the connection is pending until released
+	called := make(chan struct{})
+	release := make(chan struct{})
+	ws, err := vncd.NewWebsocketServer(func() (backends.Backend, error) {
+		close(called)
+		<-release
+		return nil, errors.New("No backend")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := vncd.NewSessionRegistry()
+	ws.Sessions = registry
+	srv := httptest.NewServer(ws.Handler())
+	defer srv.Close()
+
+	go func() {
+		url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/websockify"
+		if conn, err := websocket.Dial(url, "", srv.URL); err == nil {
+			defer conn.Close()
+			ioutil.ReadAll(conn)
+		}
+	}()
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Backend not requested")
+	}
+
+	shutdown := make(chan struct{})
+	go exitAfterIdle(registry, idle, func() { close(shutdown) })
+	select {
+	case <-shutdown:
+		t.Fatal("Shut down while a connection waits for its backend")
+	case <-time.After(3 * idle):
+	}
+
+	closed := time.Now()
+	close(release)
+	select {
+	case <-shutdown:
+		if d := time.Since(closed); d < idle {
+			t.Errorf("Shut down %v after the connection closed, want at least %v", d, idle)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No shutdown after the connection closed")
+	}
+}
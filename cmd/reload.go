@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/kramergroup/vncd"
+	"github.com/kramergroup/vncd/backends"
+)
+
+// backendSetup is the part of the configuration that is swapped when the
+// configuration is reloaded
+type backendSetup struct {
+	factory       classFactory
+	classes       []ResourceClassConfig
+	pool          *backends.DockerBackendPool // nil unless the backend pools containers
+	availablePods func() (int, error)         // nil unless the backend counts pods
+	reachable     func() error                // nil unless the backend can be checked
+}
+
+// currentBackends holds the current backendSetup
+var currentBackends atomic.Value
+
+// buildBackends builds the backend setup of c. A pool of the current setup is
+// reused if it creates the same backends.
+func buildBackends(c BackendConfig) (backendSetup, error) {
+	t, ok := backendTypes[*c.Type]
+	if !ok {
+		return backendSetup{}, fmt.Errorf("Unknown backend type: %s (available: %s)", *c.Type, strings.Join(backendTypeNames(), ", "))
+	}
+	setup, err := t.build(c)
+	if err != nil {
+		return backendSetup{}, err
+	}
+	setup.classes = c.Classes
+	return setup, nil
+}
+
+// replaceBackends makes setup the current backend setup and closes the pool of
+// the previous setup unless setup reuses it
+func replaceBackends(setup backendSetup) {
+	previous, _ := currentBackends.Swap(setup).(backendSetup)
+	if previous.pool != nil && previous.pool != setup.pool {
+		previous.pool.Close()
+	}
+}
+
+// closeBackends closes the pool of the current backend setup
+func closeBackends() {
+	if s, _ := currentBackends.Load().(backendSetup); s.pool != nil {
+		s.pool.Close()
+	}
+}
+
+// idleBackends counts the backends waiting in the pool of the current setup.
+// It returns false if there is no pool.
+func idleBackends() (int, bool) {
+	if s := currentBackends.Load().(backendSetup); s.pool != nil {
+		return s.pool.Idle(), true
+	}
+	return 0, false
+}
+
+// countAvailablePods counts the available pods of the current backend
+func countAvailablePods() (int, error) {
+	s := currentBackends.Load().(backendSetup)
+	if s.availablePods == nil {
+		return 0, errors.New("Backend does not count available pods")
+	}
+	return s.availablePods()
+}
+
+// checkBackendReachable returns an error if the current backend cannot serve
+// new connections. Backends that cannot be checked are assumed reachable.
+func checkBackendReachable() error {
+	s := currentBackends.Load().(backendSetup)
+	if s.reachable == nil {
+		return nil
+	}
+	return s.reachable()
+}
+
+// handleSIGHUP reloads the configuration and, if store is set, the frontend
+// certificate on SIGHUP
+func handleSIGHUP(store *vncd.CertificateStore) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		if err := reloadConfig(); err != nil {
+			log.Printf("Could not reload configuration, keeping the current one: %v", err)
+		} else {
+			log.Println("Reloaded configuration")
+		}
+		if store != nil {
+			reloadCertificate(store)
+		}
+	}
+}
+
+// reloadConfig reads the configuration file and the environment again and
+// applies the Backend section to new connections. Keys set on the command line
+// keep their values. The backend type and all other settings require a
+// restart.
+func reloadConfig() error {
+	fileConfig, err := loadConfigFile(*configFile)
+	if err != nil {
+		return err
+	}
+
+	next := mergeReloaded(config.Backend, fileConfig.Backend)
+	if *next.Type != *config.Backend.Type {
+		log.Printf("Backend type change to %s requires a restart", *next.Type)
+		next.Type = config.Backend.Type
+	}
+	reloaded := config
+	reloaded.Backend = next
+	if err = reloaded.Validate(); err != nil {
+		return err
+	}
+
+	setup, err := buildBackends(next)
+	if err != nil {
+		return err
+	}
+	replaceBackends(setup)
+	return nil
+}
+
+// mergeReloaded returns current with all keys replaced by their values in
+// reloaded, except keys set on the command line and keys missing from
+// reloaded. Keys directly under Backend are read for the current type.
+func mergeReloaded(current, reloaded BackendConfig) BackendConfig {
+	reloaded.resolveLegacy(*current.Type)
+	merged := current
+	mergeSection(reflect.ValueOf(&merged).Elem(), reflect.ValueOf(reloaded))
+	return merged
+}
+
+// mergeSection sets the fields of the configuration section dst to the values
+// in src, except fields set on the command line and fields missing from src.
+// Nested blocks are merged field by field.
+func mergeSection(dst, src reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		field, value := dst.Field(i), src.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.Struct:
+			mergeSection(field, value)
+			continue
+		case reflect.Ptr, reflect.Slice, reflect.Map:
+			if value.IsNil() || setOnCommandLine(field) {
+				continue
+			}
+		}
+		field.Set(value)
+	}
+}
+
+// setOnCommandLine returns true if v points to the value of a flag given on the
+// command line
+func setOnCommandLine(v reflect.Value) bool {
+	if v.Kind() != reflect.Ptr {
+		return false
+	}
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if reflect.ValueOf(f.Value).Pointer() == v.Pointer() {
+			set = true
+		}
+	})
+	return set
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        string
+		wantErr     bool
+		wantAddress string // target of the backends after the reload
+		wantClasses int
+	}{
+		{
+			name:        "backend changed",
+			file:        "Backend:\n  Static:\n    Address: 127.0.0.1:5901\n  Classes:\n    - Name: large\n",
+			wantAddress: "127.0.0.1:5901",
+			wantClasses: 1,
+		},
+		{
+			name:        "missing keys keep their values",
+			file:        "Backend:\n  Classes:\n    - Name: large\n",
+			wantAddress: "127.0.0.1:5900",
+			wantClasses: 1,
+		},
+		{
+			name:        "type change ignored",
+			file:        "Backend:\n  Type: roundrobin\n  Static:\n    Address: 127.0.0.1:5901\n",
+			wantAddress: "127.0.0.1:5901",
+		},
+		{
+			name:        "malformed file",
+			file:        "Backend: [\n",
+			wantErr:     true,
+			wantAddress: "127.0.0.1:5900",
+		},
+		{
+			name:        "invalid configuration",
+			file:        "Backend:\n  Docker:\n    Image: vnc\n",
+			wantErr:     true,
+			wantAddress: "127.0.0.1:5900",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current, file := config, *configFile
+			t.Cleanup(func() { config, *configFile = current, file })
+
+			typ, address := "static", "127.0.0.1:5900"
+			config = Config{Backend: BackendConfig{Type: &typ, Static: StaticConfig{Address: &address}}}
+			setup, err := buildBackends(config.Backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			replaceBackends(setup)
+
+			*configFile = writeFile(t, "vncd.conf.yaml", tt.file)
+			if err = reloadConfig(); (err != nil) != tt.wantErr {
+				t.Fatalf("reloadConfig() error = %v, want error %t", err, tt.wantErr)
+			}
+
+			s := currentBackends.Load().(backendSetup)
+			b, err := s.factory(ResourceClassConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if target, _ := b.GetTarget(); target.String() != tt.wantAddress {
+				t.Errorf("Backend target = %s, want %s", target, tt.wantAddress)
+			}
+			if len(s.classes) != tt.wantClasses {
+				t.Errorf("%d resource classes, want %d", len(s.classes), tt.wantClasses)
+			}
+		})
+	}
+}
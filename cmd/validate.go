@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/kramergroup/vncd/webclient"
+)
+
+// Validate checks the configuration and returns an error listing all
+// problems found, or nil if there are none
+func (c *Config) Validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// Frontend
+	f := c.Frontend
+	for _, p := range []struct {
+		key  string
+		port *int
+	}{
+		{"Frontend.Port", f.Port},
+		{"Frontend.HealthPort", f.HealthPort},
+		{"Frontend.Websocket", f.WebSocket},
+		{"Frontend.WebsocketHealthPort", f.WebSocketHealthPort},
+	} {
+		if p.port != nil && !validPort(*p.port) {
+			problem("%s %d is not a valid port (1-65535)", p.key, *p.port)
+		}
+	}
+	if isSet(f.TLS) || isSet(f.WebSocketTLS) {
+		if value(f.Cert) == "" || !exists(value(f.Cert)) {
+			problem("Frontend.Cert: certificate file [%s] required for TLS not found", value(f.Cert))
+		}
+		if value(f.Key) == "" || !exists(value(f.Key)) {
+			problem("Frontend.Key: key file [%s] required for TLS not found", value(f.Key))
+		}
+	}
+	if ca := value(f.ClientCA); ca != "" && !exists(ca) {
+		problem("Frontend.ClientCA: file [%s] not found", ca)
+	}
+	if isSet(f.WebClient) {
+		if err := webclient.Available(); err != nil {
+			problem("Frontend.WebClient: %v", err)
+		}
+	}
+
+	// Backend
+	b := c.Backend
+	backendType := value(b.Type)
+	if _, ok := backendTypes[backendType]; !ok {
+		problem("Backend.Type [%s] is unknown (available: %s)", backendType, strings.Join(backendTypeNames(), ", "))
+	}
+	checkPort := func(block string, port *int) {
+		if port != nil && *port != 0 && !validPort(*port) {
+			problem("Backend.%s.Port %d is not a valid port (1-65535, or 0 for the default)", block, *port)
+		}
+	}
+	require := func(key string, v *string) {
+		if value(v) == "" {
+			problem("Backend.%s is required by the %s backend", key, backendType)
+		}
+	}
+	switch backendType {
+	case "docker":
+		require("Docker.Image", b.Docker.Image)
+		checkPort("Docker", b.Docker.Port)
+	case "kubernetes":
+		k := b.Kubernetes
+		require("Kubernetes.Namespace", k.Namespace)
+		checkPort("Kubernetes", k.Port)
+		if value(k.PodTemplate) == "" {
+			require("Kubernetes.LabelSelector", k.LabelSelector)
+		} else if !exists(value(k.PodTemplate)) {
+			problem("Backend.Kubernetes.PodTemplate: file [%s] not found", value(k.PodTemplate))
+		}
+	case "static":
+		require("Static.Address", b.Static.Address)
+	case "roundrobin":
+		require("RoundRobin.Targets", b.RoundRobin.Targets)
+	case "command":
+		require("Command.Command", b.Command.Command)
+		checkPort("Command", b.Command.Port)
+	case "ssh":
+		if b.SSH == nil || b.SSH.Host == "" {
+			problem("Backend.SSH.Host is required by the ssh backend")
+		} else {
+			if b.SSH.KeyFile == "" && b.SSH.Password == "" {
+				problem("Backend.SSH requires a KeyFile or Password")
+			}
+			if b.SSH.KnownHostsFile == "" && !b.SSH.InsecureIgnoreHostKey {
+				problem("Backend.SSH requires a KnownHostsFile (or InsecureIgnoreHostKey to skip host key verification)")
+			}
+		}
+	}
+	if t, ok := backendTypes[backendType]; ok {
+		blocks := reflect.ValueOf(b)
+		for _, name := range backendTypeNames() {
+			if block := backendTypes[name].block; block != t.block && blockSet(blocks.FieldByName(block)) {
+				problem("Backend.%s is set but Backend.Type is %s", block, backendType)
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+}
+
+func validPort(port int) bool {
+	return port > 0 && port < 65536
+}
+
+// blockSet returns true if a key of the backend block v is set in the
+// configuration file or environment. Flag defaults do not count.
+func blockSet(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if blockSet(v.Field(i)) {
+				return true
+			}
+		}
+		return false
+	case reflect.Ptr:
+		return !v.IsNil() && !isFlagValue(v)
+	case reflect.Slice, reflect.Map:
+		return v.Len() > 0
+	}
+	return !v.IsZero()
+}
+
+// isFlagValue returns true if v points to the value of a flag
+func isFlagValue(v reflect.Value) bool {
+	found := false
+	flag.VisitAll(func(f *flag.Flag) {
+		if reflect.ValueOf(f.Value).Pointer() == v.Pointer() {
+			found = true
+		}
+	})
+	return found
+}
+
+// isSet returns true if the optional flag b is set and true
+func isSet(b *bool) bool {
+	return b != nil && *b
+}
+
+// value returns the optional string s or "" if it is not set
+func value(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateBackend(t *testing.T) {
+	port := 5901
+	tests := []struct {
+		name    string
+		backend BackendConfig
+		wantErr string // "" = valid
+	}{
+		{
+			name:    "docker",
+			backend: BackendConfig{Type: strPtr("docker"), Docker: DockerConfig{Image: strPtr("vnc"), Port: &port}},
+		},
+		{
+			name:    "docker without port",
+			backend: BackendConfig{Type: strPtr("docker"), Docker: DockerConfig{Image: strPtr("vnc")}},
+		},
+		{
+			name:    "docker with default port",
+			backend: BackendConfig{Type: strPtr("docker"), Docker: DockerConfig{Image: strPtr("vnc"), Port: backendPort}},
+		},
+		{
+			name:    "docker with invalid port",
+			backend: BackendConfig{Type: strPtr("docker"), Docker: DockerConfig{Image: strPtr("vnc"), Port: intPtr(70000)}},
+			wantErr: "Backend.Docker.Port 70000 is not a valid port",
+		},
+		{
+			name:    "docker without image",
+			backend: BackendConfig{Type: strPtr("docker"), Docker: DockerConfig{Port: &port}},
+			wantErr: "Backend.Docker.Image is required",
+		},
+		{
+			name: "block of another type",
+			backend: BackendConfig{
+				Type:   strPtr("docker"),
+				Docker: DockerConfig{Image: strPtr("vnc"), Port: &port},
+				Static: StaticConfig{Address: strPtr("vnc:5900")},
+			},
+			wantErr: "Backend.Static is set but Backend.Type is docker",
+		},
+		{
+			name: "flag defaults of another type",
+			backend: BackendConfig{
+				Type:    strPtr("docker"),
+				Docker:  DockerConfig{Image: strPtr("vnc"), Port: &port},
+				Command: CommandConfig{Port: backendPort, StartupTimeout: startupTimeout},
+			},
+		},
+		{
+			name:    "static",
+			backend: BackendConfig{Type: strPtr("static"), Static: StaticConfig{Address: strPtr("vnc:5900")}},
+		},
+		{
+			name:    "static without address",
+			backend: BackendConfig{Type: strPtr("static")},
+			wantErr: "Backend.Static.Address is required",
+		},
+		{
+			name:    "unknown type",
+			backend: BackendConfig{Type: strPtr("vm")},
+			wantErr: "Backend.Type [vm] is unknown",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkValidate(t, Config{Backend: tt.backend}, tt.wantErr)
+		})
+	}
+}
+
+// checkValidate checks that c is valid, or else that its validation fails with
+// wantErr among the problems
+func checkValidate(t *testing.T, c Config, wantErr string) {
+	t.Helper()
+	err := c.Validate()
+	switch {
+	case wantErr == "" && err != nil:
+		t.Errorf("Validate() = %v, want no error", err)
+	case wantErr != "" && (err == nil || !strings.Contains(err.Error(), wantErr)):
+		t.Errorf("Validate() = %v, want %q", err, wantErr)
+	}
+}
+
+func TestValidateFrontend(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeFile(t, "cert.pem", "cert"), writeFile(t, "key.pem", "key")
+	missing := filepath.Join(dir, "missing.pem")
+	tests := []struct {
+		name     string
+		frontend FrontendConfig
+		wantErr  string // "" = valid
+	}{
+		{
+			name:     "ports",
+			frontend: FrontendConfig{Port: intPtr(5900), HealthPort: intPtr(9999), WebSocket: intPtr(80)},
+		},
+		{
+			name:     "port out of range",
+			frontend: FrontendConfig{Port: intPtr(65536)},
+			wantErr:  "Frontend.Port 65536 is not a valid port",
+		},
+		{
+			name:     "port zero",
+			frontend: FrontendConfig{Port: intPtr(0)},
+			wantErr:  "Frontend.Port 0 is not a valid port",
+		},
+		{
+			name:     "negative health port",
+			frontend: FrontendConfig{HealthPort: intPtr(-1)},
+			wantErr:  "Frontend.HealthPort -1 is not a valid port",
+		},
+		{
+			name:     "tls",
+			frontend: FrontendConfig{TLS: boolPtr(true), Cert: &cert, Key: &key},
+		},
+		{
+			name:     "tls without certificate",
+			frontend: FrontendConfig{TLS: boolPtr(true), Key: &key},
+			wantErr:  "Frontend.Cert",
+		},
+		{
+			name:     "tls with missing certificate file",
+			frontend: FrontendConfig{TLS: boolPtr(true), Cert: &missing, Key: &key},
+			wantErr:  "Frontend.Cert: certificate file [" + missing + "]",
+		},
+		{
+			name:     "websocket tls with missing key file",
+			frontend: FrontendConfig{WebSocketTLS: boolPtr(true), Cert: &cert, Key: &missing},
+			wantErr:  "Frontend.Key: key file [" + missing + "]",
+		},
+		{
+			name:     "files not needed without tls",
+			frontend: FrontendConfig{TLS: boolPtr(false), Cert: &missing, Key: &missing},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{
+				Frontend: tt.frontend,
+				Backend:  BackendConfig{Type: strPtr("static"), Static: StaticConfig{Address: strPtr("vnc:5900")}},
+			}
+			checkValidate(t, c, tt.wantErr)
+		})
+	}
+}
+
+func strPtr(s string) *string { return &s }
+func intPtr(n int) *int       { return &n }
+func boolPtr(b bool) *bool    { return &b }
@@ -0,0 +1,70 @@
+package vncd
+
+import (
+	"context"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/http"
+
+	"github.com/kramergroup/vncd/backends"
+)
+
+// ContextBackendFactory creates a Backend for a connection. The context carries
+// information about the connection that can be used to select the backend,
+// e.g. the HTTP request of a websocket handshake (see RequestFromContext).
+type ContextBackendFactory func(ctx context.Context) (backends.Backend, error)
+
+// WithoutContext adapts a factory that does not need any information about
+// the connection to a ContextBackendFactory
+func WithoutContext(factory func() (backends.Backend, error)) ContextBackendFactory {
+	return func(ctx context.Context) (backends.Backend, error) {
+		return factory()
+	}
+}
+
+type requestKey struct{}
+
+// RequestFromContext returns the HTTP request that initiated a websocket
+// connection, if ctx belongs to one. Headers (e.g. Authorization) and query
+// parameters of the handshake are available from it.
+func RequestFromContext(ctx context.Context) (*http.Request, bool) {
+	r, ok := ctx.Value(requestKey{}).(*http.Request)
+	return r, ok
+}
+
+// contextWithRequest returns a context carrying the HTTP request r
+func contextWithRequest(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, requestKey{}, r)
+}
+
+type clientSubjectKey struct{}
+
+// ClientSubjectFromContext returns the subject of the verified client
+// certificate of a mutual TLS connection, if ctx belongs to one. The common
+// name identifies the user.
+func ClientSubjectFromContext(ctx context.Context) (pkix.Name, bool) {
+	s, ok := ctx.Value(clientSubjectKey{}).(pkix.Name)
+	return s, ok
+}
+
+// contextWithClientSubject returns a context carrying a client certificate subject
+func contextWithClientSubject(ctx context.Context, s pkix.Name) context.Context {
+	return context.WithValue(ctx, clientSubjectKey{}, s)
+}
+
+// GeometryFromContext returns the desktop geometry a websocket client requested
+// with the 'geometry' query parameter of the handshake (e.g. ?geometry=3840x2160)
+func GeometryFromContext(ctx context.Context) (width, height int, ok bool) {
+	r, ok := RequestFromContext(ctx)
+	if !ok {
+		return 0, 0, false
+	}
+	g := r.URL.Query().Get("geometry")
+	if g == "" {
+		return 0, 0, false
+	}
+	if _, err := fmt.Sscanf(g, "%dx%d", &width, &height); err != nil || width <= 0 || height <= 0 {
+		return 0, 0, false
+	}
+	return width, height, true
+}
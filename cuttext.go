@@ -0,0 +1,86 @@
+package vncd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/kramergroup/vncd/rfb"
+)
+
+// DefaultMaxCutText bounds the clipboard texts passed to a CutTextSink if no
+// other limit is set
+const DefaultMaxCutText = 64 * 1024
+
+// CutTextSink receives the clipboard texts (ServerCutText messages) a backend
+// sends to the client of a session
+type CutTextSink func(info ConnInfo, text []byte)
+
+// CutTextWebhook returns a CutTextSink posting each text as JSON
+// ({"session": "<id>", "labels": {...}, "text": "..."}) to url. Failed posts
+// are logged and dropped.
+func CutTextWebhook(url string) CutTextSink {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(info ConnInfo, text []byte) {
+		body, _ := json.Marshal(struct {
+			Session string            `json:"session"`
+			Labels  map[string]string `json:"labels,omitempty"`
+			Text    string            `json:"text"`
+		}{info.ID, info.Labels, string(text)})
+
+		go func() {
+			resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+			if err != nil {
+				log.Printf("Could not deliver clipboard of session [%s]: %v", info.ID, err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+}
+
+// tapCutText wraps the backend connection of a session so that the clipboard
+// texts sent by the backend are passed to sink. The connection is returned
+// unchanged if sink is nil.
+func tapCutText(conn net.Conn, sink CutTextSink, maxLen int, info ConnInfo) net.Conn {
+	if sink == nil {
+		return conn
+	}
+	if maxLen <= 0 {
+		maxLen = DefaultMaxCutText
+	}
+	tap := rfb.NewCutTextTap(maxLen, func(text []byte) {
+		sink(info, text)
+	})
+	return &tappedConn{Conn: conn, tap: tap}
+}
+
+// tappedConn feeds everything exchanged with the backend to a CutTextTap
+type tappedConn struct {
+	net.Conn
+	tap *rfb.CutTextTap
+}
+
+func (c *tappedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.tap.ObserveServer(b[:n])
+	return n, err
+}
+
+func (c *tappedConn) Write(b []byte) (int, error) {
+	// The tap needs to see client messages before the backend answers them
+	c.tap.ObserveClient(b)
+	return c.Conn.Write(b)
+}
+
+// CloseWrite half-closes the connection if the wrapped connection supports it
+func (c *tappedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("Connection cannot be half-closed")
+}
@@ -0,0 +1,75 @@
+package vncd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestTapCutText(t *testing.T) {
+	// The server offers no authentication, which the client selects before
+	// sending ClientInit
+	offer := []byte("RFB 003.008\n\x01\x01")
+	handshake := []byte("RFB 003.008\n\x01\x01")
+	stream := bytes.Join([][]byte{
+		{0, 0, 0, 0}, // security result
+		{0, 16, 0, 16, 32, 24, 0, 1, 0, 255, 0, 255, 0, 255, 16, 8, 0, 0, 0, 0},
+		{0, 0, 0, 3}, []byte("vnc"),
+		{3, 0, 0, 0, 0, 0, 0, 9}, []byte("clipboard"),
+		{2}, // Bell
+		{3, 0, 0, 0, 0, 0, 0, 2}, []byte("ok"),
+	}, nil)
+
+	var mux sync.Mutex
+	var texts []string
+	sink := func(info ConnInfo, text []byte) {
+		mux.Lock()
+		defer mux.Unlock()
+		if info.ID != "session" {
+			t.Errorf("Text of session %q, want session", info.ID)
+		}
+		texts = append(texts, string(text))
+	}
+
+	proxy, backend := net.Pipe()
+	conn := tapCutText(proxy, sink, 4, ConnInfo{ID: "session"})
+	go func() {
+		defer backend.Close()
+		backend.Write(offer)
+		io.ReadFull(backend, make([]byte, len(handshake)))
+		// The messages are split across several writes
+		for b := stream; len(b) > 0; b = b[3:] {
+			if len(b) < 3 {
+				backend.Write(b)
+				break
+			}
+			backend.Write(b[:3])
+		}
+	}()
+
+	got := make([]byte, len(offer))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(handshake); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client receives every byte unchanged
+	if want := append(append([]byte{}, offer...), stream...); !bytes.Equal(append(got, rest...), want) {
+		t.Errorf("Client received %q, want %q", append(got, rest...), want)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if want := []string{"clip", "ok"}; !reflect.DeepEqual(texts, want) {
+		t.Errorf("Sink received %q, want %q", texts, want)
+	}
+}
@@ -0,0 +1,74 @@
+package vncd
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kramergroup/vncd/rfb"
+)
+
+// keepaliveBackend wraps the backend connection of a session so that
+// FramebufferUpdateRequests are injected after interval without client
+// messages (see rfb.Keepalive). The connection is returned unchanged if
+// interval is 0.
+func keepaliveBackend(conn net.Conn, interval time.Duration) net.Conn {
+	if interval <= 0 {
+		return conn
+	}
+	c := &keepaliveConn{
+		Conn:      conn,
+		keepalive: rfb.NewKeepalive(),
+		done:      make(chan struct{}),
+	}
+	go c.run(interval)
+	return c
+}
+
+// keepaliveConn passes everything sent to the backend through a keepalive
+type keepaliveConn struct {
+	net.Conn
+	keepalive *rfb.Keepalive
+	done      chan struct{}
+	once      sync.Once
+}
+
+func (c *keepaliveConn) run(interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if _, err := c.keepalive.Inject(c.Conn, interval); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *keepaliveConn) Write(b []byte) (int, error) {
+	return c.keepalive.Write(c.Conn, b)
+}
+
+func (c *keepaliveConn) stop() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// Close stops the keepalive and closes the connection
+func (c *keepaliveConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+// CloseWrite stops the keepalive and half-closes the connection if the
+// wrapped connection supports it
+func (c *keepaliveConn) CloseWrite() error {
+	c.stop()
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("Connection cannot be half-closed")
+}
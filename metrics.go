@@ -0,0 +1,87 @@
+package vncd
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/******************************************************************************
+  Metrics
+ ******************************************************************************/
+
+// Names of the session metrics used by the Prometheus (SessionMetrics) and
+// StatsD exporters. Prometheus names carry a "vncd_" prefix, StatsD names the
+// configured prefix.
+const (
+	metricOpenSessions     = "open_sessions"     // gauge
+	metricConnections      = "connections"       // counter of ready sessions
+	metricBackendErrors    = "backend_errors"    // counter of failed creations
+	metricBackendCreate    = "backend_create"    // timer of backend creations
+	metricBackendTerminate = "backend_terminate" // timer of backend terminations
+	metricBytesIn          = "bytes_in"          // counter of bytes from clients
+	metricBytesOut         = "bytes_out"         // counter of bytes to clients
+)
+
+// SessionMetrics serves the open sessions of a registry as a Prometheus gauge.
+// Only the label keys in AllowedLabels become metric labels; all other labels
+// are dropped to bound the number of time series (e.g. a label per client IP).
+// They remain available via the registry itself.
+type SessionMetrics struct {
+	Registry      *SessionRegistry
+	AllowedLabels []string
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (m SessionMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	// Count sessions per combination of allowed labels
+	counts := make(map[string]int)
+	for _, s := range m.Registry.Sessions(nil) {
+		counts[m.metricLabels(s.Labels)]++
+	}
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	name := "vncd_" + metricOpenSessions
+	fmt.Fprintf(w, "# HELP %s Number of open sessions.\n", name)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	if len(keys) == 0 {
+		fmt.Fprintf(w, "%s 0\n", name)
+	}
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", name, k, counts[k])
+	}
+}
+
+// metricLabels formats the allowed labels of a session as a Prometheus label
+// set (e.g. {tenant="acme"}). Missing labels are reported as empty values.
+func (m SessionMetrics) metricLabels(labels map[string]string) string {
+	if len(m.AllowedLabels) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(m.AllowedLabels))
+	for i, k := range m.AllowedLabels {
+		pairs[i] = metricName(k) + `="` + labelValueEscaper.Replace(labels[k]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelValueEscaper escapes label values as required by the Prometheus text
+// exposition format, which only knows the escapes \\, \" and \n
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricName replaces characters that are not valid in Prometheus label names
+func metricName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, s)
+}
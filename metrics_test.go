@@ -0,0 +1,31 @@
+package vncd
+
+import (
+	"testing"
+)
+
+func TestMetricLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		labels  map[string]string
+		want    string
+	}{
+		{"no allowed labels", nil, map[string]string{"tenant": "acme"}, ``},
+		{"plain value", []string{"tenant"}, map[string]string{"tenant": "acme"}, `{tenant="acme"}`},
+		{"missing value", []string{"tenant"}, nil, `{tenant=""}`},
+		{"invalid name", []string{"app.kubernetes.io/name"}, map[string]string{"app.kubernetes.io/name": "vnc"}, `{app_kubernetes_io_name="vnc"}`},
+		{"backslash", []string{"path"}, map[string]string{"path": `C:\vnc`}, `{path="C:\\vnc"}`},
+		{"quote", []string{"name"}, map[string]string{"name": `say "hi"`}, `{name="say \"hi\""}`},
+		{"newline", []string{"name"}, map[string]string{"name": "a\nb"}, `{name="a\nb"}`},
+		{"unicode and tab are not escaped", []string{"name"}, map[string]string{"name": "caf\u00e9\tbar"}, "{name=\"caf\u00e9\tbar\"}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := SessionMetrics{AllowedLabels: tt.allowed}
+			if got := m.metricLabels(tt.labels); got != tt.want {
+				t.Errorf("metricLabels() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
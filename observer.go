@@ -0,0 +1,78 @@
+package vncd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// BackendEvent describes a step in the lifecycle of the backend of a session
+type BackendEvent struct {
+	Session  ConnInfo      // the session (ID and labels; Target once known)
+	Time     time.Time     // when the step completed
+	Duration time.Duration // how long the step took
+	Err      error         // set if the step failed
+
+	// Bytes relayed from the client to the backend (BytesIn) and back
+	// (BytesOut) during the session. Only set for OnTerminate.
+	BytesIn  int64
+	BytesOut int64
+}
+
+// BackendObserver is notified about the lifecycle of session backends, e.g. to
+// collect metrics or an audit trail. For every session, OnCreate is called
+// once the backend factory returns (with Err set if it failed). OnReady
+// follows once the proxy has connected to the backend, and OnTerminate once
+// the backend has been terminated. Backends that fail before becoming ready
+// are terminated without OnReady.
+//
+// Methods are called synchronously from the connection handlers and should
+// return quickly.
+type BackendObserver interface {
+	OnCreate(e BackendEvent)
+	OnReady(e BackendEvent)
+	OnTerminate(e BackendEvent)
+}
+
+// backendEvent returns the event for a step started at start
+func backendEvent(info ConnInfo, start time.Time, err error) BackendEvent {
+	now := time.Now()
+	return BackendEvent{
+		Session:  info,
+		Time:     now,
+		Duration: now.Sub(start),
+		Err:      err,
+	}
+}
+
+// observeCreate notifies o (if not nil) of a backend creation
+func observeCreate(o BackendObserver, info ConnInfo, start time.Time, err error) {
+	if o != nil {
+		o.OnCreate(backendEvent(info, start, err))
+	}
+}
+
+// observeReady notifies o (if not nil) of a backend becoming ready
+func observeReady(o BackendObserver, info ConnInfo, start time.Time) {
+	if o != nil {
+		o.OnReady(backendEvent(info, start, nil))
+	}
+}
+
+// observeTerminate notifies o (if not nil) of a backend termination. t holds
+// the bytes relayed during the session (nil if there was none).
+func observeTerminate(o BackendObserver, info ConnInfo, start time.Time, t *traffic) {
+	if o != nil {
+		e := backendEvent(info, start, nil)
+		if t != nil {
+			e.BytesIn = atomic.LoadInt64(&t.in)
+			e.BytesOut = atomic.LoadInt64(&t.out)
+		}
+		o.OnTerminate(e)
+	}
+}
+
+// traffic counts the bytes relayed during a session
+type traffic struct {
+	in  int64 // from the client to the backend
+	out int64 // from the backend to the client
+}
@@ -1,17 +1,22 @@
 package vncd
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/kramergroup/vncd/backends"
+	"github.com/kramergroup/vncd/rfb"
 )
 
 // Server is a TCP server that takes an incoming request and sends it to another
@@ -19,6 +24,9 @@ import (
 type Server struct {
 
 	// Target address
+	//
+	// Deprecated: connections are relayed to the target of their backend,
+	// which is recorded in their SessionInfo. Target is not set.
 	Target *net.TCPAddr
 
 	// Local address
@@ -40,12 +48,95 @@ type Server struct {
 	// Creator creates a new Backend for connection requests
 	BackendFactory func() (backends.Backend, error)
 
-	// Pipe termination channels
-	sigs map[chan<- os.Signal]struct{}
+	// Sessions, if set, keeps track of open connections
+	Sessions *SessionRegistry
+
+	// IDGenerator stamps each connection with an ID (RandomID if nil)
+	IDGenerator IDGenerator
+
+	// Labels derives the labels attached to each session
+	Labels LabelMapping
+
+	// Observer, if set, is notified about the lifecycle of backends
+	Observer BackendObserver
+
+	// ReadinessProbe, if set, is run against new backends until they are ready
+	// before the proxy connects to them
+	ReadinessProbe backends.Probe
+
+	// Limiter, if set, limits the rate of new connections
+	Limiter *ConnectionLimiter
+
+	// MaxConcurrentTerminations bounds the number of backends terminated at the
+	// same time, e.g. during shutdown. Zero means no limit.
+	MaxConcurrentTerminations int
+
+	// UpdateRequestRate caps the number of FramebufferUpdateRequest messages
+	// per second a client can send to its backend. Zero disables the limit.
+	UpdateRequestRate float64
+
+	// CutTextSink, if set, receives the clipboard texts backends send to
+	// clients. Texts are truncated to MaxCutText bytes (DefaultMaxCutText if 0).
+	CutTextSink CutTextSink
+	MaxCutText  int
+
+	// KeepaliveInterval, if set, sends a FramebufferUpdateRequest to the
+	// backend once the client has not sent anything for the interval, as
+	// some VNC servers disconnect idle clients
+	KeepaliveInterval time.Duration
+
+	// Record, if set, is called for every session and returns where both
+	// directions of the session are recorded to (see Recorder). With
+	// EarlyHandshake or MinRFBVersion, the version exchange is not part of
+	// the recording.
+	Record func(info ConnInfo) (io.WriteCloser, error)
+
+	// RecordDir, if set and Record is not, records every session to a file
+	// in this directory (see RecordToDir)
+	RecordDir string
+
+	// ProxyProtocol reads PROXY protocol headers (v1 and v2) sent by a load
+	// balancer ahead of the client connection and uses the client address
+	// they carry (see ProxyProtocolRequired and ProxyProtocolOptional).
+	// Headers must arrive within ProxyHeaderTimeout (DefaultProxyHeaderTimeout
+	// if 0). In optional mode, clients sending no header are delayed by this
+	// timeout, as RFB clients wait for the server to speak first. Disabled if
+	// empty.
+	ProxyProtocol      string
+	ProxyHeaderTimeout time.Duration
+
+	// Admit, if set, decides about every connection before a backend is
+	// created. The class hint of the admission is not used by the
+	// BackendFactory.
+	Admit Admitter
+
+	// EarlyHandshake makes the proxy send the RFB ProtocolVersion greeting to
+	// the client as soon as it connects - before a backend is available. The
+	// version is reconciled with the backend once it is connected.
+	EarlyHandshake bool
+
+	// MinRFBVersion refuses clients that request an older protocol version,
+	// e.g. 3.8 to refuse RFB 3.3 clients with their weaker security
+	// handshake. Without EarlyHandshake, the version of the backend is
+	// offered to the client once it is connected. Not enforced if zero.
+	MinRFBVersion rfb.Version
+
+	// HandshakeFailureReason is sent to clients greeted early (see
+	// EarlyHandshake) as RFB handshake failure if the backend fails before
+	// the handshake with it is complete. The connection is closed without
+	// a reason if empty.
+	HandshakeFailureReason string
+
+	// Pipe termination channels, guarded by sigsMux
+	sigs    map[chan<- os.Signal]struct{}
+	sigsMux sync.Mutex
 
 	// accepting monitors the state of the server and returns true if new
 	// connections can be established
 	accepting bool
+
+	// terminations bounds concurrent backend terminations
+	terminations terminator
 }
 
 // NewServer created a new proxy which sends all packet to target. The function dir
@@ -67,40 +158,57 @@ func NewServer(dir func(*[]byte), factory func() (backends.Backend, error), conf
 }
 
 // ListenAndServe listens on the TCP network address laddr and then handle packets
-// on incoming connections.
-func (p *Server) ListenAndServe(laddr *net.TCPAddr) {
+// on incoming connections. It returns an error if laddr cannot be bound and nil
+// once the server has been stopped by a signal.
+func (p *Server) ListenAndServe(laddr *net.TCPAddr) error {
 	p.Addr = laddr
 
-	var listener net.Listener
-	listener, err := net.ListenTCP("tcp", laddr)
+	listener, err := p.listen(laddr)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
 
 	p.serve(listener)
+	return nil
 }
 
 // ListenAndServeTLS acts identically to ListenAndServe, except that it uses TLS
-// protocol. Additionally, files containing a certificate and matching private key
-// for the server must be provided.
-func (p *Server) ListenAndServeTLS(laddr *net.TCPAddr, certFile, keyFile string) {
+// protocol with the given configuration (e.g. of a CertificateStore).
+func (p *Server) ListenAndServeTLS(laddr *net.TCPAddr, config *tls.Config) error {
 	p.Addr = laddr
 
-	var listener net.Listener
-	cer, err := tls.LoadX509KeyPair(certFile, keyFile)
+	listener, err := p.listen(laddr)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
+	}
+
+	p.serve(tls.NewListener(listener, config))
+	return nil
+}
+
+// listen opens a TCP listener, reading PROXY protocol headers if configured
+func (p *Server) listen(laddr *net.TCPAddr) (net.Listener, error) {
+	listener, err := net.ListenTCP("tcp", laddr)
+	if err != nil || p.ProxyProtocol == "" {
+		return listener, err
 	}
-	config := &tls.Config{Certificates: []tls.Certificate{cer}}
-	listener, err = tls.Listen("tcp", laddr.String(), config)
+	pl, err := newProxyListener(listener, p.ProxyProtocol, p.ProxyHeaderTimeout)
 	if err != nil {
-		fmt.Println(err)
-		return
+		listener.Close()
+		return nil, err
 	}
+	return pl, nil
+}
 
-	p.serve(listener)
+// failHandshake sends the HandshakeFailureReason to a client that has been
+// greeted early and awaits the security handshake
+func (p *Server) failHandshake(client io.Writer, v rfb.Version) {
+	if !p.EarlyHandshake || p.HandshakeFailureReason == "" {
+		return
+	}
+	if err := rfb.WriteFailure(client, v, p.HandshakeFailureReason); err != nil {
+		fmt.Println("Could not send handshake failure to client: " + err.Error())
+	}
 }
 
 func (p *Server) serve(ln net.Listener) {
@@ -131,17 +239,24 @@ func (p *Server) serve(ln net.Listener) {
 				fmt.Println(a.err)
 				continue
 			}
+			if !p.Limiter.Allow(a.conn.RemoteAddr().String()) {
+				fmt.Println("Rate limit exceeded - rejecting connection from " + a.conn.RemoteAddr().String())
+				a.conn.Close()
+				continue
+			}
 			go p.handleConn(a.conn)
 		case signal := <-sigs:
+			p.sigsMux.Lock()
 			for s := range p.sigs {
 				s <- signal
 			}
+			p.sigsMux.Unlock()
 
 			// Wait for all pipes to deregister
 			d := make(chan bool, 1)
 			go func() {
-				for len(p.sigs) > 0 {
-					continue
+				for p.CountOpenConnections() > 0 {
+					time.Sleep(10 * time.Millisecond)
 				}
 				d <- true
 			}()
@@ -166,16 +281,67 @@ func (p *Server) AcceptingConnections() bool {
 
 // CountOpenConnections returns the number of open, monitored connections
 func (p *Server) CountOpenConnections() int {
+	p.sigsMux.Lock()
+	defer p.sigsMux.Unlock()
 	return len(p.sigs)
 }
 
+// registerPipe registers or deregisters the termination channel of a pipe
+func (p *Server) registerPipe(sg chan<- os.Signal, register bool) {
+	p.sigsMux.Lock()
+	defer p.sigsMux.Unlock()
+	if register {
+		p.sigs[sg] = struct{}{}
+	} else {
+		delete(p.sigs, sg)
+	}
+}
+
+// terminate terminates the backend of a session, honouring
+// MaxConcurrentTerminations
+func (p *Server) terminate(b backends.Backend, info ConnInfo, t *traffic) {
+	start := time.Now()
+	p.terminations.terminate(p.MaxConcurrentTerminations, b)
+	observeTerminate(p.Observer, info, start, t)
+}
+
 // handleConn handles connection.
 func (p *Server) handleConn(conn net.Conn) {
 	fmt.Println("Incomming connection from " + p.Addr.String())
+	defer p.Sessions.connect()()
+
+	info := newConnInfo(p.IDGenerator, conn.RemoteAddr().String(), p.Labels.labels(nil, nil))
+	if !admit(p.Admit, info).Allowed {
+		conn.Close()
+		return
+	}
+
+	var client io.ReadWriter = conn
+
+	// Greet the client while the backend is still starting up. This also
+	// detects dead clients before a backend is created for them.
+	var clientVersion rfb.Version
+	if p.EarlyHandshake {
+		var err error
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+		clientVersion, err = rfb.Greet(client, rfb.Version38)
+		if err != nil {
+			fmt.Println("RFB greeting failed: " + err.Error())
+			conn.Close()
+			return
+		}
+		if err = rfb.RequireVersion(client, clientVersion, p.MinRFBVersion); err != nil {
+			fmt.Println(err.Error())
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+	}
 
 	// Initiate the backend
 	backendCreatedCh := make(chan bool)
 	var backend backends.Backend
+	created := time.Now()
 	go func() {
 		var err error
 		backend, err = p.BackendFactory()
@@ -188,68 +354,135 @@ func (p *Server) handleConn(conn net.Conn) {
 	select {
 	case <-time.After(30 * time.Second):
 		fmt.Println("Timeout obtaining backend.")
+		observeCreate(p.Observer, info, created, errors.New("Timeout obtaining backend"))
+		p.failHandshake(client, clientVersion)
 		conn.Close()
 		return
 	case ok := <-backendCreatedCh:
 		if !ok {
 			fmt.Println("Failed to obtain backend.")
+			observeCreate(p.Observer, info, created, errors.New("Failed to obtain backend"))
+			p.failHandshake(client, clientVersion)
 			conn.Close()
 			return
 		}
 	}
+	observeCreate(p.Observer, info, created, nil)
+	created = time.Now()
+	fmt.Println("Connection [" + info.ID + "] handled by backend " + backend.ID())
 
-	// Set the proxy Target to the backend
-	var err error
-	p.Target, err = backend.GetTarget()
+	// Connect to the target of this connection's backend
+	target, err := backend.GetTarget()
 	if err != nil {
-		fmt.Println("Failed to obtain backend address.")
-		backend.Terminate()
+		fmt.Println("Failed to obtain address of backend " + backend.ID())
+		p.terminate(backend, info, nil)
+		p.failHandshake(client, clientVersion)
 		conn.Close()
 		return
 	}
 
-	// connects to VNC server - try for 5 seconds to give time for VNC to come up
-	var rconn net.Conn
-	var establishRemoteConn = true
-	remoteConnEstablishedCh := make(chan bool)
-	go func() {
-		var err error
-		for establishRemoteConn {
-			if p.Config == nil {
-				rconn, err = net.Dial("tcp", p.Target.String())
-				establishRemoteConn = (err != nil)
-			} else {
-				rconn, err = tls.Dial("tcp", p.Target.String(), p.Config)
-				establishRemoteConn = (err != nil)
-			}
+	// Wait for the backend to become ready
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	err = backend.Ready(ctx)
+	cancel()
+	if err != nil {
+		fmt.Println(err)
+		p.terminate(backend, info, nil)
+		p.failHandshake(client, clientVersion)
+		conn.Close()
+		return
+	}
+	if p.ReadinessProbe != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err = backends.WaitReady(ctx, backend, p.ReadinessProbe, time.Second)
+		cancel()
+		if err != nil {
+			fmt.Println(err)
+			p.terminate(backend, info, nil)
+			p.failHandshake(client, clientVersion)
+			conn.Close()
+			return
 		}
-		remoteConnEstablishedCh <- (err == nil)
-	}()
+	}
 
-	select {
-	case <-time.After(30 * time.Second):
-		fmt.Println("Timeout establishing remote connection to backend.")
-		establishRemoteConn = false
+	// connects to VNC server, which is ready to accept connections now
+	var rconn net.Conn
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if p.Config == nil {
+		rconn, err = dialer.Dial("tcp", target.String())
+	} else {
+		rconn, err = tls.DialWithDialer(dialer, "tcp", target.String(), p.Config)
+	}
+	if err != nil {
+		fmt.Println("Failed to establish connection to backend " + backend.ID() + ": " + err.Error())
+		p.failHandshake(client, clientVersion)
 		conn.Close()
-		backend.Terminate()
+		p.terminate(backend, info, nil)
 		return
-	case ok := <-remoteConnEstablishedCh:
-		if !ok {
-			fmt.Println("Failed to establish connection to backend.")
+	}
+	rconn = tapCutText(rconn, p.CutTextSink, p.MaxCutText, info)
+	rconn = keepaliveBackend(rconn, p.KeepaliveInterval)
+	rconn = limitUpdateRequests(rconn, p.UpdateRequestRate)
+
+	// Reconcile the protocol version with the backend
+	if p.EarlyHandshake {
+		rconn.SetDeadline(time.Now().Add(30 * time.Second))
+		if _, err = rfb.Handshake(client, rconn, clientVersion); err != nil {
+			fmt.Println("RFB handshake with backend failed: " + err.Error())
+			if _, ok := err.(rfb.ServerError); ok {
+				p.failHandshake(client, clientVersion)
+			}
+			conn.Close()
+			rconn.Close()
+			p.terminate(backend, info, nil)
+			return
+		}
+		rconn.SetDeadline(time.Time{})
+	} else if p.MinRFBVersion != (rfb.Version{}) {
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+		rconn.SetDeadline(time.Now().Add(30 * time.Second))
+		if _, err = rfb.RelayVersion(client, rconn, p.MinRFBVersion); err != nil {
+			fmt.Println("RFB version exchange failed: " + err.Error())
 			conn.Close()
-			backend.Terminate()
+			rconn.Close()
+			p.terminate(backend, info, nil)
 			return
 		}
+		conn.SetDeadline(time.Time{})
+		rconn.SetDeadline(time.Time{})
 	}
 
 	// Start bi-directional pipes
 	var pipeMux sync.Mutex
 	var pipeDone = false
 	sg := make(chan os.Signal, 1)
-	p.sigs[sg] = struct{}{} // register pipe with system signal handling
+	p.registerPipe(sg, true) // register pipe with system signal handling
+
+	info.Target = target.String()
+	info.Started = time.Now()
+	p.Sessions.add(info)
+	observeReady(p.Observer, info, created)
+	var relayed traffic
+
+	// Record the session
+	var recording io.WriteCloser
+	recorder := NewRecorder(ioutil.Discard)
+	record := p.Record
+	if record == nil && p.RecordDir != "" {
+		record = RecordToDir(p.RecordDir)
+	}
+	if record != nil {
+		if recording, err = record(info); err != nil {
+			fmt.Println("Not recording session: " + err.Error())
+		} else {
+			recorder = NewRecorder(recording)
+		}
+	}
 
-	// write to dst what it reads from src
-	var pipe = func(src, dst net.Conn, filter func(b *[]byte)) {
+	// write to dst what it reads from src. If halfClose is set, the end of src
+	// only closes the write side of dst and leaves the other pipe running.
+	// count is increased by the bytes written to dst.
+	var pipe = func(src, dst net.Conn, filter func(b *[]byte), rec io.Writer, halfClose bool, count *int64) {
 
 		buff := make([]byte, 65535)
 		cp := make(chan error, 1)
@@ -258,16 +491,19 @@ func (p *Server) handleConn(conn net.Conn) {
 			pipeMux.Lock()
 			// if first pipe to end, closing conn will end the other pipe.
 			if !pipeDone {
-				fmt.Println("Closing pipe " + p.Addr.String() + "<->" + p.Target.String())
+				fmt.Println("Closing pipe [" + info.ID + "] " + p.Addr.String() + "<->" + target.String() + " (backend " + backend.ID() + ")")
 				conn.Close()
 				rconn.Close()
-				backend.Terminate()
-				delete(p.sigs, sg)
+				p.Sessions.remove(info.ID)
+				p.terminate(backend, info, &relayed)
+				p.registerPipe(sg, false)
+				if recording != nil {
+					recording.Close()
+				}
 				pipeDone = true
 			}
 			pipeMux.Unlock()
 		}
-		defer cleanup()
 
 		copyPayload := func() {
 			src.SetReadDeadline(time.Now().Add(10 * time.Second))
@@ -285,8 +521,10 @@ func (p *Server) handleConn(conn net.Conn) {
 			if filter != nil {
 				filter(&b)
 			}
+			rec.Write(b)
 
-			_, err = dst.Write(b)
+			n, err = dst.Write(b)
+			atomic.AddInt64(count, int64(n))
 			cp <- err
 		}
 		for {
@@ -296,6 +534,14 @@ func (p *Server) handleConn(conn net.Conn) {
 				cleanup()
 				return
 			case err := <-cp:
+				if err == io.EOF && halfClose {
+					if cw, ok := dst.(closeWriter); ok {
+						fmt.Println("Client closed its write side - half-closing backend connection")
+						if cw.CloseWrite() == nil {
+							return
+						}
+					}
+				}
 				if err != nil {
 					cleanup()
 					return
@@ -305,7 +551,13 @@ func (p *Server) handleConn(conn net.Conn) {
 		}
 	}
 
-	fmt.Println("Initiating pipe " + p.Addr.String() + "<->" + p.Target.String())
-	go pipe(conn, rconn, p.Director)
-	go pipe(rconn, conn, nil)
+	fmt.Println("Initiating pipe [" + info.ID + "] " + p.Addr.String() + "<->" + target.String() + " (backend " + backend.ID() + ")")
+	go pipe(conn, rconn, p.Director, recorder.Client(), true, &relayed.in)
+	go pipe(rconn, conn, nil, recorder.Server(), false, &relayed.out)
+}
+
+// closeWriter is implemented by connections that can be half-closed (e.g.
+// *net.TCPConn and *tls.Conn)
+type closeWriter interface {
+	CloseWrite() error
 }
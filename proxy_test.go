@@ -0,0 +1,152 @@
+package vncd
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kramergroup/vncd/backends"
+)
+
+// recordingObserver keeps the events of a session and the number of open
+// sessions at OnReady
+type recordingObserver struct {
+	mux         sync.Mutex
+	sessions    *SessionRegistry
+	openAtReady int
+	terminate   chan BackendEvent
+}
+
+func (o *recordingObserver) OnCreate(e BackendEvent) {}
+
+func (o *recordingObserver) OnReady(e BackendEvent) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.openAtReady = len(o.sessions.Sessions(nil))
+}
+
+func (o *recordingObserver) OnTerminate(e BackendEvent) {
+	o.terminate <- e
+}
+
+func TestServerObservesSession(t *testing.T) {
+	replay := newReplayBackend(t, syntheticSession)
+	p, err := NewServer(nil, func() (backends.Backend, error) {
+		return replay, nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Sessions = NewSessionRegistry()
+	o := &recordingObserver{sessions: p.Sessions, terminate: make(chan BackendEvent, 1)}
+	p.Observer = o
+
+	conn, err := net.Dial("tcp", startServer(t, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = playClient(conn, syntheticSession, nil); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err = replay.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	var e BackendEvent
+	select {
+	case e = <-o.terminate:
+	case <-time.After(15 * time.Second):
+		t.Fatal("Backend not terminated")
+	}
+
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	tests := []struct {
+		name      string
+		got, want int64
+	}{
+		{"open sessions at OnReady", int64(o.openAtReady), 1},
+		{"open sessions after termination", int64(len(p.Sessions.Sessions(nil))), 0},
+		{"bytes in", e.BytesIn, int64(len(joinFrames(syntheticSession, true)))},
+		{"bytes out", e.BytesOut, int64(len(joinFrames(syntheticSession, false)))},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %d, want %d", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+// targetObserver collects the targets of sessions becoming ready
+type targetObserver struct {
+	mux     sync.Mutex
+	targets map[string]int
+}
+
+func (o *targetObserver) OnCreate(e BackendEvent)    {}
+func (o *targetObserver) OnTerminate(e BackendEvent) {}
+
+func (o *targetObserver) OnReady(e BackendEvent) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.targets[e.Session.Target]++
+}
+
+func TestServerSessionTargets(t *testing.T) {
+	replays := []*replayBackend{
+		newReplayBackend(t, syntheticSession),
+		newReplayBackend(t, syntheticSession),
+	}
+	var next int32
+	p, err := NewServer(nil, func() (backends.Backend, error) {
+		return replays[atomic.AddInt32(&next, 1)-1], nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &targetObserver{targets: make(map[string]int)}
+	p.Observer = o
+	addr := startServer(t, p)
+
+	// Both sessions are set up concurrently
+	var wg sync.WaitGroup
+	errs := make(chan error, len(replays))
+	for range replays {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			errs <- playClient(conn, syntheticSession, nil)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range replays {
+		if err := r.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each session records the target of its own backend
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	for _, r := range replays {
+		target, _ := r.GetTarget()
+		if n := o.targets[target.String()]; n != 1 {
+			t.Errorf("%d sessions with target %s, want 1 (targets: %v)", n, target, o.targets)
+		}
+	}
+}
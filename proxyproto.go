@@ -0,0 +1,281 @@
+package vncd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/******************************************************************************
+  PROXY protocol
+ ******************************************************************************/
+
+// Modes of handling PROXY protocol headers sent by load balancers in front of
+// the proxy (see Server.ProxyProtocol)
+const (
+	// ProxyProtocolRequired closes connections without a valid header
+	ProxyProtocolRequired = "required"
+
+	// ProxyProtocolOptional accepts connections without a header. Connections
+	// with an incomplete or invalid header are passed through unmodified.
+	ProxyProtocolOptional = "optional"
+)
+
+// DefaultProxyHeaderTimeout bounds the time to receive a PROXY protocol header
+// if no other timeout is set
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+const (
+	proxyV1MaxLen  = 107  // maximum length of a v1 header including CRLF
+	proxyMaxHeader = 4096 // maximum length of a v2 header including TLVs
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// errNoProxyHeader is returned if a connection does not start with a header
+var errNoProxyHeader = errors.New("No PROXY protocol header")
+
+// proxyListener reads the PROXY protocol header (v1 or v2) of accepted
+// connections and reports the client address it carries as their remote
+// address. Headers are read concurrently, so that slow senders do not hold up
+// other connections.
+type proxyListener struct {
+	net.Listener
+	required bool
+	timeout  time.Duration
+
+	conns chan net.Conn
+	errs  chan error
+	done  chan struct{}
+	once  sync.Once
+}
+
+// newProxyListener wraps ln. The header of each connection must be received
+// within timeout (DefaultProxyHeaderTimeout if 0).
+func newProxyListener(ln net.Listener, mode string, timeout time.Duration) (*proxyListener, error) {
+	if mode != ProxyProtocolRequired && mode != ProxyProtocolOptional {
+		return nil, fmt.Errorf("Unknown PROXY protocol mode: %s", mode)
+	}
+	if timeout <= 0 {
+		timeout = DefaultProxyHeaderTimeout
+	}
+	l := &proxyListener{
+		Listener: ln,
+		required: mode == ProxyProtocolRequired,
+		timeout:  timeout,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l, nil
+}
+
+// Accept returns the next connection whose header has been read
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, errors.New("Listener closed")
+	}
+}
+
+// Close closes the listener. Connections still sending their header are
+// closed once the header has been read.
+func (l *proxyListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func (l *proxyListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go l.readHeader(conn)
+	}
+}
+
+func (l *proxyListener) readHeader(conn net.Conn) {
+	c, err := readProxyHeader(conn, l.required, l.timeout)
+	if err != nil {
+		fmt.Println("Rejecting connection from " + conn.RemoteAddr().String() + ": " + err.Error())
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// readProxyHeader reads the header at the start of conn and returns a
+// connection reporting the client address of the header as remote address.
+// Only peeked bytes are consumed, so that optional headers that turn out to be
+// incomplete or invalid are passed through unmodified.
+func readProxyHeader(conn net.Conn, required bool, timeout time.Duration) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReaderSize(conn, proxyMaxHeader)
+	n, remote, err := parseProxyHeader(br)
+	if err != nil {
+		if required {
+			return nil, err
+		}
+		if err != errNoProxyHeader {
+			fmt.Println("Passing through connection with invalid PROXY protocol header from " + conn.RemoteAddr().String() + ": " + err.Error())
+		}
+		return &proxiedConn{Conn: conn, r: br}, nil
+	}
+	br.Discard(n)
+	return &proxiedConn{Conn: conn, r: br, remote: remote}, nil
+}
+
+// parseProxyHeader peeks at a header in br and returns its length and the
+// client address it carries (nil for local or unknown connections)
+func parseProxyHeader(br *bufio.Reader) (int, net.Addr, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// Nothing sent, e.g. an RFB client waiting for the greeting
+			return 0, nil, errNoProxyHeader
+		}
+		return 0, nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return parseProxyV1(br)
+	case proxyV2Signature[0]:
+		return parseProxyV2(br)
+	}
+	return 0, nil, errNoProxyHeader
+}
+
+// parseProxyV1 parses a text header (e.g. "PROXY TCP4 1.2.3.4 5.6.7.8 1234 5900\r\n")
+func parseProxyV1(br *bufio.Reader) (int, net.Addr, error) {
+	var line []byte
+	for n := 1; ; n++ {
+		if n > proxyV1MaxLen {
+			return 0, nil, errors.New("PROXY protocol header too long")
+		}
+		b, err := br.Peek(n)
+		if err != nil {
+			return 0, nil, fmt.Errorf("Incomplete PROXY protocol header: %v", err)
+		}
+		if n <= 6 && !bytes.HasPrefix([]byte("PROXY "), b) {
+			return 0, nil, errNoProxyHeader
+		}
+		if bytes.HasSuffix(b, []byte("\r\n")) {
+			line = b[:n-2]
+			break
+		}
+	}
+
+	fields := strings.Split(string(line), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return len(line) + 2, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return 0, nil, fmt.Errorf("Invalid PROXY protocol header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return 0, nil, fmt.Errorf("Invalid PROXY protocol source address %q", line)
+	}
+	return len(line) + 2, &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// parseProxyV2 parses a binary header
+func parseProxyV2(br *bufio.Reader) (int, net.Addr, error) {
+	for n := 1; n <= len(proxyV2Signature); n++ {
+		b, err := br.Peek(n)
+		if err != nil {
+			return 0, nil, fmt.Errorf("Incomplete PROXY protocol header: %v", err)
+		}
+		if !bytes.Equal(b, proxyV2Signature[:n]) {
+			return 0, nil, errNoProxyHeader
+		}
+	}
+	hdr, err := br.Peek(16)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Incomplete PROXY protocol header: %v", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return 0, nil, fmt.Errorf("Unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	length := 16 + int(binary.BigEndian.Uint16(hdr[14:16]))
+	if length > proxyMaxHeader {
+		return 0, nil, errors.New("PROXY protocol header too long")
+	}
+	b, err := br.Peek(length)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Incomplete PROXY protocol header: %v", err)
+	}
+
+	if hdr[12]&0x0F == 0 {
+		return length, nil, nil // LOCAL command, e.g. a health check
+	}
+	addrs := b[16:]
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		if len(addrs) < 12 {
+			return 0, nil, errors.New("Invalid PROXY protocol IPv4 addresses")
+		}
+		return length, &net.TCPAddr{IP: append(net.IP(nil), addrs[0:4]...), Port: int(binary.BigEndian.Uint16(addrs[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(addrs) < 36 {
+			return 0, nil, errors.New("Invalid PROXY protocol IPv6 addresses")
+		}
+		return length, &net.TCPAddr{IP: append(net.IP(nil), addrs[0:16]...), Port: int(binary.BigEndian.Uint16(addrs[32:34]))}, nil
+	}
+	return length, nil, nil // unspecified or unsupported family
+}
+
+// proxiedConn is a connection whose PROXY protocol header has been read
+type proxiedConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr // client address of the header (nil if none)
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address of the header, or the address of the
+// peer if there was none
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// CloseWrite half-closes the connection if the wrapped connection supports it
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("Connection cannot be half-closed")
+}
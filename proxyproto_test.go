@@ -0,0 +1,116 @@
+package vncd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a binary PROXY header of family fam (0x11 for TCP over
+// IPv4, 0x21 for IPv6) from the source address src
+func proxyV2Header(fam byte, src *net.TCPAddr) []byte {
+	ip := src.IP.To4()
+	dst := net.IPv4(10, 0, 0, 1).To4()
+	if fam == 0x21 {
+		ip, dst = src.IP.To16(), net.IPv6loopback
+	}
+	addrs := append(append([]byte{}, ip...), dst...)
+	addrs = append(addrs, 0, 0, 0x17, 0x0c) // source port (set below) and 5900
+	binary.BigEndian.PutUint16(addrs[len(addrs)-4:], uint16(src.Port))
+
+	hdr := append([]byte{}, proxyV2Signature...)
+	hdr = append(hdr, 0x21, fam, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:16], uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	// The payload exceeds the buffer of the header, so that reading it
+	// reuses the bytes the header was peeked from
+	payload := bytes.Repeat([]byte("RFB 003.008\n"), 1000)
+
+	tests := []struct {
+		name     string
+		header   []byte
+		required bool
+		want     string // remote address ("" = address of the peer)
+	}{
+		{
+			name:   "v1 TCP4",
+			header: []byte("PROXY TCP4 192.0.2.1 10.0.0.1 40000 5900\r\n"),
+			want:   "192.0.2.1:40000",
+		},
+		{
+			name:   "v1 TCP6",
+			header: []byte("PROXY TCP6 2001:db8::1 ::1 40000 5900\r\n"),
+			want:   "[2001:db8::1]:40000",
+		},
+		{
+			name:   "v2 IPv4",
+			header: proxyV2Header(0x11, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}),
+			want:   "192.0.2.1:40000",
+		},
+		{
+			name:   "v2 IPv6",
+			header: proxyV2Header(0x21, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}),
+			want:   "[2001:db8::1]:40000",
+		},
+		{
+			name: "no header",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				client.Write(append(append([]byte{}, tt.header...), payload...))
+			}()
+
+			conn, err := readProxyHeader(server, tt.required, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(payload))
+			if _, err = io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Error("Payload was modified")
+			}
+
+			want := tt.want
+			if want == "" {
+				want = server.RemoteAddr().String()
+			}
+			if addr := conn.RemoteAddr().String(); addr != want {
+				t.Errorf("RemoteAddr() = %s, want %s", addr, want)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderRequired(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{"no header", []byte("RFB 003.008\n")},
+		{"invalid v1", []byte("PROXY TCP4 nowhere 10.0.0.1 40000 5900\r\n")},
+		{"unsupported v2 version", append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go client.Write(tt.header)
+
+			if _, err := readProxyHeader(server, true, 100*time.Millisecond); err == nil {
+				t.Error("Connection without valid header accepted")
+			}
+		})
+	}
+}
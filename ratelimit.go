@@ -0,0 +1,165 @@
+package vncd
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/******************************************************************************
+  Connection rate limits
+ ******************************************************************************/
+
+// RateLimit holds the parameters of a ConnectionLimiter. Rates are new
+// connections per second; zero disables the respective limit.
+type RateLimit struct {
+	Global float64 `json:"global"` // rate of all connections
+	PerIP  float64 `json:"perIP"`  // rate of connections from one client IP
+	Burst  int     `json:"burst"`  // connections allowed in excess of the rates
+}
+
+// Validate returns an error if the parameters are out of range
+func (l RateLimit) Validate() error {
+	if l.Global < 0 || l.PerIP < 0 {
+		return errors.New("Rate limits must not be negative")
+	}
+	if l.Burst < 1 && (l.Global > 0 || l.PerIP > 0) {
+		return errors.New("Burst must be at least 1 if a rate limit is set")
+	}
+	return nil
+}
+
+// bucket is a token bucket
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket at rate up to burst and takes a token if available
+func (b *bucket) take(now time.Time, rate float64, burst int) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// maxTrackedIPs bounds the number of per-IP buckets before idle ones are
+// discarded
+const maxTrackedIPs = 10000
+
+// ConnectionLimiter limits the rate of new connections globally and per client
+// IP. The limits can be changed at runtime (see SetLimit and ServeHTTP) and
+// apply to subsequent connections. A nil limiter allows all connections.
+type ConnectionLimiter struct {
+	mux    sync.Mutex
+	limit  RateLimit
+	global bucket
+	perIP  map[string]*bucket
+}
+
+// NewConnectionLimiter creates a limiter with the given limits
+func NewConnectionLimiter(limit RateLimit) (*ConnectionLimiter, error) {
+	l := &ConnectionLimiter{}
+	return l, l.SetLimit(limit)
+}
+
+// Limit returns the current limits
+func (l *ConnectionLimiter) Limit() RateLimit {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.limit
+}
+
+// SetLimit replaces the limits. Buckets start full, so that tightening the
+// limits does not reject clients that have been quiet.
+func (l *ConnectionLimiter) SetLimit(limit RateLimit) error {
+	if err := limit.Validate(); err != nil {
+		return err
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.limit = limit
+	l.global = bucket{tokens: float64(limit.Burst), last: time.Now()}
+	l.perIP = make(map[string]*bucket)
+	return nil
+}
+
+// Allow returns true if a new connection from addr (host:port or host) is
+// within the limits
+func (l *ConnectionLimiter) Allow(addr string) bool {
+	if l == nil {
+		return true
+	}
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		ip = addr
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := time.Now()
+
+	if l.limit.PerIP > 0 {
+		b, ok := l.perIP[ip]
+		if !ok {
+			if len(l.perIP) >= maxTrackedIPs {
+				l.discardIdle(now)
+			}
+			b = &bucket{tokens: float64(l.limit.Burst), last: now}
+			l.perIP[ip] = b
+		}
+		if !b.take(now, l.limit.PerIP, l.limit.Burst) {
+			return false
+		}
+	}
+	if l.limit.Global > 0 && !l.global.take(now, l.limit.Global, l.limit.Burst) {
+		return false
+	}
+	return true
+}
+
+// discardIdle removes the buckets of IPs that have refilled completely, which
+// are equivalent to new buckets
+func (l *ConnectionLimiter) discardIdle(now time.Time) {
+	full := float64(l.limit.Burst) / l.limit.PerIP
+	for ip, b := range l.perIP {
+		if now.Sub(b.last).Seconds() >= full {
+			delete(l.perIP, ip)
+		}
+	}
+}
+
+// ServeHTTP returns the current limits as JSON (GET) or replaces them with the
+// limits in the request body (PUT)
+func (l *ConnectionLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var limit RateLimit
+		if err := json.NewDecoder(r.Body).Decode(&limit); err != nil {
+			http.Error(w, "Invalid rate limit: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := l.SetLimit(limit); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.Limit())
+}
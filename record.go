@@ -0,0 +1,124 @@
+package vncd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// RecordToDir returns a Server.Record function writing each session to a new
+// file in dir, named after the start time and ID of the session
+// (e.g. 20060102T150405Z-<id>.vncrec). Recordings can be read with
+// ReadRecording.
+func RecordToDir(dir string) func(info ConnInfo) (io.WriteCloser, error) {
+	return func(info ConnInfo) (io.WriteCloser, error) {
+		id := strings.Map(func(r rune) rune {
+			if r == '/' || r == os.PathSeparator {
+				return '_'
+			}
+			return r
+		}, info.ID)
+		name := info.Started.UTC().Format("20060102T150405Z") + "-" + id + ".vncrec"
+		return os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	}
+}
+
+// Frame is a chunk of a recorded session as read from one side
+type Frame struct {
+	FromClient bool   // true for client-to-server bytes
+	Data       []byte // the bytes read
+}
+
+// Recording is the raw byte stream of a session in both directions
+type Recording struct {
+	Frames []Frame
+}
+
+// ReadRecording reads a recording written by a Recorder
+func ReadRecording(r io.Reader) (*Recording, error) {
+	rec := &Recording{}
+	br := bufio.NewReader(r)
+	for {
+		dir, err := br.ReadByte()
+		if err == io.EOF {
+			return rec, nil
+		}
+		if err != nil {
+			return rec, err
+		}
+		if dir != 'c' && dir != 's' {
+			return rec, fmt.Errorf("Invalid recording frame direction %q", dir)
+		}
+		var n uint32
+		if err = binary.Read(br, binary.BigEndian, &n); err != nil {
+			return rec, err
+		}
+		data := make([]byte, n)
+		if _, err = io.ReadFull(br, data); err != nil {
+			return rec, err
+		}
+		rec.Frames = append(rec.Frames, Frame{FromClient: dir == 'c', Data: data})
+	}
+}
+
+// Recorder writes both directions of a session to a recording. Each write to
+// Client or Server is stored as one frame, prefixed by its direction ('c' or
+// 's') and its length (uint32, big endian).
+type Recorder struct {
+	w   io.Writer
+	err error
+	mux sync.Mutex
+}
+
+// NewRecorder creates a recorder writing to w
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+// Client returns a writer recording client-to-server bytes
+func (r *Recorder) Client() io.Writer {
+	return recorderSide{r, 'c'}
+}
+
+// Server returns a writer recording server-to-client bytes
+func (r *Recorder) Server() io.Writer {
+	return recorderSide{r, 's'}
+}
+
+// Err returns the first error writing the recording
+func (r *Recorder) Err() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.err
+}
+
+func (r *Recorder) write(dir byte, b []byte) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.err != nil || len(b) == 0 {
+		return
+	}
+	hdr := make([]byte, 5)
+	hdr[0] = dir
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(b)))
+	if _, r.err = r.w.Write(hdr); r.err == nil {
+		_, r.err = r.w.Write(b)
+	}
+}
+
+// recorderSide records one direction of a session. Writes never fail so that
+// a broken recording does not affect the session.
+type recorderSide struct {
+	r   *Recorder
+	dir byte
+}
+
+func (s recorderSide) Write(b []byte) (int, error) {
+	s.r.write(s.dir, b)
+	return len(b), nil
+}
@@ -0,0 +1,240 @@
+package vncd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kramergroup/vncd/backends"
+)
+
+/*
+replayBackend implements a Backend that plays the server side of a recorded
+session. It accepts a single connection, sends the recorded server-to-client
+bytes and expects the recorded client-to-server bytes in between. This allows
+deterministic tests of the proxy without a VNC server.
+*/
+type replayBackend struct {
+	backends.BaseBackend
+	recording *Recording
+	listener  net.Listener
+	done      chan struct{}
+	err       error
+}
+
+// newReplayBackend creates a backend replaying rec on a local port
+func newReplayBackend(t *testing.T, rec *Recording) *replayBackend {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &replayBackend{
+		recording: rec,
+		listener:  l,
+		done:      make(chan struct{}),
+	}
+	go b.serve()
+	return b
+}
+
+func (b *replayBackend) GetTarget() (*net.TCPAddr, error) {
+	return b.listener.Addr().(*net.TCPAddr), nil
+}
+
+func (b *replayBackend) ID() string {
+	return "replay-" + b.listener.Addr().String()
+}
+
+func (b *replayBackend) Terminate() {
+	b.listener.Close()
+}
+
+// Wait blocks until the replay has finished and returns an error if the
+// client did not send the recorded bytes
+func (b *replayBackend) Wait() error {
+	select {
+	case <-b.done:
+		return b.err
+	case <-time.After(5 * time.Second):
+		return errors.New("Replay did not finish")
+	}
+}
+
+func (b *replayBackend) serve() {
+	defer close(b.done)
+
+	conn, err := b.listener.Accept()
+	if err != nil {
+		b.err = err
+		return
+	}
+	defer conn.Close()
+	b.listener.Close()
+
+	for i, f := range b.recording.Frames {
+		if !f.FromClient {
+			if _, err = conn.Write(f.Data); err != nil {
+				b.err = err
+				return
+			}
+			continue
+		}
+		data := make([]byte, len(f.Data))
+		if _, err = io.ReadFull(conn, data); err != nil {
+			b.err = fmt.Errorf("Replay frame %d: %v", i, err)
+			return
+		}
+		if !bytes.Equal(data, f.Data) {
+			b.err = fmt.Errorf("Replay frame %d: client sent %q, recorded %q", i, data, f.Data)
+			return
+		}
+	}
+
+	// The client must not send anything beyond the recording
+	if n, _ := conn.Read(make([]byte, 1)); n > 0 {
+		b.err = errors.New("Client sent more bytes than recorded")
+	}
+}
+
+// syntheticSession is an RFB 3.8 session without authentication up to the
+// first framebuffer update request
+var syntheticSession = &Recording{Frames: []Frame{
+	{FromClient: false, Data: []byte("RFB 003.008\n")},
+	{FromClient: true, Data: []byte("RFB 003.008\n")},
+	{FromClient: false, Data: []byte{1, 1}}, // security type None
+	{FromClient: true, Data: []byte{1}},
+	{FromClient: false, Data: []byte{0, 0, 0, 0}}, // security result OK
+	{FromClient: true, Data: []byte{1}},           // ClientInit (shared)
+	{FromClient: false, Data: []byte{
+		0, 16, 0, 16, // 16x16
+		32, 24, 0, 1, 0, 255, 0, 255, 0, 255, 16, 8, 0, 0, 0, 0, // pixel format
+		0, 0, 0, 4, 't', 'e', 's', 't', // name
+	}},
+	{FromClient: true, Data: []byte{3, 0, 0, 0, 0, 0, 0, 16, 0, 16}}, // FramebufferUpdateRequest
+}}
+
+// bufferCloser records to a buffer and signals when it is closed
+type bufferCloser struct {
+	bytes.Buffer
+	closed chan struct{}
+}
+
+func (b *bufferCloser) Close() error {
+	close(b.closed)
+	return nil
+}
+
+// startServer serves p on a local port and returns its address
+func startServer(t *testing.T, p *Server) string {
+	ln, err := p.listen(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Addr = ln.Addr().(*net.TCPAddr)
+	go p.serve(ln)
+	return ln.Addr().String()
+}
+
+// playClient plays the client side of rec on conn, replacing the data of
+// client frame i by send[i] if present
+func playClient(conn net.Conn, rec *Recording, send map[int][]byte) error {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for i, f := range rec.Frames {
+		if f.FromClient {
+			data := f.Data
+			if s, ok := send[i]; ok {
+				data = s
+			}
+			if _, err := conn.Write(data); err != nil {
+				return err
+			}
+			continue
+		}
+		data := make([]byte, len(f.Data))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return fmt.Errorf("Frame %d: %v", i, err)
+		}
+		if !bytes.Equal(data, f.Data) {
+			return fmt.Errorf("Frame %d: server sent %q, recorded %q", i, data, f.Data)
+		}
+	}
+	return nil
+}
+
+func TestReplayThroughServer(t *testing.T) {
+	tests := []struct {
+		name      string
+		send      map[int][]byte // client frames sent instead of the recorded ones
+		wantError bool
+	}{
+		{name: "recorded session"},
+		{name: "diverging client", send: map[int][]byte{7: {3, 1, 0, 0, 0, 0, 0, 16, 0, 16}}, wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replay := newReplayBackend(t, syntheticSession)
+			recording := &bufferCloser{closed: make(chan struct{})}
+			p, err := NewServer(nil, func() (backends.Backend, error) {
+				return replay, nil
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Record = func(info ConnInfo) (io.WriteCloser, error) {
+				return recording, nil
+			}
+
+			conn, err := net.Dial("tcp", startServer(t, p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientErr := playClient(conn, syntheticSession, tt.send)
+			conn.Close()
+			replayErr := replay.Wait()
+
+			if tt.wantError {
+				if replayErr == nil {
+					t.Error("Replay accepted a diverging client")
+				}
+				return
+			}
+			if clientErr != nil {
+				t.Fatal(clientErr)
+			}
+			if replayErr != nil {
+				t.Fatal(replayErr)
+			}
+
+			// The recording of the proxy holds the same bytes in both directions
+			select {
+			case <-recording.closed:
+			case <-time.After(15 * time.Second):
+				t.Fatal("Recording was not closed")
+			}
+			rec, err := ReadRecording(&recording.Buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, fromClient := range []bool{true, false} {
+				if got, want := joinFrames(rec, fromClient), joinFrames(syntheticSession, fromClient); !bytes.Equal(got, want) {
+					t.Errorf("Recorded %q (from client: %t), want %q", got, fromClient, want)
+				}
+			}
+		})
+	}
+}
+
+// joinFrames concatenates the data of the frames of rec in one direction
+func joinFrames(rec *Recording, fromClient bool) []byte {
+	var b []byte
+	for _, f := range rec.Frames {
+		if f.FromClient == fromClient {
+			b = append(b, f.Data...)
+		}
+	}
+	return b
+}
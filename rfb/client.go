@@ -0,0 +1,331 @@
+package rfb
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// Client-to-server message types
+const (
+	SetPixelFormat           = 0
+	SetEncodings             = 2
+	FramebufferUpdateRequest = 3
+	KeyEvent                 = 4
+	PointerEvent             = 5
+	ClientCutText            = 6
+	EnableContinuousUpdates  = 150
+	XvpClientMessage         = 250
+	SetDesktopSize           = 251
+)
+
+// States of the client stream
+const (
+	stateVersion = iota
+	stateSecurity
+	stateVNCAuth
+	stateClientInit
+	stateMessages
+	stateUnknown // message boundaries can no longer be determined
+)
+
+/******************************************************************************
+  Client stream
+ ******************************************************************************/
+
+// ClientStream tracks message boundaries in the client-to-server byte stream of
+// a connection, starting with the client's ProtocolVersion. The stream is fed
+// in chunks as read from the connection; messages may span several chunks.
+//
+// Only the security types 'none' and 'VNC authentication' can be followed.
+// Once the stream contains something that cannot be parsed (e.g. an unknown
+// message type or an RFB 3.3 client, whose security type is decided by the
+// server), tracking stops and Scan reports no further messages.
+type ClientStream struct {
+	state    int
+	hdr      []byte // bytes of the current message up to the end of its header
+	remain   int    // bytes of the current message still to come after its header
+	security byte   // security type selected by the client
+	bpp      int    // bits per pixel requested with SetPixelFormat
+}
+
+// SecurityType returns the security type the client selected, or
+// SecurityInvalid if it has not selected one (yet)
+func (s *ClientStream) SecurityType() byte {
+	return s.security
+}
+
+// BitsPerPixel returns the bits per pixel of the last SetPixelFormat message,
+// or 0 if the client has not sent one
+func (s *ClientStream) BitsPerPixel() int {
+	return s.bpp
+}
+
+// Scan feeds the next chunk of the stream and calls fn for every message
+// whose header completes within b. start and end are the offsets of the
+// message in b; start is negative if the message began in an earlier chunk
+// and end is larger than len(b) if it continues in a later one. fn may be nil.
+func (s *ClientStream) Scan(b []byte, fn func(msgType byte, start, end int)) {
+	i := 0
+	for i < len(b) {
+		if s.remain > 0 {
+			n := s.remain
+			if n > len(b)-i {
+				n = len(b) - i
+			}
+			s.remain -= n
+			i += n
+			continue
+		}
+		if s.state == stateUnknown {
+			return
+		}
+
+		// Collect the header. Its length may depend on its first bytes.
+		need := s.headerLen()
+		for len(s.hdr) < need && i < len(b) {
+			s.hdr = append(s.hdr, b[i])
+			i++
+			need = s.headerLen()
+		}
+		if len(s.hdr) < need {
+			return // header continues in the next chunk
+		}
+
+		total := s.messageLen()
+		s.remain = total - len(s.hdr)
+		if s.state == stateMessages && fn != nil {
+			start := i - len(s.hdr)
+			fn(s.hdr[0], start, start+total)
+		}
+		s.advance()
+		s.hdr = s.hdr[:0]
+	}
+}
+
+// atMessageBoundary returns true if the stream is between two messages of the
+// normal protocol
+func (s *ClientStream) atMessageBoundary() bool {
+	return s.state == stateMessages && len(s.hdr) == 0 && s.remain == 0
+}
+
+// headerLen returns the number of bytes required to determine the length of
+// the current message
+func (s *ClientStream) headerLen() int {
+	switch s.state {
+	case stateVersion:
+		return 12
+	case stateSecurity, stateClientInit:
+		return 1
+	case stateVNCAuth:
+		return 16
+	}
+
+	if len(s.hdr) == 0 {
+		return 1
+	}
+	switch s.hdr[0] {
+	case SetPixelFormat:
+		return 20
+	case SetEncodings, XvpClientMessage:
+		return 4
+	case FramebufferUpdateRequest, EnableContinuousUpdates:
+		return 10
+	case KeyEvent, ClientCutText, SetDesktopSize:
+		return 8
+	case PointerEvent:
+		return 6
+	}
+	return 1 // unknown message type
+}
+
+// messageLen returns the total length of the current message once its header
+// is complete
+func (s *ClientStream) messageLen() int {
+	if s.state != stateMessages {
+		return len(s.hdr)
+	}
+	switch s.hdr[0] {
+	case SetEncodings:
+		return 4 + 4*int(binary.BigEndian.Uint16(s.hdr[2:4]))
+	case ClientCutText:
+		return 8 + int(binary.BigEndian.Uint32(s.hdr[4:8]))
+	case SetDesktopSize:
+		return 8 + 16*int(s.hdr[6])
+	}
+	return len(s.hdr)
+}
+
+// advance moves to the state following the current (complete) header
+func (s *ClientStream) advance() {
+	switch s.state {
+	case stateVersion:
+		s.state = stateUnknown
+		v, err := ParseVersion(s.hdr)
+		if err == nil && !v.Normalize().Less(Version37) {
+			s.state = stateSecurity
+		}
+	case stateSecurity:
+		s.security = s.hdr[0]
+		switch s.hdr[0] {
+		case SecurityNone:
+			s.state = stateClientInit
+		case SecurityVNCAuth:
+			s.state = stateVNCAuth
+		default:
+			s.state = stateUnknown
+		}
+	case stateVNCAuth:
+		s.state = stateClientInit
+	case stateClientInit:
+		s.state = stateMessages
+	case stateMessages:
+		if s.hdr[0] == SetPixelFormat {
+			s.bpp = int(s.hdr[4])
+		}
+		if s.headerLen() == 1 {
+			s.state = stateUnknown // all known messages are longer
+		}
+	}
+}
+
+/******************************************************************************
+  Update request limiter
+ ******************************************************************************/
+
+// UpdateRequestLimiter caps the rate of FramebufferUpdateRequest messages a
+// client sends to the server. Requests exceeding the rate are held back rather
+// than delaying the stream, so that key and pointer events pass immediately.
+// Held back requests are coalesced into one, which Flush sends once the rate
+// allows it. Requests are never dropped outright, as clients usually wait for
+// an update before requesting the next one.
+//
+// All client bytes must be written to the server through Write, starting with
+// the ProtocolVersion, so that the limiter knows the message boundaries.
+type UpdateRequestLimiter struct {
+	interval time.Duration
+	next     time.Time
+	pending  []byte // request held back
+	stream   ClientStream
+	mux      sync.Mutex
+}
+
+// NewUpdateRequestLimiter returns a limiter forwarding at most rate
+// FramebufferUpdateRequest messages per second
+func NewUpdateRequestLimiter(rate float64) *UpdateRequestLimiter {
+	return &UpdateRequestLimiter{
+		interval: time.Duration(float64(time.Second) / rate),
+	}
+}
+
+// Interval returns the minimum time between two requests
+func (l *UpdateRequestLimiter) Interval() time.Duration {
+	return l.interval
+}
+
+// Write writes client bytes to the server w, holding back requests that
+// exceed the rate
+func (l *UpdateRequestLimiter) Write(w io.Writer, b []byte) (int, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	type span struct{ start, end int }
+	var requests []span
+	l.stream.Scan(b, func(msgType byte, start, end int) {
+		if msgType == FramebufferUpdateRequest && start >= 0 && end <= len(b) {
+			requests = append(requests, span{start, end})
+		}
+	})
+
+	out := b
+	if len(requests) > 0 {
+		out = make([]byte, 0, len(b))
+		last := 0
+		for _, r := range requests {
+			now := time.Now()
+			if l.pending == nil && !l.next.After(now) {
+				l.next = now.Add(l.interval)
+				continue
+			}
+			l.hold(b[r.start:r.end])
+			out = append(out, b[last:r.start]...)
+			last = r.end
+		}
+		out = append(out, b[last:]...)
+	}
+	if _, err := w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// hold coalesces req with the request held back. A non-incremental request
+// asks for the whole area and is kept over incremental ones.
+func (l *UpdateRequestLimiter) hold(req []byte) {
+	if l.pending == nil || req[1] == 0 || l.pending[1] != 0 {
+		l.pending = append(l.pending[:0], req...)
+	}
+}
+
+// Flush writes the request held back to the server w once the rate allows it
+// and the stream is at a message boundary. It returns true if a request has
+// been written.
+func (l *UpdateRequestLimiter) Flush(w io.Writer) (bool, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := time.Now()
+	if l.pending == nil || l.next.After(now) || !l.stream.atMessageBoundary() {
+		return false, nil
+	}
+	l.next = now.Add(l.interval)
+	_, err := w.Write(l.pending)
+	l.pending = nil
+	return err == nil, err
+}
+
+/******************************************************************************
+  Keepalive
+ ******************************************************************************/
+
+// Keepalive injects incremental FramebufferUpdateRequest messages into the
+// client-to-server stream of an idle connection, which keeps servers engaged
+// that disconnect idle clients. A request is only injected between two client
+// messages, so that the stream stays intact when the client resumes.
+//
+// All client bytes must be written to the server through Write, starting with
+// the ProtocolVersion, so that the keepalive knows the message boundaries.
+type Keepalive struct {
+	mux    sync.Mutex
+	stream ClientStream
+	last   time.Time // time of the last write
+}
+
+// NewKeepalive creates a keepalive for a new connection
+func NewKeepalive() *Keepalive {
+	return &Keepalive{last: time.Now()}
+}
+
+// Write writes client bytes to the server w
+func (k *Keepalive) Write(w io.Writer, b []byte) (int, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.stream.Scan(b, nil)
+	k.last = time.Now()
+	return w.Write(b)
+}
+
+// Inject writes a request for a single pixel to the server w if nothing has
+// been written for idle and the stream is at a message boundary. It returns
+// true if a request has been written.
+func (k *Keepalive) Inject(w io.Writer, idle time.Duration) (bool, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if time.Since(k.last) < idle || !k.stream.atMessageBoundary() {
+		return false, nil
+	}
+	k.last = time.Now()
+	req := []byte{FramebufferUpdateRequest, 1, 0, 0, 0, 0, 0, 1, 0, 1}
+	_, err := w.Write(req)
+	return err == nil, err
+}
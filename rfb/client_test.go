@@ -0,0 +1,209 @@
+package rfb
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+var (
+	// clientHandshake is what an RFB 3.8 client without authentication sends
+	// before its first message
+	clientHandshake = []byte("RFB 003.008\n\x01\x01")
+
+	incrementalRequest = []byte{FramebufferUpdateRequest, 1, 0, 0, 0, 0, 0, 16, 0, 16}
+	fullRequest        = []byte{FramebufferUpdateRequest, 0, 0, 0, 0, 0, 0, 16, 0, 16}
+	keyEvent           = []byte{KeyEvent, 1, 0, 0, 0, 0, 0, 'a'}
+)
+
+// join concatenates messages
+func join(msgs ...[]byte) []byte {
+	return bytes.Join(msgs, nil)
+}
+
+func TestUpdateRequestLimiterWrite(t *testing.T) {
+	tests := []struct {
+		name        string
+		writes      [][]byte // written after the handshake
+		want        []byte   // passed on to the server
+		wantPending []byte   // request held back
+	}{
+		{
+			name:   "first request passes",
+			writes: [][]byte{incrementalRequest},
+			want:   incrementalRequest,
+		},
+		{
+			name:        "excess request held back",
+			writes:      [][]byte{incrementalRequest, incrementalRequest},
+			want:        incrementalRequest,
+			wantPending: incrementalRequest,
+		},
+		{
+			name:        "events pass while requests are held back",
+			writes:      [][]byte{join(incrementalRequest, incrementalRequest, keyEvent), keyEvent},
+			want:        join(incrementalRequest, keyEvent, keyEvent),
+			wantPending: incrementalRequest,
+		},
+		{
+			name:        "full request kept over incremental ones",
+			writes:      [][]byte{incrementalRequest, join(incrementalRequest, fullRequest, incrementalRequest)},
+			want:        incrementalRequest,
+			wantPending: fullRequest,
+		},
+		{
+			name:        "latest incremental request kept",
+			writes:      [][]byte{fullRequest, incrementalRequest, join(incrementalRequest[:1], []byte{1, 0, 1, 0, 1, 0, 8, 0, 8})},
+			want:        fullRequest,
+			wantPending: []byte{FramebufferUpdateRequest, 1, 0, 1, 0, 1, 0, 8, 0, 8},
+		},
+		{
+			name:   "request split across writes passes",
+			writes: [][]byte{fullRequest, incrementalRequest[:4], incrementalRequest[4:]},
+			want:   join(fullRequest, incrementalRequest),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewUpdateRequestLimiter(1)
+			var server bytes.Buffer
+			if _, err := l.Write(&server, clientHandshake); err != nil {
+				t.Fatal(err)
+			}
+			server.Reset()
+
+			for _, b := range tt.writes {
+				n, err := l.Write(&server, b)
+				if err != nil || n != len(b) {
+					t.Fatalf("Write() = %d, %v, want %d", n, err, len(b))
+				}
+			}
+			if !bytes.Equal(server.Bytes(), tt.want) {
+				t.Errorf("Server received %v, want %v", server.Bytes(), tt.want)
+			}
+			if !bytes.Equal(l.pending, tt.wantPending) {
+				t.Errorf("Held back %v, want %v", l.pending, tt.wantPending)
+			}
+		})
+	}
+}
+
+func TestUpdateRequestLimiterFlush(t *testing.T) {
+	l := NewUpdateRequestLimiter(20)
+	var server bytes.Buffer
+	l.Write(&server, join(clientHandshake, incrementalRequest, fullRequest))
+	server.Reset()
+
+	// Nothing is sent before the interval has passed
+	if ok, err := l.Flush(&server); ok || err != nil || server.Len() > 0 {
+		t.Fatalf("Flush() = %t, %v before the interval, sent %v", ok, err, server.Bytes())
+	}
+
+	time.Sleep(l.Interval())
+	if ok, err := l.Flush(&server); !ok || err != nil {
+		t.Fatalf("Flush() = %t, %v after the interval", ok, err)
+	}
+	if !bytes.Equal(server.Bytes(), fullRequest) {
+		t.Errorf("Flush() sent %v, want %v", server.Bytes(), fullRequest)
+	}
+
+	// The flushed request counts towards the rate
+	server.Reset()
+	l.Write(&server, incrementalRequest)
+	if server.Len() > 0 {
+		t.Errorf("Request after Flush() passed within the interval")
+	}
+}
+
+func TestKeepaliveInject(t *testing.T) {
+	const idle = 20 * time.Millisecond
+	cutText := []byte{ClientCutText, 0, 0, 0, 0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o'}
+	keepaliveRequest := []byte{FramebufferUpdateRequest, 1, 0, 0, 0, 0, 0, 1, 0, 1}
+	tests := []struct {
+		name       string
+		writes     [][]byte // written by the client before it goes quiet
+		wait       time.Duration
+		wantInject bool
+	}{
+		{
+			name:       "idle after handshake",
+			wait:       2 * idle,
+			wantInject: true,
+		},
+		{
+			name:       "idle after message",
+			writes:     [][]byte{keyEvent},
+			wait:       2 * idle,
+			wantInject: true,
+		},
+		{
+			name:   "not idle yet",
+			writes: [][]byte{keyEvent},
+		},
+		{
+			name:   "idle within a split ClientCutText",
+			writes: [][]byte{cutText[:10]},
+			wait:   2 * idle,
+		},
+		{
+			name:       "idle after a split ClientCutText",
+			writes:     [][]byte{cutText[:3], cutText[3:10], cutText[10:]},
+			wait:       2 * idle,
+			wantInject: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := NewKeepalive()
+			var server bytes.Buffer
+			k.Write(&server, clientHandshake)
+			for _, b := range tt.writes {
+				if n, err := k.Write(&server, b); err != nil || n != len(b) {
+					t.Fatalf("Write() = %d, %v, want %d", n, err, len(b))
+				}
+			}
+			sent := server.Len()
+
+			time.Sleep(tt.wait)
+			ok, err := k.Inject(&server, idle)
+			if err != nil || ok != tt.wantInject {
+				t.Fatalf("Inject() = %t, %v, want %t", ok, err, tt.wantInject)
+			}
+			var want []byte
+			if tt.wantInject {
+				want = keepaliveRequest
+			}
+			if injected := server.Bytes()[sent:]; !bytes.Equal(injected, want) {
+				t.Errorf("Injected %v, want %v", injected, want)
+			}
+		})
+	}
+}
+
+func TestKeepaliveTraffic(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	k := NewKeepalive()
+	var server bytes.Buffer
+	k.Write(&server, clientHandshake)
+
+	// Nothing is injected while the client keeps sending
+	for i := 0; i < 10; i++ {
+		time.Sleep(idle / 10)
+		k.Write(&server, keyEvent)
+		if ok, err := k.Inject(&server, idle); ok || err != nil {
+			t.Fatalf("Inject() = %t, %v while the client is active", ok, err)
+		}
+	}
+	if want := join(clientHandshake, bytes.Repeat(keyEvent, 10)); !bytes.Equal(server.Bytes(), want) {
+		t.Errorf("Server received %v, want %v", server.Bytes(), want)
+	}
+
+	// An injected request restarts the interval
+	time.Sleep(idle)
+	if ok, _ := k.Inject(&server, idle); !ok {
+		t.Fatal("Inject() = false after the client went quiet")
+	}
+	if ok, _ := k.Inject(&server, idle); ok {
+		t.Error("Inject() = true right after an injected request")
+	}
+}
@@ -0,0 +1,299 @@
+/*
+Package rfb implements the parts of the RFB (VNC) protocol the proxy needs to
+take part in the connection handshake between a client and a backend.
+
+See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst for the
+protocol specification.
+*/
+package rfb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Security types used during the handshake
+const (
+	SecurityInvalid = 0
+	SecurityNone    = 1
+	SecurityVNCAuth = 2
+)
+
+/******************************************************************************
+  Protocol version
+ ******************************************************************************/
+
+// Version is an RFB protocol version
+type Version struct {
+	Major int
+	Minor int
+}
+
+// Protocol versions defined by the RFB specification
+var (
+	Version33 = Version{3, 3}
+	Version37 = Version{3, 7}
+	Version38 = Version{3, 8}
+)
+
+// Less returns true if v is an older protocol version than o
+func (v Version) Less(o Version) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	return v.Minor < o.Minor
+}
+
+// String returns the version as sent on the wire (e.g. "RFB 003.008\n")
+func (v Version) String() string {
+	return fmt.Sprintf("RFB %03d.%03d\n", v.Major, v.Minor)
+}
+
+// Normalize maps v onto one of the versions defined by the specification.
+// Unknown versions newer than 3.8 are treated as 3.8 and any other unknown
+// version as 3.3.
+func (v Version) Normalize() Version {
+	switch {
+	case !v.Less(Version38):
+		return Version38
+	case v == Version37:
+		return Version37
+	default:
+		return Version33
+	}
+}
+
+// ReadVersion reads a ProtocolVersion message from r
+func ReadVersion(r io.Reader) (Version, error) {
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return Version{}, err
+	}
+	return ParseVersion(buf)
+}
+
+// ParseVersion parses a 12-byte ProtocolVersion message
+func ParseVersion(b []byte) (Version, error) {
+	var v Version
+	if _, err := fmt.Sscanf(string(b), "RFB %03d.%03d\n", &v.Major, &v.Minor); err != nil {
+		return v, fmt.Errorf("Invalid RFB protocol version %q", b)
+	}
+	return v, nil
+}
+
+// ParseVersionNumber parses a version number of the form "3.8"
+func ParseVersionNumber(s string) (Version, error) {
+	var v Version
+	if _, err := fmt.Sscanf(s, "%d.%d", &v.Major, &v.Minor); err != nil {
+		return v, fmt.Errorf("Invalid RFB protocol version %q", s)
+	}
+	return v, nil
+}
+
+// WriteVersion writes a ProtocolVersion message for v to w
+func WriteVersion(w io.Writer, v Version) error {
+	_, err := io.WriteString(w, v.String())
+	return err
+}
+
+/******************************************************************************
+  Handshake
+ ******************************************************************************/
+
+// Greet sends the ProtocolVersion offer to the client and returns the
+// (normalized) version the client replies with.
+func Greet(client io.ReadWriter, offer Version) (Version, error) {
+	if err := WriteVersion(client, offer); err != nil {
+		return Version{}, err
+	}
+	v, err := ReadVersion(client)
+	if err != nil {
+		return v, err
+	}
+	v = v.Normalize()
+	if offer.Less(v) {
+		return v, fmt.Errorf("Client requested RFB version %d.%d above offered %d.%d", v.Major, v.Minor, offer.Major, offer.Minor)
+	}
+	return v, nil
+}
+
+// Handshake completes the version exchange with the server for a client that
+// has already been greeted (see Greet) and agreed to clientVersion. The lower
+// of the client and server versions is negotiated with the server. If that is
+// older than clientVersion, the security handshake is translated so that the
+// client continues to see the version it agreed to. On return, both sides are
+// positioned after the security type negotiation and the remaining stream can
+// be relayed unmodified.
+//
+// Errors of the server before anything has been sent to the client are
+// returned as ServerError. The client can still be sent a reason in this case
+// (see WriteFailure).
+func Handshake(client, server io.ReadWriter, clientVersion Version) (Version, error) {
+	serverVersion, err := ReadVersion(server)
+	if err != nil {
+		return serverVersion, ServerError{err}
+	}
+
+	v := serverVersion.Normalize()
+	if clientVersion.Less(v) {
+		v = clientVersion
+	}
+	if err = WriteVersion(server, v); err != nil {
+		return v, ServerError{err}
+	}
+
+	if v.Less(clientVersion) {
+		err = translateSecurity(client, server, clientVersion, v)
+	}
+	return v, err
+}
+
+// RelayVersion performs the version exchange between a client that has not
+// been greeted and the server: the version of the server is offered to the
+// client and the version the client agrees to is passed on to the server, which
+// handles older versions itself. Clients agreeing to a version older than min
+// are refused (see RequireVersion). On return, the remaining stream can be
+// relayed unmodified.
+func RelayVersion(client, server io.ReadWriter, min Version) (Version, error) {
+	serverVersion, err := ReadVersion(server)
+	if err != nil {
+		return serverVersion, ServerError{err}
+	}
+	v, err := Greet(client, serverVersion)
+	if err != nil {
+		return v, err
+	}
+	if err = RequireVersion(client, v, min); err != nil {
+		return v, err
+	}
+	if err = WriteVersion(server, v); err != nil {
+		return v, ServerError{err}
+	}
+	return v, nil
+}
+
+// RequireVersion refuses a client that agreed to a version v older than min by
+// sending it a handshake failure and returns an error. It returns nil if v is
+// recent enough.
+func RequireVersion(client io.Writer, v, min Version) error {
+	if !v.Less(min) {
+		return nil
+	}
+	reason := fmt.Sprintf("RFB version %d.%d is not supported, %d.%d or newer required",
+		v.Major, v.Minor, min.Major, min.Minor)
+	WriteFailure(client, v, reason)
+	return errors.New("Refusing client: " + reason)
+}
+
+// ServerError is a failure of the server during the handshake (e.g. a closed
+// connection) that the client has not been told about
+type ServerError struct {
+	Err error
+}
+
+func (e ServerError) Error() string {
+	return "RFB server failed during handshake: " + e.Err.Error()
+}
+
+// WriteFailure sends a handshake failure with a reason to the client, using the
+// message layout of the security handshake for version v.
+func WriteFailure(w io.Writer, v Version, reason string) error {
+	var msg []byte
+	if v.Less(Version37) {
+		msg = make([]byte, 4) // security type 'invalid'
+	} else {
+		msg = []byte{0} // empty list of security types
+	}
+	msg = append(msg, encodeString(reason)...)
+	_, err := w.Write(msg)
+	return err
+}
+
+// translateSecurity presents the security handshake of a server speaking
+// serverVersion to a client speaking the newer clientVersion
+func translateSecurity(client, server io.ReadWriter, clientVersion, serverVersion Version) error {
+
+	var types []byte
+	if serverVersion.Less(Version37) {
+		// RFB 3.3 - the server decides the security type
+		var secType uint32
+		if err := binary.Read(server, binary.BigEndian, &secType); err != nil {
+			return ServerError{err}
+		}
+		if secType != SecurityInvalid {
+			types = []byte{byte(secType)}
+		}
+	} else {
+		// RFB 3.7 - the list of security types has the same layout
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(server, n); err != nil {
+			return ServerError{err}
+		}
+		types = make([]byte, n[0])
+		if _, err := io.ReadFull(server, types); err != nil {
+			return ServerError{err}
+		}
+	}
+
+	if len(types) == 0 {
+		reason, err := readString(server)
+		if err != nil {
+			return ServerError{err}
+		}
+		if err = WriteFailure(client, clientVersion, reason); err != nil {
+			return err
+		}
+		return fmt.Errorf("Backend refused connection: %s", reason)
+	}
+
+	if _, err := client.Write(append([]byte{byte(len(types))}, types...)); err != nil {
+		return err
+	}
+	choice := make([]byte, 1)
+	if _, err := io.ReadFull(client, choice); err != nil {
+		return err
+	}
+
+	if serverVersion.Less(Version37) {
+		// A 3.3 server does not expect the client's choice
+		if choice[0] != types[0] {
+			return fmt.Errorf("Client selected unsupported security type %d", choice[0])
+		}
+	} else if _, err := server.Write(choice); err != nil {
+		return err
+	}
+
+	// RFB 3.8 sends a SecurityResult for security type 'none', older versions
+	// do not. Complete the handshake on behalf of the server.
+	if choice[0] == SecurityNone && !clientVersion.Less(Version38) {
+		if _, err := client.Write(make([]byte, 4)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readString reads a length-prefixed string (e.g. a failure reason)
+func readString(r io.Reader) (string, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+	if n > 4096 {
+		return "", fmt.Errorf("RFB string too long (%d bytes)", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// encodeString encodes s as a length-prefixed string
+func encodeString(s string) []byte {
+	buf := make([]byte, 4, 4+len(s))
+	binary.BigEndian.PutUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
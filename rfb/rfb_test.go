@@ -0,0 +1,138 @@
+package rfb
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// peer is one side of a connection reading from in and writing to out
+type peer struct {
+	io.Reader
+	io.Writer
+}
+
+func TestRelayVersion(t *testing.T) {
+	tests := []struct {
+		name          string
+		server        string // sent by the server
+		client        string // sent by the client
+		min           Version
+		want          Version
+		wantErr       bool
+		wantServerErr bool
+		wantRefusal   bool // the client is sent a handshake failure
+	}{
+		{
+			name:   "same version",
+			server: "RFB 003.008\n", client: "RFB 003.008\n",
+			want: Version38,
+		},
+		{
+			name:   "older client without minimum",
+			server: "RFB 003.008\n", client: "RFB 003.003\n",
+			want: Version33,
+		},
+		{
+			name:   "client at minimum",
+			server: "RFB 003.008\n", client: "RFB 003.007\n",
+			min:  Version37,
+			want: Version37,
+		},
+		{
+			name:   "client below minimum",
+			server: "RFB 003.008\n", client: "RFB 003.003\n",
+			min:     Version37,
+			want:    Version33,
+			wantErr: true, wantRefusal: true,
+		},
+		{
+			name:   "client above offer",
+			server: "RFB 003.003\n", client: "RFB 003.008\n",
+			want:    Version38,
+			wantErr: true,
+		},
+		{
+			name:   "server closed",
+			server: "", client: "RFB 003.008\n",
+			wantErr: true, wantServerErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var toClient, toServer bytes.Buffer
+			client := peer{bytes.NewBufferString(tt.client), &toClient}
+			server := peer{bytes.NewBufferString(tt.server), &toServer}
+
+			v, err := RelayVersion(client, server, tt.min)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RelayVersion() error = %v, want error %t", err, tt.wantErr)
+			}
+			var serverErr ServerError
+			if errors.As(err, &serverErr) != tt.wantServerErr {
+				t.Errorf("RelayVersion() error = %v, want ServerError %t", err, tt.wantServerErr)
+			}
+			if !tt.wantServerErr && v != tt.want {
+				t.Errorf("RelayVersion() = %v, want %v", v, tt.want)
+			}
+
+			// The server learns the version only if the client is accepted
+			wantServer := ""
+			if !tt.wantErr {
+				wantServer = tt.want.String()
+			}
+			if toServer.String() != wantServer {
+				t.Errorf("Server received %q, want %q", toServer.String(), wantServer)
+			}
+
+			// The client is offered the server version and refused with a reason
+			wantClient := tt.server
+			if tt.wantRefusal {
+				var failure bytes.Buffer
+				RequireVersion(&failure, tt.want, tt.min)
+				wantClient += failure.String()
+			}
+			if toClient.String() != wantClient {
+				t.Errorf("Client received %q, want %q", toClient.String(), wantClient)
+			}
+		})
+	}
+}
+
+func TestRequireVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		v, min      Version
+		wantErr     bool
+		wantFailure []byte // start of the handshake failure sent to the client
+	}{
+		{"no minimum", Version33, Version{}, false, nil},
+		{"newer than minimum", Version38, Version37, false, nil},
+		{"at minimum", Version37, Version37, false, nil},
+		{"3.3 below minimum", Version33, Version37, true, []byte{0, 0, 0, 0}},
+		{"3.7 below minimum", Version37, Version38, true, []byte{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var client bytes.Buffer
+			err := RequireVersion(&client, tt.v, tt.min)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RequireVersion() error = %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				if client.Len() > 0 {
+					t.Errorf("Client sent %q", client.Bytes())
+				}
+				return
+			}
+			if !bytes.HasPrefix(client.Bytes(), tt.wantFailure) {
+				t.Fatalf("Client sent %v, want failure starting with %v", client.Bytes(), tt.wantFailure)
+			}
+			reason, err := readString(bytes.NewReader(client.Bytes()[len(tt.wantFailure):]))
+			if err != nil || reason == "" {
+				t.Errorf("Client sent no reason: %q, %v", reason, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,421 @@
+package rfb
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// Server-to-client message types
+const (
+	FramebufferUpdate   = 0
+	SetColourMapEntries = 1
+	Bell                = 2
+	ServerCutText       = 3
+)
+
+// Encodings of framebuffer update rectangles
+const (
+	EncodingRaw                 = 0
+	EncodingCopyRect            = 1
+	EncodingRRE                 = 2
+	EncodingHextile             = 5
+	EncodingZRLE                = 16
+	EncodingCursor              = -239
+	EncodingDesktopSize         = -223
+	EncodingLastRect            = -224
+	EncodingExtendedDesktopSize = -308
+)
+
+// Hextile subencoding flags
+const (
+	hextileRaw                 = 1
+	hextileBackgroundSpecified = 2
+	hextileForegroundSpecified = 4
+	hextileAnySubrects         = 8
+	hextileSubrectsColoured    = 16
+)
+
+/******************************************************************************
+  Server stream
+ ******************************************************************************/
+
+// serverStream tracks message boundaries in the server-to-client byte stream
+// of a connection, starting with the server's ProtocolVersion. Like
+// ClientStream, it is fed in chunks as read from the connection.
+//
+// Framebuffer updates can only be followed for the encodings Raw, CopyRect,
+// RRE, Hextile and ZRLE and a few pseudo-encodings. Other encodings stop the
+// tracking, as their length cannot be determined without decoding them.
+type serverStream struct {
+	buf    []byte                      // bytes collected for the next step
+	need   int                         // bytes to collect before calling next
+	skip   int                         // bytes to discard before collecting
+	next   func(s *serverStream) error // parses buf; nil once tracking stopped
+	client *ClientStream               // the other direction of the connection
+
+	version Version
+	bpp     int // bits per pixel announced in ServerInit
+
+	rects          int  // rectangles left in the current update
+	untilLastRect  bool // the update is terminated by a LastRect rectangle
+	tilesX, tilesY int  // hextile tiles of the current rectangle
+	tile           int  // current hextile tile
+	width, height  int  // size of the current rectangle
+
+	cutText    func(text []byte) // receives ServerCutText messages
+	maxCutText int               // longer texts are truncated
+	textLen    int               // length of the text being collected
+}
+
+// scan feeds the next chunk of the stream
+func (s *serverStream) scan(b []byte) {
+	i := 0
+	for i < len(b) && s.next != nil {
+		if s.skip > 0 {
+			n := s.skip
+			if n > len(b)-i {
+				n = len(b) - i
+			}
+			s.skip -= n
+			i += n
+			continue
+		}
+
+		n := s.need - len(s.buf)
+		if n > len(b)-i {
+			n = len(b) - i
+		}
+		s.buf = append(s.buf, b[i:i+n]...)
+		i += n
+		if len(s.buf) < s.need {
+			return // continues in the next chunk
+		}
+
+		// Steps expecting no bytes run once the next chunk arrives, i.e.
+		// after the client has answered what the server sent so far
+		if err := s.next(s); err != nil {
+			s.next = nil
+		}
+	}
+}
+
+// expect collects n bytes and then calls next
+func (s *serverStream) expect(n int, next func(s *serverStream) error) error {
+	s.buf = s.buf[:0]
+	s.need = n
+	s.next = next
+	return nil
+}
+
+// discard skips n bytes and then continues with next
+func (s *serverStream) discard(n int, next func(s *serverStream) error) error {
+	s.skip = n
+	return next(s)
+}
+
+// stop ends the tracking
+func (s *serverStream) stop() error {
+	return errUntrackable
+}
+
+// bytesPerPixel returns the current pixel size, preferring the format most
+// recently requested by the client
+func (s *serverStream) bytesPerPixel() int {
+	if s.client != nil && s.client.BitsPerPixel() > 0 {
+		return s.client.BitsPerPixel() / 8
+	}
+	return s.bpp / 8
+}
+
+type streamError string
+
+func (e streamError) Error() string { return string(e) }
+
+const errUntrackable = streamError("RFB stream cannot be tracked")
+
+/******************************************************************************
+  Handshake
+ ******************************************************************************/
+
+func (s *serverStream) init() {
+	s.expect(12, readServerVersion)
+}
+
+func readServerVersion(s *serverStream) error {
+	v, err := ParseVersion(s.buf)
+	if err != nil {
+		return err
+	}
+	s.version = v.Normalize()
+	if s.version.Less(Version37) {
+		return s.expect(4, readSecurityType33)
+	}
+	return s.expect(1, readSecurityTypeCount)
+}
+
+// readSecurityType33 reads the security type decided by an RFB 3.3 server
+func readSecurityType33(s *serverStream) error {
+	return s.security(byte(binary.BigEndian.Uint32(s.buf)))
+}
+
+func readSecurityTypeCount(s *serverStream) error {
+	if s.buf[0] == 0 {
+		return s.stop() // connection failed
+	}
+	return s.expect(int(s.buf[0]), readSecurityTypes)
+}
+
+// readSecurityTypes reads the types offered by the server and continues with
+// the type the client selected. The client has sent its choice before the
+// server responds to it, so it is known when the next bytes arrive.
+func readSecurityTypes(s *serverStream) error {
+	return s.expect(0, func(s *serverStream) error {
+		if s.client == nil {
+			return s.stop()
+		}
+		return s.security(s.client.SecurityType())
+	})
+}
+
+func (s *serverStream) security(secType byte) error {
+	switch secType {
+	case SecurityNone:
+		if s.version.Less(Version38) {
+			return s.expect(24, readServerInit)
+		}
+		return s.expect(4, readSecurityResult)
+	case SecurityVNCAuth:
+		return s.discard(16, func(s *serverStream) error {
+			return s.expect(4, readSecurityResult)
+		})
+	}
+	return s.stop()
+}
+
+func readSecurityResult(s *serverStream) error {
+	if binary.BigEndian.Uint32(s.buf) != 0 {
+		return s.stop() // authentication failed
+	}
+	return s.expect(24, readServerInit)
+}
+
+func readServerInit(s *serverStream) error {
+	s.bpp = int(s.buf[4])
+	nameLen := int(binary.BigEndian.Uint32(s.buf[20:24]))
+	return s.discard(nameLen, func(s *serverStream) error {
+		return s.expect(1, readMessageType)
+	})
+}
+
+/******************************************************************************
+  Messages
+ ******************************************************************************/
+
+func readMessageType(s *serverStream) error {
+	switch s.buf[0] {
+	case FramebufferUpdate:
+		return s.expect(3, readFramebufferUpdate)
+	case SetColourMapEntries:
+		return s.expect(5, readColourMapEntries)
+	case Bell:
+		return s.expect(1, readMessageType)
+	case ServerCutText:
+		return s.expect(7, readCutTextHeader)
+	}
+	return s.stop()
+}
+
+func (s *serverStream) nextMessage() error {
+	return s.expect(1, readMessageType)
+}
+
+func readColourMapEntries(s *serverStream) error {
+	n := int(binary.BigEndian.Uint16(s.buf[3:5]))
+	return s.discard(6*n, (*serverStream).nextMessage)
+}
+
+func readCutTextHeader(s *serverStream) error {
+	length := int32(binary.BigEndian.Uint32(s.buf[3:7]))
+	if length < 0 {
+		// Extended clipboard message (negative length) - not plain text
+		return s.discard(int(-length), (*serverStream).nextMessage)
+	}
+	s.textLen = int(length)
+	n := s.textLen
+	if n > s.maxCutText {
+		n = s.maxCutText
+	}
+	return s.expect(n, readCutText)
+}
+
+func readCutText(s *serverStream) error {
+	if s.cutText != nil {
+		text := make([]byte, len(s.buf))
+		copy(text, s.buf)
+		s.cutText(text)
+	}
+	return s.discard(s.textLen-len(s.buf), (*serverStream).nextMessage)
+}
+
+/******************************************************************************
+  Framebuffer updates
+ ******************************************************************************/
+
+func readFramebufferUpdate(s *serverStream) error {
+	s.rects = int(binary.BigEndian.Uint16(s.buf[1:3]))
+	s.untilLastRect = s.rects == 0xFFFF
+	return s.nextRect()
+}
+
+func (s *serverStream) nextRect() error {
+	if s.rects == 0 && !s.untilLastRect {
+		return s.nextMessage()
+	}
+	s.rects--
+	return s.expect(12, readRectHeader)
+}
+
+func readRectHeader(s *serverStream) error {
+	s.width = int(binary.BigEndian.Uint16(s.buf[4:6]))
+	s.height = int(binary.BigEndian.Uint16(s.buf[6:8]))
+	encoding := int32(binary.BigEndian.Uint32(s.buf[8:12]))
+	bypp := s.bytesPerPixel()
+	if bypp == 0 {
+		return s.stop()
+	}
+
+	switch encoding {
+	case EncodingRaw:
+		return s.discard(s.width*s.height*bypp, (*serverStream).nextRect)
+	case EncodingCopyRect:
+		return s.discard(4, (*serverStream).nextRect)
+	case EncodingRRE:
+		return s.expect(4+bypp, readRRE)
+	case EncodingHextile:
+		s.tilesX = (s.width + 15) / 16
+		s.tilesY = (s.height + 15) / 16
+		s.tile = 0
+		return s.nextTile()
+	case EncodingZRLE:
+		return s.expect(4, readZRLE)
+	case EncodingCursor:
+		mask := (s.width + 7) / 8 * s.height
+		return s.discard(s.width*s.height*bypp+mask, (*serverStream).nextRect)
+	case EncodingDesktopSize:
+		return s.nextRect()
+	case EncodingLastRect:
+		s.rects, s.untilLastRect = 0, false
+		return s.nextMessage()
+	case EncodingExtendedDesktopSize:
+		return s.expect(4, readExtendedDesktopSize)
+	}
+	return s.stop()
+}
+
+func readRRE(s *serverStream) error {
+	n := int(binary.BigEndian.Uint32(s.buf[0:4]))
+	return s.discard(n*(s.bytesPerPixel()+8), (*serverStream).nextRect)
+}
+
+func readZRLE(s *serverStream) error {
+	n := int(binary.BigEndian.Uint32(s.buf[0:4]))
+	return s.discard(n, (*serverStream).nextRect)
+}
+
+func readExtendedDesktopSize(s *serverStream) error {
+	return s.discard(16*int(s.buf[0]), (*serverStream).nextRect)
+}
+
+func (s *serverStream) nextTile() error {
+	if s.tile == s.tilesX*s.tilesY {
+		return s.nextRect()
+	}
+	return s.expect(1, readTile)
+}
+
+// tileSize returns the size of the current hextile tile
+func (s *serverStream) tileSize() (int, int) {
+	w, h := 16, 16
+	if x := s.tile % s.tilesX; x == s.tilesX-1 && s.width%16 != 0 {
+		w = s.width % 16
+	}
+	if y := s.tile / s.tilesX; y == s.tilesY-1 && s.height%16 != 0 {
+		h = s.height % 16
+	}
+	return w, h
+}
+
+func readTile(s *serverStream) error {
+	subenc := s.buf[0]
+	bypp := s.bytesPerPixel()
+	w, h := s.tileSize()
+	s.tile++
+
+	if subenc&hextileRaw != 0 {
+		return s.discard(w*h*bypp, (*serverStream).nextTile)
+	}
+
+	n := 0
+	if subenc&hextileBackgroundSpecified != 0 {
+		n += bypp
+	}
+	if subenc&hextileForegroundSpecified != 0 {
+		n += bypp
+	}
+	if subenc&hextileAnySubrects == 0 {
+		return s.discard(n, (*serverStream).nextTile)
+	}
+
+	// The number of subrects follows the colours
+	return s.discard(n, func(s *serverStream) error {
+		return s.expect(1, func(s *serverStream) error {
+			size := 2
+			if subenc&hextileSubrectsColoured != 0 {
+				size += bypp
+			}
+			return s.discard(int(s.buf[0])*size, (*serverStream).nextTile)
+		})
+	})
+}
+
+/******************************************************************************
+  Cut text tap
+ ******************************************************************************/
+
+// CutTextTap extracts the text of ServerCutText messages (the server's
+// clipboard) from a connection without modifying it. It must be fed both
+// directions of the connection as exchanged with the server, starting with
+// the handshake.
+//
+// The tap gives up silently if the server stream cannot be followed (see
+// serverStream), in which case no further texts are reported.
+type CutTextTap struct {
+	mux    sync.Mutex
+	client ClientStream
+	server serverStream
+}
+
+// NewCutTextTap creates a tap passing texts of up to maxLen bytes to sink.
+// Longer texts are truncated.
+func NewCutTextTap(maxLen int, sink func(text []byte)) *CutTextTap {
+	t := &CutTextTap{}
+	t.server.client = &t.client
+	t.server.cutText = sink
+	t.server.maxCutText = maxLen
+	t.server.init()
+	return t
+}
+
+// ObserveClient feeds bytes sent to the server
+func (t *CutTextTap) ObserveClient(b []byte) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.client.Scan(b, nil)
+}
+
+// ObserveServer feeds bytes received from the server
+func (t *CutTextTap) ObserveServer(b []byte) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.server.scan(b)
+}
@@ -0,0 +1,111 @@
+package rfb
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// serverHandshake is what an RFB 3.8 server without authentication sends
+// before the security type is selected (offer) and afterwards (init): a
+// 32 bpp ServerInit with the desktop name "vnc"
+var (
+	serverOffer = []byte("RFB 003.008\n\x01\x01")
+	serverInit  = join(
+		[]byte{0, 0, 0, 0}, // security result
+		[]byte{0, 16, 0, 16, 32, 24, 0, 1, 0, 255, 0, 255, 0, 255, 16, 8, 0, 0, 0, 0},
+		[]byte{0, 0, 0, 3}, []byte("vnc"),
+	)
+)
+
+// cutText returns a ServerCutText message with the given length field and text
+func cutText(length int32, text string) []byte {
+	msg := []byte{ServerCutText, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[4:], uint32(length))
+	return append(msg, text...)
+}
+
+// rawUpdate is a FramebufferUpdate with a single 2x2 raw rectangle at 32 bpp
+var rawUpdate = join(
+	[]byte{FramebufferUpdate, 0, 0, 1},
+	[]byte{0, 0, 0, 0, 0, 2, 0, 2, 0, 0, 0, EncodingRaw},
+	make([]byte, 2*2*4),
+)
+
+func TestCutTextTap(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []byte // sent by the server after ServerInit
+		maxLen   int
+		want     []string
+	}{
+		{
+			name:     "text",
+			messages: cutText(5, "hello"),
+			maxLen:   100,
+			want:     []string{"hello"},
+		},
+		{
+			name:     "texts between other messages",
+			messages: join(rawUpdate, cutText(5, "hello"), []byte{Bell}, cutText(5, "world")),
+			maxLen:   100,
+			want:     []string{"hello", "world"},
+		},
+		{
+			name:     "empty text reported with the next message",
+			messages: join(cutText(0, ""), []byte{Bell}),
+			maxLen:   100,
+			want:     []string{""},
+		},
+		{
+			name:     "oversized text cut at the limit",
+			messages: join(cutText(9, "clipboard"), cutText(2, "ok")),
+			maxLen:   4,
+			want:     []string{"clip", "ok"},
+		},
+		{
+			name:     "text at the limit",
+			messages: cutText(4, "clip"),
+			maxLen:   4,
+			want:     []string{"clip"},
+		},
+		{
+			name:     "extended clipboard skipped",
+			messages: join(cutText(-4, "\x00\x00\x00\x01"), cutText(2, "ok")),
+			maxLen:   100,
+			want:     []string{"ok"},
+		},
+		{
+			name:     "untrackable encoding",
+			messages: join([]byte{FramebufferUpdate, 0, 0, 1}, []byte{0, 0, 0, 0, 0, 2, 0, 2, 0, 0, 0, 7}, cutText(2, "ok")),
+			maxLen:   100,
+		},
+	}
+	for _, tt := range tests {
+		for _, chunk := range []int{1, 3, 1 << 16} {
+			var got []string
+			tap := NewCutTextTap(tt.maxLen, func(text []byte) {
+				got = append(got, string(text))
+			})
+
+			// The server's messages are split across several writes
+			feed := func(b []byte) {
+				for len(b) > 0 {
+					n := chunk
+					if n > len(b) {
+						n = len(b)
+					}
+					tap.ObserveServer(b[:n])
+					b = b[n:]
+				}
+			}
+			feed(serverOffer)
+			tap.ObserveClient(clientHandshake)
+			feed(join(serverInit, tt.messages))
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s in chunks of %d: got texts %q, want %q", tt.name, chunk, got, tt.want)
+			}
+		}
+	}
+}
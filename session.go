@@ -0,0 +1,215 @@
+package vncd
+
+import (
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConnInfo describes a proxied connection (session)
+type ConnInfo struct {
+	ID         string            `json:"id"`
+	RemoteAddr string            `json:"remote"`
+	Target     string            `json:"target"`
+	Started    time.Time         `json:"started"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// IDGenerator returns the ID of a new connection. The ID field of info is not
+// yet set.
+type IDGenerator func(info ConnInfo) string
+
+// RandomID is the default IDGenerator returning random hex strings
+func RandomID(info ConnInfo) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newConnInfo describes a new connection and stamps it with an ID from gen, or
+// a random ID if gen is nil
+func newConnInfo(gen IDGenerator, remoteAddr string, labels map[string]string) ConnInfo {
+	info := ConnInfo{
+		RemoteAddr: remoteAddr,
+		Labels:     labels,
+	}
+	if gen == nil {
+		gen = RandomID
+	}
+	info.ID = gen(info)
+	return info
+}
+
+/******************************************************************************
+  Labels
+ ******************************************************************************/
+
+// LabelMapping derives session labels from a connection. Keys are label names,
+// values describe the source of the label value:
+//
+//	query:<name>   query parameter of the websocket handshake
+//	header:<name>  header of the websocket handshake
+//	cn             common name of the verified client certificate
+//	<value>        any other value is used literally
+//
+// Labels whose source is not available for a connection are omitted.
+type LabelMapping map[string]string
+
+// labels evaluates the mapping for a connection. r and subject may be nil.
+func (m LabelMapping) labels(r *http.Request, subject *pkix.Name) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+
+	labels := make(map[string]string)
+	for key, source := range m {
+		var value string
+		switch {
+		case strings.HasPrefix(source, "query:"):
+			if r != nil {
+				value = r.URL.Query().Get(strings.TrimPrefix(source, "query:"))
+			}
+		case strings.HasPrefix(source, "header:"):
+			if r != nil {
+				value = r.Header.Get(strings.TrimPrefix(source, "header:"))
+			}
+		case source == "cn":
+			if subject != nil {
+				value = subject.CommonName
+			}
+		default:
+			value = source
+		}
+		if value != "" {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+/******************************************************************************
+  Session registry
+ ******************************************************************************/
+
+// SessionRegistry keeps track of the open sessions of one or more servers. It
+// serves them as JSON via HTTP (see ServeHTTP).
+type SessionRegistry struct {
+	mux       sync.Mutex
+	sessions  map[string]ConnInfo
+	pending   int       // connections waiting for their backend
+	idleSince time.Time // when the last session or connection ended
+}
+
+// NewSessionRegistry creates an empty SessionRegistry
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		sessions:  make(map[string]ConnInfo),
+		idleSince: time.Now(),
+	}
+}
+
+// add registers an open session. It is safe to call on a nil registry.
+func (r *SessionRegistry) add(info ConnInfo) {
+	if r == nil {
+		return
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.sessions[info.ID] = info
+}
+
+// remove deregisters a session. It is safe to call on a nil registry.
+func (r *SessionRegistry) remove(id string) {
+	if r == nil {
+		return
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	delete(r.sessions, id)
+	if len(r.sessions) == 0 {
+		r.idleSince = time.Now()
+	}
+}
+
+// connect counts a connection that is not yet a session, e.g. while its
+// backend is created, until the returned function is called. It is safe to
+// call on a nil registry.
+func (r *SessionRegistry) connect() (done func()) {
+	if r == nil {
+		return func() {}
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.pending++
+	return func() {
+		r.mux.Lock()
+		defer r.mux.Unlock()
+		r.pending--
+		if r.pending == 0 && len(r.sessions) == 0 {
+			r.idleSince = time.Now()
+		}
+	}
+}
+
+// Idle returns for how long there have been no open sessions or connections
+// waiting for a backend, i.e. the time since the last one ended or since the
+// registry was created. It returns zero while any are open.
+func (r *SessionRegistry) Idle() time.Duration {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if len(r.sessions) > 0 || r.pending > 0 {
+		return 0
+	}
+	return time.Since(r.idleSince)
+}
+
+// Sessions returns the open sessions carrying all labels in selector, ordered
+// by start time
+func (r *SessionRegistry) Sessions(selector map[string]string) []ConnInfo {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	sessions := make([]ConnInfo, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		if matchLabels(s.Labels, selector) {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Started.Before(sessions[j].Started)
+	})
+	return sessions
+}
+
+// ServeHTTP lists the open sessions. Sessions can be filtered by labels with
+// one or more 'label' query parameters, e.g. /sessions?label=tenant=acme
+func (r *SessionRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	selector := make(map[string]string)
+	for _, l := range req.URL.Query()["label"] {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			http.Error(w, "Invalid label selector "+l, http.StatusBadRequest)
+			return
+		}
+		selector[kv[0]] = kv[1]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Sessions(selector))
+}
+
+// matchLabels returns true if labels contain all key/value pairs of selector
+func matchLabels(labels, selector map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
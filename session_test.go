@@ -0,0 +1,66 @@
+package vncd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSessionRegistryServeHTTP(t *testing.T) {
+	r := NewSessionRegistry()
+	start := time.Now()
+	for i, labels := range []map[string]string{
+		{"tenant": "acme", "team": "a"},
+		{"tenant": "acme", "team": "b"},
+		{"tenant": "globex"},
+		nil,
+	} {
+		r.add(ConnInfo{ID: string(rune('a' + i)), Labels: labels, Started: start.Add(time.Duration(i) * time.Second)})
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		want     []string // session IDs in order
+	}{
+		{"all sessions", "", http.StatusOK, []string{"a", "b", "c", "d"}},
+		{"by tenant", "?label=tenant=acme", http.StatusOK, []string{"a", "b"}},
+		{"by tenant and team", "?label=tenant=acme&label=team=b", http.StatusOK, []string{"b"}},
+		{"no match", "?label=tenant=initech", http.StatusOK, []string{}},
+		{"empty value", "?label=tenant=", http.StatusOK, []string{"d"}},
+		{"invalid selector", "?label=tenant", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest("GET", "/sessions"+tt.query, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("GET /sessions%s = %d, want %d", tt.query, rec.Code, tt.wantCode)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var sessions []ConnInfo
+			if err := json.Unmarshal(rec.Body.Bytes(), &sessions); err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]string, len(sessions))
+			for i, s := range sessions {
+				ids[i] = s.ID
+			}
+			if len(ids) != len(tt.want) {
+				t.Fatalf("Sessions %v, want %v", ids, tt.want)
+			}
+			for i := range ids {
+				if ids[i] != tt.want[i] {
+					t.Errorf("Sessions %v, want %v", ids, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
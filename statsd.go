@@ -0,0 +1,83 @@
+package vncd
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+/******************************************************************************
+  StatsD
+ ******************************************************************************/
+
+// StatsD sends session metrics to a StatsD server via UDP. It is a
+// BackendObserver and emits a metric line for every backend event:
+//
+//	<prefix>.connections:1|c             a session became ready
+//	<prefix>.backend_errors:1|c          a backend could not be created
+//	<prefix>.backend_create:<ms>|ms      time to create a backend
+//	<prefix>.backend_terminate:<ms>|ms   time to terminate a backend
+//	<prefix>.open_sessions:<n>|g         open sessions (if Registry is set)
+//	<prefix>.bytes_in:<n>|c              bytes relayed from clients to backends
+//	<prefix>.bytes_out:<n>|c             bytes relayed from backends to clients
+//
+// Metrics are sent on a best-effort basis; send errors are ignored.
+type StatsD struct {
+	Prefix   string           // prefix of metric names ("vncd" if empty)
+	Registry *SessionRegistry // source of the open sessions gauge (optional)
+	conn     net.Conn
+}
+
+// NewStatsD creates an emitter sending to the StatsD server at addr
+// (host:port)
+func NewStatsD(addr string) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsD{conn: conn}, nil
+}
+
+// Close closes the connection to the StatsD server
+func (s *StatsD) Close() error {
+	return s.conn.Close()
+}
+
+// OnCreate emits the creation time of a backend or counts the failure
+func (s *StatsD) OnCreate(e BackendEvent) {
+	if e.Err != nil {
+		s.send(metricBackendErrors, "1|c")
+		return
+	}
+	s.send(metricBackendCreate, fmt.Sprintf("%d|ms", e.Duration/time.Millisecond))
+}
+
+// OnReady counts the connection and emits the open sessions
+func (s *StatsD) OnReady(e BackendEvent) {
+	s.send(metricConnections, "1|c")
+	s.sendOpenSessions()
+}
+
+// OnTerminate emits the termination time, the bytes relayed during the session
+// and the open sessions
+func (s *StatsD) OnTerminate(e BackendEvent) {
+	s.send(metricBackendTerminate, fmt.Sprintf("%d|ms", e.Duration/time.Millisecond))
+	s.send(metricBytesIn, fmt.Sprintf("%d|c", e.BytesIn))
+	s.send(metricBytesOut, fmt.Sprintf("%d|c", e.BytesOut))
+	s.sendOpenSessions()
+}
+
+func (s *StatsD) sendOpenSessions() {
+	if s.Registry != nil {
+		s.send(metricOpenSessions, fmt.Sprintf("%d|g", len(s.Registry.Sessions(nil))))
+	}
+}
+
+// send writes a metric line of the form <prefix>.<name>:<value>
+func (s *StatsD) send(name, value string) {
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = "vncd"
+	}
+	fmt.Fprintf(s.conn, "%s.%s:%s", prefix, name, value)
+}
@@ -0,0 +1,33 @@
+package vncd
+
+import (
+	"sync"
+
+	"github.com/kramergroup/vncd/backends"
+)
+
+// terminator bounds the number of backends terminated concurrently. On mass
+// shutdown, this prevents overwhelming the Docker daemon or Kubernetes API with
+// termination requests.
+type terminator struct {
+	once sync.Once
+	sem  chan struct{}
+}
+
+// terminate terminates b once fewer than limit other terminations are in
+// progress. A limit <= 0 does not bound concurrency.
+func (t *terminator) terminate(limit int, b backends.Backend) {
+	if limit <= 0 {
+		b.Terminate()
+		return
+	}
+
+	t.once.Do(func() {
+		t.sem = make(chan struct{}, limit)
+	})
+	t.sem <- struct{}{}
+	defer func() {
+		<-t.sem
+	}()
+	b.Terminate()
+}
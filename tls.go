@@ -0,0 +1,134 @@
+package vncd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// Policies for verifying backend certificates (see BackendTLSConfig)
+const (
+	// TLSPolicyStrict verifies the certificate chain and that the certificate
+	// is valid for the backend address
+	TLSPolicyStrict = "strict"
+
+	// TLSPolicySkipSAN verifies the certificate chain, but not the backend
+	// address. This suits backends addressed by IP (e.g. pods) that share a CA.
+	TLSPolicySkipSAN = "skip-san"
+
+	// TLSPolicyInsecure does not verify backend certificates at all
+	TLSPolicyInsecure = "insecure"
+)
+
+// BackendTLSConfig returns the TLS configuration for connecting to backends
+// with the given verification policy. Certificates are verified against the
+// CAs in caFile, or the system CAs if caFile is empty.
+func BackendTLSConfig(policy string, caFile string) (*tls.Config, error) {
+
+	if policy == TLSPolicyInsecure {
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+
+	var roots *x509.CertPool
+	if caFile != "" {
+		var err error
+		if roots, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+
+	switch policy {
+	case TLSPolicyStrict:
+		return &tls.Config{RootCAs: roots}, nil
+	case TLSPolicySkipSAN:
+		// Skip the default verification, which includes the host name, and
+		// verify the chain only
+		return &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				return verifyChain(rawCerts, roots)
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("Unknown backend TLS policy: %s", policy)
+}
+
+// verifyChain verifies the certificate chain presented by a peer against roots
+// without checking the host name
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("Backend presented no certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// loadCertPool reads PEM encoded CA certificates from file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No CA certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// CertificateStore holds the certificate presented by TLS frontends and allows
+// to replace it at runtime. The certificate is swapped atomically, so that all
+// listeners sharing a store present the new certificate from the same moment
+// on. Established connections are not affected.
+type CertificateStore struct {
+	certFile, keyFile string
+	cert              atomic.Value // *tls.Certificate
+}
+
+// LoadCertificateStore creates a store holding the certificate and key in
+// certFile and keyFile
+func LoadCertificateStore(certFile, keyFile string) (*CertificateStore, error) {
+	s := &CertificateStore{certFile: certFile, keyFile: keyFile}
+	return s, s.Reload()
+}
+
+// Reload reads the certificate and key files again. The current certificate
+// is kept if they cannot be read.
+func (s *CertificateStore) Reload() error {
+	cer, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+	s.cert.Store(&cer)
+	return nil
+}
+
+// GetCertificate returns the current certificate (see tls.Config)
+func (s *CertificateStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert.Load().(*tls.Certificate), nil
+}
+
+// TLSConfig returns a TLS configuration presenting the current certificate
+func (s *CertificateStore) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: s.GetCertificate}
+}
@@ -0,0 +1,79 @@
+package vncd
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kramergroup/vncd/rfb"
+)
+
+// limitUpdateRequests wraps the backend connection of a session so that at
+// most rate FramebufferUpdateRequests per second are sent to it (see
+// rfb.UpdateRequestLimiter). The connection is returned unchanged if rate is
+// 0.
+func limitUpdateRequests(conn net.Conn, rate float64) net.Conn {
+	if rate <= 0 {
+		return conn
+	}
+	c := &updateLimitConn{
+		Conn:    conn,
+		limiter: rfb.NewUpdateRequestLimiter(rate),
+		done:    make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// updateLimitConn passes everything sent to the backend through a limiter and
+// sends the requests it holds back
+type updateLimitConn struct {
+	net.Conn
+	limiter *rfb.UpdateRequestLimiter
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (c *updateLimitConn) run() {
+	tick := c.limiter.Interval() / 2
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if _, err := c.limiter.Flush(c.Conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *updateLimitConn) Write(b []byte) (int, error) {
+	return c.limiter.Write(c.Conn, b)
+}
+
+func (c *updateLimitConn) stop() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// Close stops sending held back requests and closes the connection
+func (c *updateLimitConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+// CloseWrite stops sending held back requests and half-closes the connection
+// if the wrapped connection supports it
+func (c *updateLimitConn) CloseWrite() error {
+	c.stop()
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("Connection cannot be half-closed")
+}
@@ -0,0 +1,43 @@
+/*
+Package webclient serves a minimal browser VNC client based on noVNC
+(https://github.com/novnc/noVNC).
+
+The page in static/index.html loads noVNC from static/novnc, which is not part
+of the repository. Fetch a noVNC release into that directory before building
+(see the Makefile target novnc). Available reports whether it has been.
+*/
+package webclient
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// client is the module loaded by static/index.html
+const client = "static/novnc/core/rfb.js"
+
+// Available returns an error if noVNC was not fetched before building, so
+// that the client cannot work
+func Available() error {
+	if _, err := fs.Stat(static, client); err != nil {
+		return errors.New("noVNC is missing from the build (fetch it with make novnc and rebuild)")
+	}
+	return nil
+}
+
+// Handler serves the client pages and relays websocket connections to the ws
+// handler at "websockify", which is where the client connects to. The handler
+// expects to be mounted with its path prefix stripped (see http.StripPrefix).
+func Handler(ws http.Handler) http.Handler {
+	files, _ := fs.Sub(static, "static") // static is always embedded
+
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(files)))
+	mux.Handle("/websockify", ws)
+	return mux
+}
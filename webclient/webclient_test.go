@@ -0,0 +1,46 @@
+package webclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAvailable(t *testing.T) {
+	// The embedded client mirrors whether noVNC was fetched into the source tree
+	_, err := os.Stat(client)
+	fetched := err == nil
+	if err := Available(); (err == nil) != fetched {
+		t.Errorf("Available() = %v with noVNC fetched %t", err, fetched)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ws := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("websocket"))
+	})
+	tests := []struct {
+		name     string
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{"index", "/", http.StatusOK, "<html"},
+		{"websocket", "/websockify", http.StatusOK, "websocket"},
+		{"missing file", "/missing.js", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			Handler(ws).ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("GET %s = %d, want %d", tt.path, rec.Code, tt.wantCode)
+			}
+			if !strings.Contains(strings.ToLower(rec.Body.String()), tt.wantBody) {
+				t.Errorf("GET %s body does not contain %q", tt.path, tt.wantBody)
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package vncd
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509/pkix"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +12,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -23,6 +28,58 @@ type WebsocketServer struct {
 	// Creator creates a new Backend for connection requests
 	BackendFactory func() (backends.Backend, error)
 
+	// ContextBackendFactory creates a new Backend for connection requests with
+	// access to the websocket handshake request. If set, it takes precedence
+	// over BackendFactory.
+	ContextBackendFactory ContextBackendFactory
+
+	// RedirectTarget is the base URL (e.g. https://peer.example.com) of another
+	// instance that new connections are redirected to while draining. If empty,
+	// new connections are refused while draining.
+	RedirectTarget string
+
+	// Sessions, if set, keeps track of open connections
+	Sessions *SessionRegistry
+
+	// IDGenerator stamps each connection with an ID (RandomID if nil)
+	IDGenerator IDGenerator
+
+	// Labels derives the labels attached to each session
+	Labels LabelMapping
+
+	// Observer, if set, is notified about the lifecycle of backends
+	Observer BackendObserver
+
+	// ReadinessProbe, if set, is run against new backends until they are ready
+	// before the proxy connects to them
+	ReadinessProbe backends.Probe
+
+	// Limiter, if set, limits the rate of new connections
+	Limiter *ConnectionLimiter
+
+	// KeepaliveInterval, if set, sends a FramebufferUpdateRequest to the
+	// backend once the client has not sent anything for the interval, as
+	// some VNC servers disconnect idle clients
+	KeepaliveInterval time.Duration
+
+	// Admit, if set, decides about every connection before a backend is
+	// created. The class hint of the admission is passed to the
+	// ContextBackendFactory (see AdmissionClassFromContext).
+	Admit Admitter
+
+	// MaxConcurrentTerminations bounds the number of backends terminated at the
+	// same time, e.g. during shutdown. Zero means no limit.
+	MaxConcurrentTerminations int
+
+	// CutTextSink, if set, receives the clipboard texts backends send to
+	// clients. Texts are truncated to MaxCutText bytes (DefaultMaxCutText if 0).
+	CutTextSink CutTextSink
+	MaxCutText  int
+
+	// IdleTimeout closes a relay (and terminates its backend) if there has been
+	// no traffic in either direction for the given duration. Zero disables it.
+	IdleTimeout time.Duration
+
 	// Pipe termination channels
 	sigs map[chan<- os.Signal]struct{}
 
@@ -31,6 +88,15 @@ type WebsocketServer struct {
 
 	// Use binary mode for communication
 	binaryMode bool
+
+	// Number of open relays
+	open int32
+
+	// Set while draining - existing relays continue, new ones are turned away
+	draining int32
+
+	// terminations bounds concurrent backend terminations
+	terminations terminator
 }
 
 // NewWebsocketServer created a new proxy which sends all packet to target. The function dir
@@ -50,45 +116,208 @@ func NewWebsocketServer(factory func() (backends.Backend, error)) (*WebsocketSer
 	return p, err
 }
 
+// NewContextWebsocketServer creates a new proxy like NewWebsocketServer, but
+// with a factory that receives the websocket handshake request in its context
+// (see RequestFromContext).
+func NewContextWebsocketServer(factory ContextBackendFactory) (*WebsocketServer, error) {
+
+	p := &WebsocketServer{
+		ContextBackendFactory: factory,
+		sigs:                  make(map[chan<- os.Signal]struct{}),
+		binaryMode:            true,
+	}
+
+	var err error
+	if factory == nil {
+		err = errors.New("Backend factory method must not be nil")
+	}
+	return p, err
+}
+
+// SetBinaryMode selects binary (true) or text (false) websocket framing for
+// new relays. Binary framing is the default and is recommended for modern
+// noVNC clients, which negotiate the 'binary' subprotocol.
+func (p *WebsocketServer) SetBinaryMode(binary bool) {
+	p.binaryMode = binary
+}
+
+// BinaryMode returns true if the server uses binary websocket framing
+func (p *WebsocketServer) BinaryMode() bool {
+	return p.binaryMode
+}
+
+// AcceptingConnections returns true if the server is ready to accept new
+// connections.
+func (p *WebsocketServer) AcceptingConnections() bool {
+	return p.accepting && !p.Draining()
+}
+
+// SetDraining starts (true) or stops (false) draining the server. While
+// draining, existing relays continue but new connections are redirected to
+// RedirectTarget or refused.
+func (p *WebsocketServer) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&p.draining, v)
+}
+
+// Draining returns true if the server is draining
+func (p *WebsocketServer) Draining() bool {
+	return atomic.LoadInt32(&p.draining) == 1
+}
+
+// CountOpenConnections returns the number of open websocket relays
+func (p *WebsocketServer) CountOpenConnections() int {
+	return int(atomic.LoadInt32(&p.open))
+}
+
 // ListenAndServe listens on the TCP network address laddr and then handle packets
-// on incoming connections.
-func (p *WebsocketServer) ListenAndServe(laddr *net.TCPAddr) {
+// on incoming connections. It blocks until the server fails and returns the
+// error, e.g. if laddr cannot be bound.
+func (p *WebsocketServer) ListenAndServe(laddr *net.TCPAddr) error {
+
+	p.accepting = true
+	defer func() {
+		p.accepting = false
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle("/", p.Handler())
+	return http.ListenAndServe(laddr.String(), mux)
+}
+
+// ListenAndServeTLS acts identically to ListenAndServe, except that it serves
+// wss connections using config, which must contain the server certificate. If
+// config requires client certificates (see MutualTLSConfig), the verified
+// certificate subject is available to the ContextBackendFactory through
+// ClientSubjectFromContext.
+func (p *WebsocketServer) ListenAndServeTLS(laddr *net.TCPAddr, config *tls.Config) error {
 
 	p.accepting = true
 	defer func() {
 		p.accepting = false
 	}()
 
-	handler := func(ws *websocket.Conn) {
+	mux := http.NewServeMux()
+	mux.Handle("/", p.Handler())
+	srv := &http.Server{
+		Addr:      laddr.String(),
+		Handler:   mux,
+		TLSConfig: config,
+	}
+	return srv.ListenAndServeTLS("", "")
+}
+
+// Handler returns the HTTP handler upgrading requests to websocket relays. New
+// requests are redirected or refused while draining.
+func (p *WebsocketServer) Handler() http.Handler {
+	relay := websocket.Handler(func(ws *websocket.Conn) {
 		p.relayHandler(ws)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.Draining() {
+			if p.RedirectTarget != "" {
+				target := strings.TrimSuffix(p.RedirectTarget, "/") + r.URL.RequestURI()
+				log.Println("Draining - redirecting connection to " + target)
+				http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+				return
+			}
+			http.Error(w, "Server is draining", http.StatusServiceUnavailable)
+			return
+		}
+		if !p.Limiter.Allow(r.RemoteAddr) {
+			log.Println("Rate limit exceeded - rejecting connection from " + r.RemoteAddr)
+			http.Error(w, "Too many connections", http.StatusTooManyRequests)
+			return
+		}
+		relay.ServeHTTP(w, r)
+	})
+}
+
+// MutualTLSConfig returns a TLS configuration presenting the certificate of
+// certs and requiring clients to present a certificate signed by one of the
+// CAs in caFile.
+func MutualTLSConfig(certs *CertificateStore, caFile string) (*tls.Config, error) {
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
 	}
 
-	http.Handle("/", websocket.Handler(handler))
-	log.Fatal(http.ListenAndServe(laddr.String(), nil))
+	config := certs.TLSConfig()
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
 }
 
 func (p *WebsocketServer) relayHandler(ws *websocket.Conn) {
 
+	atomic.AddInt32(&p.open, 1)
+	defer atomic.AddInt32(&p.open, -1)
+	defer p.Sessions.connect()()
+
 	var backend *backends.Backend
 	var err error
 	var target *net.TCPAddr
 	var conn net.Conn
 
 	// Initiate the backend
-	backend, err = p.createBackend()
+	var subject *pkix.Name
+	ctx := contextWithRequest(ws.Request().Context(), ws.Request())
+	if state := ws.Request().TLS; state != nil && len(state.VerifiedChains) > 0 {
+		subject = &state.VerifiedChains[0][0].Subject
+		ctx = contextWithClientSubject(ctx, *subject)
+	}
+	info := newConnInfo(p.IDGenerator, ws.Request().RemoteAddr, p.Labels.labels(ws.Request(), subject))
+	admission := admit(p.Admit, info)
+	if !admission.Allowed {
+		ws.Close()
+		return
+	}
+	ctx = contextWithAdmissionClass(ctx, admission.Class)
+	created := time.Now()
+	backend, err = p.createBackend(ctx)
+	observeCreate(p.Observer, info, created, err)
 	if err != nil {
 		log.Printf(err.Error())
 		ws.Close()
 		return
 	}
-	defer (*backend).Terminate()
+	created = time.Now()
+	var relayed traffic
+	defer func() {
+		start := time.Now()
+		p.terminations.terminate(p.MaxConcurrentTerminations, *backend)
+		observeTerminate(p.Observer, info, start, &relayed)
+	}()
 
 	target, err = (*backend).GetTarget()
 	if err != nil {
-		log.Printf("Could not get backend target [%v] \n", err)
+		log.Printf("Could not get target of backend %s [%v] \n", (*backend).ID(), err)
+		ws.Close()
+		return
+	}
+
+	readyCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	err = (*backend).Ready(readyCtx)
+	cancel()
+	if err != nil {
+		log.Println(err)
 		ws.Close()
 		return
 	}
+	if p.ReadinessProbe != nil {
+		readyCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err = backends.WaitReady(readyCtx, *backend, p.ReadinessProbe, time.Second)
+		cancel()
+		if err != nil {
+			log.Println(err)
+			ws.Close()
+			return
+		}
+	}
 
 	conn, err = p.dialConnection(target.String())
 	if err != nil {
@@ -96,16 +325,25 @@ func (p *WebsocketServer) relayHandler(ws *websocket.Conn) {
 		ws.Close()
 		return
 	}
+	conn = tapCutText(conn, p.CutTextSink, p.MaxCutText, info)
+	conn = keepaliveBackend(conn, p.KeepaliveInterval)
 
 	if p.binaryMode {
 		ws.PayloadType = websocket.BinaryFrame
 	}
 
-	log.Println("Starting websocket pipe to " + target.String())
+	info.Target = target.String()
+	info.Started = time.Now()
+	p.Sessions.add(info)
+	defer p.Sessions.remove(info.ID)
+	observeReady(p.Observer, info, created)
+
+	log.Println("Starting websocket pipe [" + info.ID + "] to " + target.String() + " (backend " + (*backend).ID() + ")")
 	doneCh := make(chan bool)
+	lastActivity := time.Now().UnixNano()
 
-	go copyWorker(ws, conn, doneCh)
-	go copyWorker(conn, ws, doneCh)
+	go p.copyWorker(ws, conn, &lastActivity, &relayed.out, doneCh)
+	go p.copyWorker(conn, ws, &lastActivity, &relayed.in, doneCh)
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -114,51 +352,33 @@ func (p *WebsocketServer) relayHandler(ws *websocket.Conn) {
 	case <-doneCh:
 	case <-sigs:
 	}
-	log.Println("Closing websocket pipe to " + target.String())
+	log.Println("Closing websocket pipe [" + info.ID + "] to " + target.String() + " (backend " + (*backend).ID() + ")")
 	conn.Close()
 	ws.Close()
 	<-doneCh
 }
 
+// dialConnection connects to the VNC server of a ready backend
 func (p *WebsocketServer) dialConnection(target string) (net.Conn, error) {
-	// connects to VNC server - try for 5 seconds to give time for VNC to come up
-	var rconn net.Conn
-	var establishRemoteConn = true
-	remoteConnEstablishedCh := make(chan bool)
-	go func() {
-		var err error
-		for establishRemoteConn {
-			// if p.Config == nil {
-			// 	rconn, err = net.Dial("tcp", target)
-			// 	establishRemoteConn = (err != nil)
-			// } else {
-			// 	rconn, err = tls.Dial("tcp", target, p.Config)
-			// 	establishRemoteConn = (err != nil)
-			// }
-			rconn, err = net.Dial("tcp", target)
-			establishRemoteConn = (err != nil)
-		}
-		remoteConnEstablishedCh <- (err == nil)
-	}()
-
-	select {
-	case <-time.After(30 * time.Second):
-		return nil, fmt.Errorf("Timeout connecting to TCP port")
-	case ok := <-remoteConnEstablishedCh:
-		if !ok {
-			return nil, fmt.Errorf("Failed to establish connection to backend")
-		}
+	rconn, err := net.DialTimeout("tcp", target, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to establish connection to backend: %v", err)
 	}
 	return rconn, nil
 }
 
-func (p *WebsocketServer) createBackend() (*backends.Backend, error) {
+func (p *WebsocketServer) createBackend(ctx context.Context) (*backends.Backend, error) {
+	factory := p.ContextBackendFactory
+	if factory == nil {
+		factory = WithoutContext(p.BackendFactory)
+	}
+
 	// Initiate the backend
 	backendCreatedCh := make(chan bool)
 	var backend backends.Backend
 	go func() {
 		var err error
-		backend, err = p.BackendFactory()
+		backend, err = factory(ctx)
 		if err != nil {
 			log.Println(err)
 		}
@@ -176,7 +396,47 @@ func (p *WebsocketServer) createBackend() (*backends.Backend, error) {
 	}
 }
 
-func copyWorker(dst net.Conn, src net.Conn, doneCh chan<- bool) {
-	io.Copy(dst, src)
-	doneCh <- true
+// copyWorker copies from src to dst until either fails and adds the bytes
+// written to count. If an idle timeout is set, src is read with deadlines and
+// the copy ends once lastActivity (shared by both directions of the relay) is
+// older than the timeout.
+func (p *WebsocketServer) copyWorker(dst net.Conn, src net.Conn, lastActivity *int64, count *int64, doneCh chan<- bool) {
+	defer func() {
+		doneCh <- true
+	}()
+
+	if p.IdleTimeout <= 0 {
+		n, _ := io.Copy(dst, src)
+		atomic.AddInt64(count, n)
+		return
+	}
+
+	poll := time.Second
+	if p.IdleTimeout < poll {
+		poll = p.IdleTimeout
+	}
+
+	buff := make([]byte, 65535)
+	for {
+		src.SetReadDeadline(time.Now().Add(poll))
+		n, err := src.Read(buff)
+		if n > 0 {
+			atomic.StoreInt64(lastActivity, time.Now().UnixNano())
+			written, werr := dst.Write(buff[:n])
+			atomic.AddInt64(count, int64(written))
+			if werr != nil {
+				return
+			}
+		}
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			if time.Since(time.Unix(0, atomic.LoadInt64(lastActivity))) > p.IdleTimeout {
+				log.Println("Closing idle websocket relay")
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+	}
 }
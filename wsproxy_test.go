@@ -0,0 +1,171 @@
+package vncd
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kramergroup/vncd/backends"
+	"golang.org/x/net/websocket"
+)
+
+// silentBackend accepts connections but never sends anything
+type silentBackend struct {
+	backends.BaseBackend
+	listener   net.Listener
+	terminated chan struct{}
+	once       sync.Once
+}
+
+func newSilentBackend(t *testing.T) *silentBackend {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &silentBackend{listener: l, terminated: make(chan struct{})}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go ioutil.ReadAll(conn)
+		}
+	}()
+	return b
+}
+
+func (b *silentBackend) GetTarget() (*net.TCPAddr, error) {
+	return b.listener.Addr().(*net.TCPAddr), nil
+}
+
+func (b *silentBackend) ID() string {
+	return "silent"
+}
+
+func (b *silentBackend) Terminate() {
+	b.once.Do(func() {
+		b.listener.Close()
+		close(b.terminated)
+	})
+}
+
+func TestWebsocketServerIdleTimeout(t *testing.T) {
+	backend := newSilentBackend(t)
+	p, err := NewWebsocketServer(func() (backends.Backend, error) {
+		return backend, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.IdleTimeout = 200 * time.Millisecond
+	srv := httptest.NewServer(p.Handler())
+	defer srv.Close()
+
+	// The client connects and stays silent, like the backend
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/websockify", "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	connected := time.Now()
+
+	select {
+	case <-backend.terminated:
+		if d := time.Since(connected); d < p.IdleTimeout {
+			t.Errorf("Backend terminated after %v, want at least %v", d, p.IdleTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Backend of an idle relay not terminated")
+	}
+
+	// The relay is closed towards the client
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Idle relay still open")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("Idle relay not closed")
+	}
+}
+
+func TestWebsocketServerDraining(t *testing.T) {
+	tests := []struct {
+		name         string
+		redirect     string
+		wantCode     int
+		wantLocation string
+	}{
+		{
+			name:         "redirect to peer",
+			redirect:     "https://peer.example.com",
+			wantCode:     http.StatusTemporaryRedirect,
+			wantLocation: "https://peer.example.com/websockify?token=abc%20def",
+		},
+		{
+			name:         "redirect to peer with trailing slash",
+			redirect:     "https://peer.example.com/",
+			wantCode:     http.StatusTemporaryRedirect,
+			wantLocation: "https://peer.example.com/websockify?token=abc%20def",
+		},
+		{
+			name:     "no peer",
+			wantCode: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var created int32
+			p, err := NewWebsocketServer(func() (backends.Backend, error) {
+				atomic.AddInt32(&created, 1)
+				return nil, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.RedirectTarget = tt.redirect
+			p.SetDraining(true)
+
+			srv := httptest.NewServer(p.Handler())
+			defer srv.Close()
+
+			// A websocket handshake, which is not followed to the peer
+			req, err := http.NewRequest("GET", srv.URL+"/websockify?token=abc%20def", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			client := &http.Client{
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("Status code = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if got := resp.Header.Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+			if n := atomic.LoadInt32(&created); n != 0 {
+				t.Errorf("%d backends created while draining", n)
+			}
+			if p.AcceptingConnections() {
+				t.Error("Draining server reports accepting connections")
+			}
+		})
+	}
+}